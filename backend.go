@@ -0,0 +1,344 @@
+package splitpt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt/common/bridgeline"
+	"anticensorshiptrafficsplitting/splitpt/common/ptproto"
+
+	"github.com/BurntSushi/toml"
+)
+
+// BridgeLineFile is the file in the state directory to which StartBackends
+// writes the bridge line of the splitpt server.
+const BridgeLineFile = "splitpt_bridgeline.txt"
+
+const (
+	// minRelaunchDelay and maxRelaunchDelay bound the delay before a
+	// backend that exited is launched again. The delay doubles each time
+	// a backend exits soon after it was launched.
+	minRelaunchDelay = 1 * time.Second
+	maxRelaunchDelay = 1 * time.Minute
+)
+
+// BackendConfig describes the PT servers that a splitpt server launches in
+// front of itself, which accept the paths clients open and forward them to
+// the splitpt server as if it were tor's ORPort. Each path a client splits
+// over goes to one of the backends.
+type BackendConfig struct {
+	LyrebirdPath string    `toml:"lyrebird_path"`
+	Backends     []Backend `toml:"backends"`
+	// SplittingAlg, if set, is the splitting algorithm the bridge line
+	// suggests clients use.
+	SplittingAlg string `toml:"splitting_alg"`
+	// Tuning, if set, is the preset of the splitpt server's tuning, which
+	// the bridge line names so that clients can check theirs against it.
+	Tuning string `toml:"-"`
+	// StateDir is where each backend keeps its keys, in a subdirectory
+	// of its own, and where the bridge line is written.
+	StateDir string `toml:"-"`
+	// Logger receives log messages. If nil, the standard logger is used.
+	Logger *log.Logger `toml:"-"`
+	// Reporter, if not nil, receives the LOG and STATUS lines of the
+	// backends, and the backends' progress.
+	Reporter Reporter `toml:"-"`
+}
+
+// Backend is one PT server of a BackendConfig.
+type Backend struct {
+	// Method is the transport method the backend serves, "obfs4" if
+	// empty.
+	Method string `toml:"method"`
+	// BindAddr is the address the backend listens on, such as
+	// "0.0.0.0:9090".
+	BindAddr string `toml:"bind_addr"`
+	// Options are the backend's transport options, such as
+	// "iat-mode=1".
+	Options []string `toml:"options"`
+}
+
+// LoadBackendConfig reads and validates a TOML file of backends.
+func LoadBackendConfig(tomlFilename string) (*BackendConfig, error) {
+	var config BackendConfig
+	_, err := toml.DecodeFile(tomlFilename, &config)
+	if err != nil {
+		return nil, err
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (config *BackendConfig) validate() error {
+	if config.LyrebirdPath == "" {
+		return errors.New("Error processing TOML: No path to lyrebird binary specified")
+	}
+	if len(config.Backends) == 0 {
+		return errors.New("No backends in TOML")
+	}
+	if strings.ContainsAny(config.SplittingAlg, " \n\x00") {
+		return errors.New("Invalid splitting algorithm in TOML")
+	}
+	for _, b := range config.Backends {
+		if strings.ContainsAny(b.Method, " ,=-\n\x00") {
+			return fmt.Errorf("Invalid backend method %q in TOML", b.Method)
+		}
+		if _, _, err := net.SplitHostPort(b.BindAddr); err != nil {
+			return fmt.Errorf("Invalid backend bindaddr %q in TOML: %w", b.BindAddr, err)
+		}
+		for _, option := range b.Options {
+			if !strings.Contains(option, "=") || strings.ContainsAny(option, ";\n\x00") {
+				return fmt.Errorf("Invalid backend option %q in TOML", option)
+			}
+		}
+	}
+	return nil
+}
+
+// Backends is a set of running backend PT servers.
+type Backends struct {
+	config BackendConfig
+	orAddr string
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lock sync.Mutex
+	// methods holds what each backend last offered.
+	methods []ptproto.ServerMethod
+}
+
+// StartBackends launches the backends of config, with orAddr, the address of
+// the splitpt server's listener, as their ORPort, and waits until each offers
+// its method. It writes the bridge line of the splitpt server to
+// BridgeLineFile in config.StateDir. The backends are kept running, and
+// launched again whenever they exit, until Close.
+func StartBackends(config BackendConfig, orAddr string) (*Backends, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	if config.StateDir == "" {
+		return nil, errors.New("backends need a state directory")
+	}
+	if config.Logger == nil {
+		config.Logger = log.Default()
+	}
+	if config.Reporter == nil {
+		config.Reporter = nopReporter{}
+	}
+	for i := range config.Backends {
+		if config.Backends[i].Method == "" {
+			config.Backends[i].Method = defaultMethod
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Backends{
+		config:  config,
+		orAddr:  loopbackAddr(orAddr),
+		ctx:     ctx,
+		cancel:  cancel,
+		methods: make([]ptproto.ServerMethod, len(config.Backends)),
+	}
+	var procs []*ptProcess
+	for i := range config.Backends {
+		p, err := b.launch(i)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		procs = append(procs, p)
+	}
+	for i, p := range procs {
+		b.wg.Add(1)
+		go b.supervise(i, p)
+	}
+	err = b.writeBridgeLine()
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close stops the backends.
+func (b *Backends) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	return nil
+}
+
+// launch launches backend i and waits until it offers its method.
+func (b *Backends) launch(i int) (*ptProcess, error) {
+	backend := b.config.Backends[i]
+	_, port, _ := net.SplitHostPort(backend.BindAddr)
+	child := childPT{
+		path:     b.config.LyrebirdPath,
+		stateDir: filepath.Join(b.config.StateDir, backend.Method+"-"+port),
+		method:   backend.Method,
+		relay: func(line ptproto.Line) {
+			relayLine(b.config.Reporter, backend.Method, backend.BindAddr, line)
+		},
+		relayStderr: func(text string) {
+			b.config.Logger.Printf("%s %s: %s", backend.Method, backend.BindAddr, text)
+			b.config.Reporter.Log("warning", fmt.Sprintf("%s %s: %s", backend.Method, backend.BindAddr, text))
+		},
+	}
+	err := os.MkdirAll(child.stateDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	env := []string{
+		"TOR_PT_SERVER_TRANSPORTS=" + backend.Method,
+		"TOR_PT_SERVER_BINDADDR=" + backend.Method + "-" + backend.BindAddr,
+		"TOR_PT_ORPORT=" + b.orAddr,
+	}
+	if len(backend.Options) > 0 {
+		var options []string
+		for _, option := range backend.Options {
+			options = append(options, backend.Method+":"+option)
+		}
+		env = append(env, "TOR_PT_SERVER_TRANSPORT_OPTIONS="+strings.Join(options, ";"))
+	}
+	startup := ptproto.ServerStartup{Method: backend.Method}
+	var method *ptproto.ServerMethod
+	p, err := child.launch(b.ctx, b.config.Logger, env, func(text string) (bool, error) {
+		m, err := startup.Line(text)
+		method = m
+		return m != nil, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("launching backend %s %s: %w", backend.Method, backend.BindAddr, err)
+	}
+	b.config.Logger.Printf("Backend %s listening on %s", backend.Method, method.Addr)
+	b.lock.Lock()
+	b.methods[i] = *method
+	b.lock.Unlock()
+	return p, nil
+}
+
+// supervise launches backend i again whenever it exits, until Close. p is its
+// running process.
+func (b *Backends) supervise(i int, p *ptProcess) {
+	defer b.wg.Done()
+	backend := b.config.Backends[i]
+	delay := minRelaunchDelay
+	launched := time.Now()
+	for {
+		select {
+		case <-b.ctx.Done():
+			<-p.exited
+			return
+		case <-p.exited:
+		}
+		msg := fmt.Sprintf("Backend %s %s exited", backend.Method, backend.BindAddr)
+		b.config.Logger.Print(msg)
+		b.config.Reporter.Log("warning", msg)
+		if time.Since(launched) > maxRelaunchDelay {
+			delay = minRelaunchDelay
+		}
+		for {
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(2*delay, maxRelaunchDelay)
+			var err error
+			p, err = b.launch(i)
+			if err == nil {
+				break
+			}
+			b.config.Logger.Printf("Error relaunching backend: %s", err.Error())
+			b.config.Reporter.Log("warning", "Error relaunching backend: "+err.Error())
+		}
+		launched = time.Now()
+	}
+}
+
+// BridgeLine returns the bridge line of the splitpt server, which names every
+// backend and the arguments clients need to connect to it. Backends listening
+// on every address are given the placeholder address "<IP_ADDRESS>", to be
+// replaced with the server's public address.
+func (b *Backends) BridgeLine() string {
+	return b.Bridge().String()
+}
+
+// Bridge returns the bridge that BridgeLine encodes.
+func (b *Backends) Bridge() *bridgeline.Bridge {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	bridge := &bridgeline.Bridge{
+		Fingerprint: "<FINGERPRINT>",
+		Alg:         b.config.SplittingAlg,
+		Tuning:      b.config.Tuning,
+	}
+	for _, m := range b.methods {
+		bridge.Paths = append(bridge.Paths, bridgeline.Path{
+			Method: m.Name,
+			Addr:   publicAddr(m.Addr),
+			Args:   m.Args,
+		})
+	}
+	return bridge
+}
+
+// writeBridgeLine writes the bridge line to BridgeLineFile in the state
+// directory, replacing it atomically.
+func (b *Backends) writeBridgeLine() error {
+	text := `# splitpt torrc client bridge line
+#
+# This file is generated from the backends splitpt launched. EDITING IT WILL
+# HAVE NO EFFECT.
+#
+# Before distributing this bridge, replace the placeholders with the public
+# IP address of the server and the fingerprint of its tor bridge.
+
+` + b.BridgeLine() + "\n"
+	file := filepath.Join(b.config.StateDir, BridgeLineFile)
+	err := os.WriteFile(file+".tmp", []byte(text), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// publicAddr replaces an unspecified IP address in addr with a placeholder.
+func publicAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return "<IP_ADDRESS>:" + port
+	}
+	return addr
+}
+
+// loopbackAddr replaces an unspecified IP address in addr with the loopback
+// address, at which a listener on every address can be reached locally.
+func loopbackAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsUnspecified() {
+		return addr
+	}
+	if ip.To4() != nil {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return net.JoinHostPort("::1", port)
+}
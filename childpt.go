@@ -0,0 +1,141 @@
+package splitpt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt/common/ptproto"
+)
+
+// ptStartupTimeout bounds the time a child PT takes to offer its method.
+const ptStartupTimeout = 30 * time.Second
+
+// childPT describes a child PT process to launch.
+type childPT struct {
+	path     string
+	stateDir string
+	// method is the transport method to ask the process for, such as
+	// "obfs4".
+	method string
+	// relay receives the LOG and STATUS lines the process writes, and
+	// relayStderr the lines it writes to its standard error.
+	relay       func(ptproto.Line)
+	relayStderr func(string)
+}
+
+// ptProcess is a running child PT.
+type ptProcess struct {
+	cmd *exec.Cmd
+	// exited is closed once the process has exited.
+	exited chan struct{}
+}
+
+// kill kills the process.
+func (p *ptProcess) kill() {
+	p.cmd.Process.Kill()
+}
+
+// launch starts the child PT with the managed proxy environment variables
+// env, besides those that every PT gets, and passes each line it writes to
+// startup until startup reports that the PT has started, by returning true,
+// or failed. If the PT fails to start, or does not start within
+// ptStartupTimeout, it is killed. Otherwise it is killed when ctx is done.
+func (child childPT) launch(ctx context.Context, logger *log.Logger, env []string, startup func(text string) (bool, error)) (*ptProcess, error) {
+	ptproc := exec.CommandContext(ctx, child.path, "-enableLogging", "-logLevel", "DEBUG")
+	// The PT protocol variables tor gave us are not meant for the child.
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "TOR_PT_") {
+			ptproc.Env = append(ptproc.Env, v)
+		}
+	}
+	ptproc.Env = append(ptproc.Env, "TOR_PT_MANAGED_TRANSPORT_VER=1")
+	ptproc.Env = append(ptproc.Env, "TOR_PT_STATE_LOCATION="+child.stateDir)
+	ptproc.Env = append(ptproc.Env, env...)
+
+	logger.Printf("Getting stdoutpipe")
+	ptprocout, err := ptproc.StdoutPipe()
+	if err != nil {
+		logger.Printf("Error getting stdout pipe")
+		return nil, err
+	}
+	ptprocerr, err := ptproc.StderrPipe()
+	if err != nil {
+		logger.Printf("Error getting stderr pipe")
+		return nil, err
+	}
+	logger.Printf("Starting ptproc")
+	err = ptproc.Start()
+	if err != nil {
+		logger.Printf("Error starting PT process: %s", err.Error())
+		return nil, err
+	}
+	p := &ptProcess{cmd: ptproc, exited: make(chan struct{})}
+
+	var stderrDone sync.WaitGroup
+	stderrDone.Add(1)
+	go func() {
+		defer stderrDone.Done()
+		scanner := bufio.NewScanner(ptprocerr)
+		for scanner.Scan() {
+			child.relayStderr(scanner.Text())
+		}
+	}()
+
+	started := make(chan error, 1)
+	go func() {
+		defer close(p.exited)
+		// Read everything the process writes, for as long as it runs,
+		// so that it never blocks writing to a full pipe.
+		done := false
+		scanner := bufio.NewScanner(ptprocout)
+		for scanner.Scan() {
+			if !done {
+				ok, err := startup(scanner.Text())
+				if ok || err != nil {
+					started <- err
+					done = true
+				}
+			}
+			line, err := ptproto.ParseLine(scanner.Text())
+			if err == nil && (line.Keyword == "LOG" || line.Keyword == "STATUS") {
+				child.relay(line)
+			}
+		}
+		if !done {
+			err := scanner.Err()
+			if err == nil {
+				err = errors.New("PT exited during startup")
+			}
+			started <- err
+		}
+		stderrDone.Wait()
+		err3 := ptproc.Wait()
+		if err3 != nil {
+			logger.Printf("Error completing command: %s", err3.Error())
+		}
+	}()
+
+	timer := time.NewTimer(ptStartupTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-started:
+	case <-timer.C:
+		err = fmt.Errorf("PT did not offer method %s within %v", child.method, ptStartupTimeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		logger.Printf("Error starting PT: %s", err.Error())
+		p.kill()
+		return nil, err
+	}
+	return p, nil
+}
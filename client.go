@@ -0,0 +1,913 @@
+/*
+Package splitpt implements traffic splitting across several pluggable
+transport connections.
+
+A client splits one KCP/smux session across every path in its Config; a
+splitpt server reassembles the paths into that session again.
+
+	client, err := splitpt.NewClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	conn, err := client.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// conn is one stream of the split session.
+
+Client options may replace the logger and the function used to dial each
+path, which makes it possible to use splitpt without launching child PTs.
+
+On the server side, Listen turns a net.Listener that receives the paths into
+a Listener of streams. What to do with each stream is up to the caller: the
+splitpt server binary forwards them to tor's ORPort or, in standalone mode,
+to the target the client requested.
+
+	ln, err := splitpt.Listen(tcpListener, splitpt.ServerConfig{})
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handle(conn)
+	}
+*/
+package splitpt
+
+import (
+	"anticensorshiptrafficsplitting/splitpt/common/metrics"
+	"anticensorshiptrafficsplitting/splitpt/common/netem"
+	"anticensorshiptrafficsplitting/splitpt/common/ptproto"
+	split "anticensorshiptrafficsplitting/splitpt/common/split"
+	"anticensorshiptrafficsplitting/splitpt/common/trace"
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+type dummyAddr struct{}
+
+func (addr dummyAddr) Network() string { return "dummy" }
+func (addr dummyAddr) String() string  { return "dummy" }
+
+var errClientClosed = errors.New("client is closed")
+
+var (
+	errPathInUse   = errors.New("session already has a path to the connection")
+	errSessionFull = errors.New("session already has enough paths")
+)
+
+// replaceTimeout bounds each attempt to dial a replacement for a failed path,
+// or a new path for a running session.
+const replaceTimeout = 1 * time.Minute
+
+// defaultMethod is the transport method asked of child PTs if a Connection
+// does not name one.
+const defaultMethod = "obfs4"
+
+// DialFunc dials a single path of a split session. The returned conn carries
+// the turbotunnel-encapsulated packets for that path to the splitpt server.
+type DialFunc func(ctx context.Context, conn Connection) (net.Conn, error)
+
+// Option configures optional parts of a Client.
+type Option func(*Client)
+
+// WithLogger makes the Client log to logger instead of to the standard
+// logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Client) { c.logger = logger }
+}
+
+// WithDialer makes the Client use dial to connect each path instead of
+// launching the child PT named by the path's Transport.
+func WithDialer(dial DialFunc) Option {
+	return func(c *Client) { c.dial = dial }
+}
+
+// WithRecorder makes the Client record a trace of every path's frames, and of
+// its TCP reads and writes if rec.TCP is set, to rec. The Client does not
+// close rec.
+func WithRecorder(rec *trace.Recorder) Option {
+	return func(c *Client) { c.recorder = rec }
+}
+
+// WithMetrics makes the Client count events, such as path switches, in m.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(c *Client) { c.metrics = m }
+}
+
+// WithStateDir makes the Client keep its state, and that of its child PTs, in
+// dir, normally the PT state directory from TOR_PT_STATE_LOCATION, so that
+// what it learns about bridges survives restarts.
+func WithStateDir(dir string) Option {
+	return func(c *Client) { c.stateDir = dir }
+}
+
+// Client is a splitpt client. All streams returned by DialContext share one
+// split session, which is established on first use and re-established if it
+// fails. In per-stream mode there is instead one session per active path, and
+// each stream is pinned to the next session in turn. A Client is safe for
+// concurrent use.
+type Client struct {
+	config   Config
+	logger   *log.Logger
+	dial     DialFunc
+	recorder *trace.Recorder
+	metrics  *metrics.Metrics
+	reporter Reporter
+	stateDir string
+	state    *clientState
+	// tempDir is the state directory of child PTs if there is no
+	// stateDir. It is created on first use and removed by Close.
+	tempOnce sync.Once
+	tempDir  string
+	tempErr  error
+
+	// ctx bounds the lifetime of anything the Client launches, such as
+	// child PT processes. It is cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// refillNow asks maintain to top up the shared session.
+	refillNow chan struct{}
+
+	lock   sync.Mutex
+	sess   *session
+	closed bool
+	// pinned holds the sessions of per-stream mode, one per active path,
+	// and next is the session the next stream is pinned to. retired holds
+	// sessions dropped as the pool shrank, which keep their streams.
+	pinned  []*session
+	next    int
+	retired []*session
+	// dialing, if not nil, is closed once the shared session being
+	// established is established or fails, and pinnedDialing holds the
+	// same for each per-stream session being established. Paths are
+	// dialed without c.lock held.
+	dialing       chan struct{}
+	pinnedDialing map[int]chan struct{}
+	// nextPath is the index of the next path added to a running session.
+	// Paths are identified by index in split sessions and traces.
+	nextPath int
+	// nextConn is the id of the next connection added to the pool.
+	nextConn int
+}
+
+// session is the state belonging to one split session.
+type session struct {
+	id    tt.SessionID
+	pconn split.SplittingPacketConn
+	conn  *kcp.UDPSession
+	smux  *smux.Session
+	// paths maps the index of each of the session's paths to the
+	// connection of the pool it goes to.
+	pathsLock sync.Mutex
+	paths     map[int]Connection
+}
+
+// setPath records that the path with the given index now goes to conn.
+func (s *session) setPath(index int, conn Connection) {
+	s.pathsLock.Lock()
+	defer s.pathsLock.Unlock()
+	s.paths[index] = conn
+}
+
+// forgetPath forgets the path with the given index, which is gone.
+func (s *session) forgetPath(index int) {
+	s.pathsLock.Lock()
+	defer s.pathsLock.Unlock()
+	delete(s.paths, index)
+}
+
+// uses reports whether the session has a path to conn.
+func (s *session) uses(conn Connection) bool {
+	s.pathsLock.Lock()
+	defer s.pathsLock.Unlock()
+	for _, c := range s.paths {
+		if c.id == conn.id {
+			return true
+		}
+	}
+	return false
+}
+
+// pathCount returns how many paths the session has, counting those being
+// dialed or redialed.
+func (s *session) pathCount() int {
+	s.pathsLock.Lock()
+	defer s.pathsLock.Unlock()
+	return len(s.paths)
+}
+
+// claim records that the path with the given index is about to be dialed to
+// conn, so that it counts toward the session's paths while it is dialed and
+// no other dial for the session picks conn. It fails if the session has
+// another path to conn, or if index is a new path and the session already has
+// limit paths. Zero means no limit.
+func (s *session) claim(index int, conn Connection, limit int) error {
+	s.pathsLock.Lock()
+	defer s.pathsLock.Unlock()
+	for i, c := range s.paths {
+		if i != index && c.id == conn.id {
+			return errPathInUse
+		}
+	}
+	if _, ok := s.paths[index]; !ok && limit > 0 && len(s.paths) >= limit {
+		return errSessionFull
+	}
+	s.paths[index] = conn
+	return nil
+}
+
+// connectionOf returns the connection of the session's path with the given
+// index.
+func (s *session) connectionOf(index int) (Connection, bool) {
+	s.pathsLock.Lock()
+	defer s.pathsLock.Unlock()
+	conn, ok := s.paths[index]
+	return conn, ok
+}
+
+// bridgeOf returns the bridge of the session's path with the given index.
+func (s *session) bridgeOf(index int) string {
+	conn, _ := s.connectionOf(index)
+	return conn.Bridge
+}
+
+// oldestPath returns the index of the session's oldest path. Paths are
+// numbered in the order they are added.
+func (s *session) oldestPath() (int, bool) {
+	s.pathsLock.Lock()
+	defer s.pathsLock.Unlock()
+	oldest, ok := 0, false
+	for i := range s.paths {
+		if !ok || i < oldest {
+			oldest, ok = i, true
+		}
+	}
+	return oldest, ok
+}
+
+// removePath retires the session's path with the given index, if it has it.
+func (s *session) removePath(index int) {
+	s.pathsLock.Lock()
+	_, ok := s.paths[index]
+	delete(s.paths, index)
+	s.pathsLock.Unlock()
+	if ok {
+		// The path may already have failed.
+		s.pconn.RemovePath(index)
+	}
+}
+
+// removeBridge retires every path of the session to bridge.
+func (s *session) removeBridge(bridge string) {
+	s.pathsLock.Lock()
+	var indexes []int
+	for i, conn := range s.paths {
+		if conn.Bridge == bridge {
+			indexes = append(indexes, i)
+		}
+	}
+	s.pathsLock.Unlock()
+	for _, i := range indexes {
+		s.removePath(i)
+	}
+}
+
+func (s *session) close() {
+	s.smux.Close()
+	s.conn.Close()
+	s.pconn.Close()
+}
+
+// NewClient returns a new Client for config. No paths are dialed until the
+// first call to DialContext.
+func NewClient(config Config, opts ...Option) (*Client, error) {
+	err := config.useBridgeLine()
+	if err != nil {
+		return nil, err
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	// Number the connections of the pool, in a copy, as the map may be
+	// shared with the caller's config.
+	conns := append([]Connection(nil), config.Connections["connections"]...)
+	for i := range conns {
+		conns[i].id = i
+	}
+	connections := map[string][]Connection{"connections": conns}
+	for k, v := range config.Connections {
+		if k != "connections" {
+			connections[k] = v
+		}
+	}
+	config.Connections = connections
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		config:        config,
+		logger:        log.Default(),
+		reporter:      nopReporter{},
+		ctx:           ctx,
+		cancel:        cancel,
+		refillNow:     make(chan struct{}, 1),
+		pinnedDialing: make(map[int]chan struct{}),
+		nextPath:      len(conns),
+		nextConn:      len(conns),
+	}
+	c.dial = c.dialPT
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.state, err = loadState(c.stateDir)
+	if err != nil {
+		c.logger.Printf("Error loading state: %s", err.Error())
+	}
+	go c.maintain()
+	return c, nil
+}
+
+// DialContext opens a new stream over the client's split session, first
+// establishing the session if necessary. ctx bounds the time spent dialing;
+// it has no effect on the returned conn once DialContext has returned.
+func (c *Client) DialContext(ctx context.Context) (net.Conn, error) {
+	c.logger.Printf("Dialing")
+	sess, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := sess.smux.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Printf("Finished dialing")
+	return stream, nil
+}
+
+// Close tears down the current session, if any, and stops every child PT the
+// client launched. Streams returned by DialContext stop working.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return errClientClosed
+	}
+	c.closed = true
+	c.recordStats(c.sessions())
+	if c.sess != nil {
+		c.sess.close()
+		c.sess = nil
+	}
+	for i, sess := range c.pinned {
+		if sess != nil {
+			sess.close()
+			c.pinned[i] = nil
+		}
+	}
+	for _, sess := range c.retired {
+		sess.close()
+	}
+	c.retired = nil
+	c.cancel()
+	if c.tempDir != "" {
+		os.RemoveAll(c.tempDir)
+	}
+	return nil
+}
+
+// sessions returns the client's live sessions. It is called with c.lock held.
+func (c *Client) sessions() []*session {
+	var sessions []*session
+	for _, sess := range append([]*session{c.sess}, c.pinned...) {
+		if sess != nil {
+			sessions = append(sessions, sess)
+		}
+	}
+	return append(sessions, c.retired...)
+}
+
+// session returns the live split session, establishing a new one if there is
+// none yet or the previous one has failed. Paths are dialed without c.lock
+// held; other callers wait for the dial, or until their own ctx is done or the
+// client is closed.
+func (c *Client) session(ctx context.Context) (*session, error) {
+	if c.config.SplittingAlg == "per-stream" {
+		return c.pinnedSession(ctx)
+	}
+	for {
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			return nil, errClientClosed
+		}
+		if c.sess != nil && !c.sess.smux.IsClosed() {
+			sess := c.sess
+			c.lock.Unlock()
+			return sess, nil
+		}
+		if dialing := c.dialing; dialing != nil {
+			c.lock.Unlock()
+			err := c.waitDial(ctx, dialing)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if c.sess != nil {
+			c.sess.close()
+			c.sess = nil
+		}
+		dialing := make(chan struct{})
+		c.dialing = dialing
+		c.lock.Unlock()
+
+		c.logger.Printf("Starting new session")
+		sess, err := c.dialSession(ctx, c.newSession)
+
+		c.lock.Lock()
+		c.dialing = nil
+		close(dialing)
+		if err == nil && c.closed {
+			sess.close()
+			err = errClientClosed
+		}
+		if err == nil {
+			c.sess = sess
+		}
+		c.lock.Unlock()
+		return sess, err
+	}
+}
+
+// dialSession runs newSession with a ctx that is also done when the client is
+// closed.
+func (c *Client) dialSession(ctx context.Context, newSession func(ctx context.Context) (*session, error)) (*session, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(c.ctx, cancel)
+	defer stop()
+	sess, err := newSession(ctx)
+	if err != nil && c.ctx.Err() != nil {
+		return nil, errClientClosed
+	}
+	return sess, err
+}
+
+// waitDial waits until dialing is closed, ctx is done or the client is closed.
+func (c *Client) waitDial(ctx context.Context, dialing chan struct{}) error {
+	select {
+	case <-dialing:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.ctx.Done():
+		return errClientClosed
+	}
+}
+
+// pinnedSession returns the next per-stream session in turn, establishing it
+// if there is none yet or the previous one has failed. Sessions that cannot
+// be established are skipped. If the next session is being established by
+// another caller, pinnedSession waits for it.
+func (c *Client) pinnedSession(ctx context.Context) (*session, error) {
+	var err error
+	for tries := 0; ; tries++ {
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			return nil, errClientClosed
+		}
+		n := c.resizePinned()
+		if tries >= n {
+			c.lock.Unlock()
+			return nil, err
+		}
+		i := c.next
+		c.next = (c.next + 1) % n
+		sess := c.pinned[i]
+		if dialing := c.pinnedDialing[i]; dialing != nil {
+			c.lock.Unlock()
+			err = c.waitDial(ctx, dialing)
+			if err != nil {
+				return nil, err
+			}
+			c.lock.Lock()
+			if i < len(c.pinned) && c.pinned[i] != nil && !c.pinned[i].smux.IsClosed() {
+				sess = c.pinned[i]
+				c.lock.Unlock()
+				return sess, nil
+			}
+			c.lock.Unlock()
+			err = fmt.Errorf("session %d could not be established", i)
+			continue
+		}
+		if sess != nil && !sess.smux.IsClosed() {
+			c.lock.Unlock()
+			return sess, nil
+		}
+		if sess != nil {
+			sess.close()
+			c.pinned[i] = nil
+		}
+		dialing := make(chan struct{})
+		c.pinnedDialing[i] = dialing
+		// Prefer a bridge that no other per-stream session uses.
+		var others []*session
+		for _, sess := range c.pinned {
+			if sess != nil && !sess.smux.IsClosed() {
+				others = append(others, sess)
+			}
+		}
+		c.lock.Unlock()
+
+		c.logger.Printf("Starting new session %d", i)
+		sess, err = c.dialSession(ctx, func(ctx context.Context) (*session, error) {
+			return c.newPinnedSession(ctx, others)
+		})
+
+		c.lock.Lock()
+		delete(c.pinnedDialing, i)
+		close(dialing)
+		if err == nil && c.closed {
+			sess.close()
+			err = errClientClosed
+		}
+		if err == errClientClosed {
+			c.lock.Unlock()
+			return nil, err
+		}
+		if err != nil {
+			c.lock.Unlock()
+			c.logger.Printf("Error starting session %d: %s", i, err.Error())
+			continue
+		}
+		if i < len(c.pinned) {
+			c.pinned[i] = sess
+		} else {
+			// The pool shrank while the session was dialed.
+			c.retired = append(c.retired, sess)
+		}
+		c.lock.Unlock()
+		return sess, nil
+	}
+}
+
+// resizePinned makes room for one per-stream session per active path,
+// retiring those beyond, and returns how many there are. It is called with
+// c.lock held.
+func (c *Client) resizePinned() int {
+	n := c.activePaths()
+	for len(c.pinned) < n {
+		c.pinned = append(c.pinned, nil)
+	}
+	for _, sess := range c.pinned[n:] {
+		if sess != nil {
+			c.retired = append(c.retired, sess)
+		}
+	}
+	c.pinned = c.pinned[:n]
+	c.next %= n
+	return n
+}
+
+// newPinnedSession establishes a session carried by a single path, preferably
+// to a bridge that none of others uses. If the path fails or is removed, the
+// session moves to another bridge, keeping its streams.
+func (c *Client) newPinnedSession(ctx context.Context, others []*session) (*session, error) {
+	inUse := func(conn Connection) bool {
+		for _, sess := range others {
+			if sess.uses(conn) {
+				return true
+			}
+		}
+		return false
+	}
+	pool := c.pool()
+	conns := c.candidates(pool, inUse, false)
+	conns = append(conns, c.candidates(pool, func(conn Connection) bool { return !inUse(conn) }, false)...)
+	sess := &session{id: tt.NewSessionID(), paths: make(map[int]Connection)}
+	_, ptconn, err := c.dialFirst(ctx, sess, 0, conns, 0)
+	if err != nil {
+		return nil, err
+	}
+	opts := []split.Option{
+		split.WithRecorder(c.recorder),
+		split.WithMetrics(c.metrics),
+		split.WithRedial(func(index int) (net.Conn, error) { return c.replace(sess, index) }),
+		split.WithPriorStats(c.priorStats(sess)),
+	}
+	if c.config.AttachWait != 0 {
+		opts = append(opts, split.WithAttachWait(c.config.AttachWait))
+	}
+	pconn := split.NewRoundRobinPacketConn(sess.id, []net.Conn{ptconn}, dummyAddr{}, opts...)
+	err = c.startSession(sess, pconn)
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// AddPath adds conn to the client's pool of paths. If the shared split session
+// has fewer than ActivePaths paths, conn is dialed and joins it at once,
+// without interrupting its streams; the server attaches the new path to the
+// session by its session ID. Otherwise conn stands by to replace a path that
+// fails.
+func (c *Client) AddPath(ctx context.Context, conn Connection) error {
+	err := c.config.validateConnection(conn)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return errClientClosed
+	}
+	for _, other := range c.config.Connections["connections"] {
+		if other.Bridge == conn.Bridge {
+			c.lock.Unlock()
+			return fmt.Errorf("already have a path to %s", conn.Bridge)
+		}
+	}
+	conn.id = c.nextConn
+	c.nextConn++
+	// Copy the list, as others may be reading it without c.lock.
+	conns := append([]Connection(nil), c.config.Connections["connections"]...)
+	c.config.Connections["connections"] = append(conns, conn)
+	sess, n := c.sess, c.activePaths()
+	c.lock.Unlock()
+	if sess == nil || sess.smux.IsClosed() {
+		return nil
+	}
+	err = c.addPath(ctx, sess, []Connection{conn}, n)
+	if err == errSessionFull {
+		return nil
+	}
+	return err
+}
+
+// Paths returns the client's pool of paths.
+func (c *Client) Paths() []Connection {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]Connection(nil), c.config.Connections["connections"]...)
+}
+
+// RemovePath removes the paths to bridge from the pool, and retires them from
+// every session using them. Sessions carry on over their other paths without
+// interrupting their streams, and are topped up from the pool.
+func (c *Client) RemovePath(bridge string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return errClientClosed
+	}
+	// Build a new list, as others may be reading the old one without
+	// c.lock.
+	conns := c.config.Connections["connections"]
+	var kept []Connection
+	for _, conn := range conns {
+		if conn.Bridge != bridge {
+			kept = append(kept, conn)
+		}
+	}
+	if len(kept) == len(conns) {
+		return fmt.Errorf("no path to %s", bridge)
+	}
+	if len(kept) == 0 {
+		return errors.New("cannot remove the last path")
+	}
+	c.config.Connections["connections"] = kept
+
+	if c.sess != nil {
+		c.sess.removeBridge(bridge)
+	}
+	// A per-stream session whose only path is removed moves to another.
+	for _, sess := range c.pinned {
+		if sess != nil {
+			sess.removeBridge(bridge)
+		}
+	}
+	retired := c.retired[:0]
+	for _, sess := range c.retired {
+		if sess.smux.IsClosed() {
+			sess.close()
+			continue
+		}
+		sess.removeBridge(bridge)
+		retired = append(retired, sess)
+	}
+	c.retired = retired
+	c.kickRefill()
+	c.notice("Removed path to %s", bridge)
+	return nil
+}
+
+func (c *Client) newSession(ctx context.Context) (*session, error) {
+	// TurboTunnel
+	sess := &session{id: tt.NewSessionID(), paths: make(map[int]Connection)}
+	conns, connList, err := c.dialPaths(ctx, sess)
+	if err != nil {
+		c.logger.Printf("Error connecting to pts: %s", err.Error())
+		return nil, err
+	}
+
+	c.logger.Printf("Getting splitting packet conn")
+	var pconn split.SplittingPacketConn
+	opts := []split.Option{
+		split.WithRecorder(c.recorder),
+		split.WithMetrics(c.metrics),
+		split.WithRedial(func(index int) (net.Conn, error) { return c.replace(sess, index) }),
+		split.WithPriorStats(c.priorStats(sess)),
+	}
+	if !c.config.Health.Disable {
+		opts = append(opts, split.WithHealthCheck(c.config.Health.HealthConfig))
+	}
+	if c.config.AttachWait != 0 {
+		opts = append(opts, split.WithAttachWait(c.config.AttachWait))
+	}
+	switch c.config.SplittingAlg {
+	case "round-robin":
+		pconn = split.NewRoundRobinPacketConn(sess.id, connList, dummyAddr{}, opts...)
+	case "random":
+		pconn = split.NewRandomPacketConn(sess.id, connList, dummyAddr{}, opts...)
+	case "adaptive-bandwidth":
+		pconn = split.NewAdaptiveBandwidthPacketConn(sess.id, connList, dummyAddr{}, opts...)
+	case "redundant":
+		k := c.config.Redundancy
+		if k == 0 {
+			k = defaultRedundancy
+		}
+		pconn = split.NewRedundantPacketConn(sess.id, connList, dummyAddr{}, k, opts...)
+	case "flowlet":
+		pconn = split.NewFlowletPacketConn(sess.id, connList, dummyAddr{}, c.config.FlowletGap, opts...)
+	case "size-class":
+		var classes []split.PathClass
+		for _, conn := range conns {
+			// Already checked by validate.
+			class, _ := pathClass(conn.Class)
+			classes = append(classes, class)
+		}
+		pconn = split.NewSizeClassPacketConn(sess.id, connList, dummyAddr{}, c.config.SizeThreshold, classes, opts...)
+	}
+	c.logger.Printf("Got splitting packet conn")
+	err = c.startSession(sess, pconn)
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// startSession runs KCP and smux over pconn, filling in sess.
+func (c *Client) startSession(sess *session, pconn split.SplittingPacketConn) error {
+	conn, err := kcp.NewConn2(pconn.RemoteAddr(), nil, 0, 0, pconn)
+	if err != nil {
+		pconn.Close()
+		return err
+	}
+	c.logger.Printf("SessionID: %v", sess.id)
+	c.config.Tuning.configureKCP(conn)
+
+	smuxSess, err := smux.Client(conn, c.config.Tuning.smuxConfig())
+	if err != nil {
+		conn.Close()
+		pconn.Close()
+		return err
+	}
+	sess.pconn, sess.conn, sess.smux = pconn, conn, smuxSess
+	return nil
+}
+
+// dialPaths dials paths of sess to ActivePaths bridges of the pool, trying
+// good bridges before bad ones and marking those that cannot be dialed as bad.
+// It returns the connections dialed and their conns, and fails only if no path
+// can be dialed.
+func (c *Client) dialPaths(ctx context.Context, sess *session) ([]Connection, []net.Conn, error) {
+	c.logger.Printf("Launching PT connections")
+	c.lock.Lock()
+	n, pool := c.activePaths(), c.config.Connections["connections"]
+	c.lock.Unlock()
+	remaining := c.candidates(pool, nil, false)
+	var conns []Connection
+	var connList []net.Conn
+	var err error
+	for len(connList) < n && len(remaining) > 0 {
+		var conn Connection
+		var ptconn net.Conn
+		conn, ptconn, err = c.dialFirst(ctx, sess, len(connList), remaining, 0)
+		if err != nil {
+			break
+		}
+		conns = append(conns, conn)
+		connList = append(connList, ptconn)
+		for i := range remaining {
+			if remaining[i].id == conn.id {
+				remaining = remaining[i+1:]
+				break
+			}
+		}
+	}
+	if len(connList) == 0 {
+		return nil, nil, err
+	}
+	c.logger.Printf("Connections launched: %v", len(connList))
+	return conns, connList, nil
+}
+
+// dialConnection dials the path of sess with the given index to conn.
+func (c *Client) dialConnection(ctx context.Context, sess *session, index int, conn Connection) (net.Conn, error) {
+	ptconn, err := c.dial(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", conn.Bridge, err)
+	}
+	if conn.Netem != nil && !conn.Netem.IsZero() {
+		c.logger.Printf("Impairing path %s: %+v", conn.Bridge, *conn.Netem)
+		ptconn = netem.Wrap(ptconn, *conn.Netem)
+	}
+	return c.recorder.WrapConn(trace.SessionID(sess.id), index, ptconn), nil
+}
+
+// dialPT is the default DialFunc. It launches the child PT named by
+// conn.Transport and dials the bridge through it.
+func (c *Client) dialPT(ctx context.Context, conn Connection) (net.Conn, error) {
+	if conn.Transport != "lyrebird" {
+		return nil, errors.New("Unrecognized PT")
+	}
+	tcpaddr, err := net.ResolveTCPAddr("tcp", conn.Bridge)
+	if err != nil {
+		c.logger.Printf("Error resolving TCP address: %s", err.Error())
+		return nil, err
+	}
+	stateDir, err := c.ptStateDir(conn.Transport)
+	if err != nil {
+		c.logger.Printf("Error creating PT state directory: %s", err.Error())
+		return nil, err
+	}
+	c.logger.Printf("Launching Lyrebird connection")
+	// The child PT must outlive ctx, which only bounds this dial. It lives
+	// as long as the conn returned.
+	child := childPT{
+		path:        c.config.LyrebirdPath,
+		stateDir:    stateDir,
+		method:      conn.Method,
+		relay:       func(line ptproto.Line) { c.relayPT(conn, line) },
+		relayStderr: func(text string) { c.relayStderr(conn, text) },
+	}
+	if child.method == "" {
+		child.method = defaultMethod
+	}
+	client, p, err := lyrebirdConnect(c.ctx, c.logger, child, conn.Args)
+	if err != nil {
+		c.logger.Printf("Error connecting to lyrebird: %s", err.Error())
+		return nil, err
+	}
+	ptconn, err := dialWithContext(ctx, func() (net.Conn, error) {
+		return client.DialWithLocalAddr("tcp", "", conn.Bridge, tcpaddr)
+	})
+	if err != nil {
+		c.logger.Printf("Error dialing: %s", err.Error())
+		p.kill()
+		return nil, err
+	}
+	return &childConn{Conn: ptconn, p: p}, nil
+}
+
+// dialWithContext runs dial, returning early if ctx is done first. A conn
+// that arrives after ctx is done is closed.
+func dialWithContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"anticensorshiptrafficsplitting/splitpt"
+	"anticensorshiptrafficsplitting/splitpt/common/bridgeline"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+// bridgeClients holds a splitpt client for each bridge tor asks for. Tor
+// passes the arguments of a torrc Bridge line with each SOCKS connection: a
+// connection with the path= arguments of a splitpt bridge line is carried by
+// a client of that bridge's paths, made on first use, and one without
+// arguments by the client of the TOML's connections.
+type bridgeClients struct {
+	config splitpt.Config
+	opts   []splitpt.Option
+	// stateDir, if not empty, is the state directory of the TOML's client.
+	// Each bridge's client keeps its state in a subdirectory.
+	stateDir string
+	// def is the client of the TOML's connections, or nil if it has none.
+	def *splitpt.Client
+
+	lock    sync.Mutex
+	bridges map[string]*splitpt.Client
+}
+
+func newBridgeClients(config splitpt.Config, opts []splitpt.Option, stateDir string, def *splitpt.Client) *bridgeClients {
+	return &bridgeClients{
+		config:   config,
+		opts:     opts,
+		stateDir: stateDir,
+		def:      def,
+		bridges:  make(map[string]*splitpt.Client),
+	}
+}
+
+// get returns the client for a SOCKS connection with the given arguments.
+func (bc *bridgeClients) get(args pt.Args) (*splitpt.Client, error) {
+	if len(args) == 0 {
+		if bc.def == nil {
+			return nil, errors.New("the Bridge line has no path= arguments and the TOML no connections")
+		}
+		return bc.def, nil
+	}
+	b, err := bridgeline.ParseArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridge line: %w", err)
+	}
+	key := strings.Join(b.Args(), " ")
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if client, ok := bc.bridges[key]; ok {
+		return client, nil
+	}
+	opts := bc.opts
+	if bc.stateDir != "" {
+		// Clients must not share a state file.
+		sum := sha256.Sum256([]byte(key))
+		dir := filepath.Join(bc.stateDir, "bridges", hex.EncodeToString(sum[:8]))
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts[:len(opts):len(opts)], splitpt.WithStateDir(dir))
+	}
+	client, err := splitpt.NewClient(bc.config.ForBridge(b), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridge line: %w", err)
+	}
+	bc.bridges[key] = client
+	return client, nil
+}
+
+// close closes every client.
+func (bc *bridgeClients) close() {
+	if bc.def != nil {
+		bc.def.Close()
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	for _, client := range bc.bridges {
+		client.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+
+	"anticensorshiptrafficsplitting/splitpt"
+	"anticensorshiptrafficsplitting/splitpt/common/harness"
+
+	"github.com/txthinking/socks5"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+func TestSocksBridgeArgs(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sln, err := splitpt.Listen(ln, splitpt.ServerConfig{Logger: logger, Tuning: splitpt.Tuning{Preset: "lossy"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sln.Close()
+	go func() {
+		for {
+			conn, err := sln.Accept()
+			if err != nil {
+				return
+			}
+			go harness.Echo(conn)
+		}
+	}()
+
+	// The client has no connections of its own, and dials each path
+	// directly rather than through lyrebird.
+	dial := func(ctx context.Context, conn splitpt.Connection) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", conn.Bridge)
+	}
+	opts := []splitpt.Option{splitpt.WithLogger(logger), splitpt.WithDialer(dial)}
+	clients := newBridgeClients(splitpt.Config{LyrebirdPath: "unused"}, opts, t.TempDir(), nil)
+	defer clients.close()
+	socksln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdown := make(chan struct{})
+	var wg sync.WaitGroup
+	go socksAcceptLoop(socksln, clients, false, shutdown, &wg)
+	defer socksln.Close()
+
+	// dialSocks connects through the SOCKS listener as tor would for a
+	// Bridge line with the given arguments.
+	dialSocks := func(args string) (net.Conn, error) {
+		password := "\x00"
+		if args == "" {
+			password = ""
+		}
+		c, err := socks5.NewClient(socksln.Addr().String(), args, password, 5, 0)
+		if err != nil {
+			return nil, err
+		}
+		return c.Dial("tcp", "192.0.2.1:9090")
+	}
+	args := "path=obfs4," + ln.Addr().String() + ",cert=AAAA;alg=round-robin;tuning=lossy"
+	for i := 0; i < 2; i++ {
+		conn, err := dialSocks(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello" {
+			t.Fatalf("echoed %q", buf)
+		}
+		conn.Close()
+	}
+	if n := len(clients.bridges); n != 1 {
+		t.Fatalf("%d clients for one bridge line", n)
+	}
+
+	// A bad bridge line is rejected, and so is a connection without one,
+	// as the TOML has no connections.
+	for _, args := range []string{"path=obfs4", "alg=round-robin", "path=obfs4," + ln.Addr().String() + ";alg=round-robin;tuning=none", ""} {
+		if conn, err := dialSocks(args); err == nil {
+			conn.Close()
+			t.Errorf("SOCKS connection with arguments %q was accepted", args)
+		}
+	}
+}
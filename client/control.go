@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt"
+)
+
+// controlTimeout bounds each control command, including dialing a new path.
+const controlTimeout = 1 * time.Minute
+
+// controlAcceptLoop accepts connections to the control socket, on which paths
+// can be added and removed while the client runs, for example to rotate out
+// a bridge that has been blocked without dropping circuits. Each line is one
+// command, answered by one line, "ok" or "error: " and the reason:
+//
+//	add {"Transport": "lyrebird", "Bridge": "192.0.2.1:443", "Cert": "...", "Args": ["iat-mode=0"]}
+//	remove 192.0.2.1:443
+//	list
+//
+// list answers with one line per path, the transport and bridge, before "ok".
+func controlAcceptLoop(ln net.Listener, client *splitpt.Client) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			err := handleControl(conn, client)
+			if err != nil {
+				log.Printf("Control connection error: %s", err)
+			}
+		}()
+	}
+}
+
+func handleControl(conn net.Conn, client *splitpt.Client) error {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		reply := controlCommand(client, scanner.Text())
+		_, err := fmt.Fprintln(conn, reply)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// controlCommand runs one command line and returns the reply.
+func controlCommand(client *splitpt.Client, line string) string {
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	arg = strings.TrimSpace(arg)
+	var err error
+	switch cmd {
+	case "add":
+		var conn splitpt.Connection
+		err = json.Unmarshal([]byte(arg), &conn)
+		if err != nil {
+			break
+		}
+		log.Printf("Control: adding path to %s", conn.Bridge)
+		ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+		err = client.AddPath(ctx, conn)
+		cancel()
+	case "remove":
+		log.Printf("Control: removing path to %s", arg)
+		err = client.RemovePath(arg)
+	case "list":
+		var b strings.Builder
+		for _, conn := range client.Paths() {
+			fmt.Fprintf(&b, "%s %s\n", conn.Transport, conn.Bridge)
+		}
+		return b.String() + "ok"
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return "ok"
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt"
+	"anticensorshiptrafficsplitting/splitpt/common/target"
+)
+
+// Put a sanity timeout on how long we wait for a CONNECT request.
+const httpRequestTimeout = 5 * time.Second
+
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader, so
+// that bytes the client sent right after its request headers are not lost.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.br.Read(p) }
+
+// httpAcceptLoop accepts HTTP CONNECT proxy connections and forwards each to
+// its requested target over its own splitpt stream.
+func httpAcceptLoop(ln net.Listener, client *splitpt.Client, shutdown chan struct{}, wg *sync.WaitGroup) error {
+	log.Printf("httpAcceptLoop()")
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			log.Printf("Returning from httpAcceptLoop")
+			return err
+		}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			err := handleHTTPConnect(conn, client)
+			if err != nil {
+				log.Printf("HTTP CONNECT error: %s", err)
+			}
+		}()
+	}
+}
+
+func handleHTTPConnect(conn net.Conn, client *splitpt.Client) error {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(httpRequestTimeout))
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	log.Printf("HTTP %s %s", req.Method, req.Host)
+	if req.Method != http.MethodConnect {
+		writeHTTPStatus(conn, http.StatusMethodNotAllowed)
+		return fmt.Errorf("unsupported method %q", req.Method)
+	}
+
+	sconn, err := dialStream(client, req.Host)
+	if err != nil {
+		writeHTTPStatus(conn, httpStatus(err))
+		return err
+	}
+	defer sconn.Close()
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	copyLoop(&bufferedConn{Conn: conn, br: br}, sconn)
+	return nil
+}
+
+// httpStatus picks the HTTP status code to report for a failed dial.
+func httpStatus(err error) int {
+	e, ok := err.(*target.ReplyError)
+	if !ok {
+		return http.StatusBadGateway
+	}
+	switch e.Code {
+	case target.ReplyNotAllowed:
+		return http.StatusForbidden
+	case target.ReplyTTLExpired:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeHTTPStatus(w io.Writer, code int) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+	return err
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -13,17 +14,24 @@ import (
 
 	"sync"
 	"syscall"
+	"time"
 
-	spt "anticensorshiptrafficsplitting/splitpt/client/lib"
+	"anticensorshiptrafficsplitting/splitpt"
+	"anticensorshiptrafficsplitting/splitpt/common/metrics"
+	"anticensorshiptrafficsplitting/splitpt/common/ptproto"
+	"anticensorshiptrafficsplitting/splitpt/common/target"
+	"anticensorshiptrafficsplitting/splitpt/common/trace"
 
-	"github.com/xtaci/smux"
 	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
 )
 
+// metricsInterval is how often the client logs its metrics.
+const metricsInterval = 1 * time.Hour
+
 // Exchanges bytes between SOCKS connection and splitpt connection
 // TODO [AHL] This will eventuall have to copy packets to different proxies according
 // to the splitting algorithm being used
-func copyLoop(socks *pt.SocksConn, sptstream *smux.Stream) {
+func copyLoop(socks io.ReadWriter, sptstream net.Conn) {
 	done := make(chan struct{}, 2)
 	go func() {
 		if _, err := io.Copy(socks, sptstream); err != nil {
@@ -34,14 +42,43 @@ func copyLoop(socks *pt.SocksConn, sptstream *smux.Stream) {
 	go func() {
 		if _, err := io.Copy(sptstream, socks); err != nil {
 			log.Printf("[copyLoop] copying from SOCKS resulted in error: %v", err)
-			done <- struct{}{}
 		}
+		done <- struct{}{}
 	}()
 	<-done
 	log.Printf("copy loop done")
 }
 
-func socksAcceptLoop(ln *pt.SocksListener, sptConfig *spt.SplitPTConfig, shutdown chan struct{}, wg *sync.WaitGroup) error {
+// dialStream opens a new splitpt stream. If targetAddr is not empty, the
+// stream is meant for a standalone exit server: the target is requested at
+// the start of the stream and dialStream waits for the server's reply.
+func dialStream(client *splitpt.Client, targetAddr string) (net.Conn, error) {
+	log.Printf("Dialing...")
+	sconn, err := client.DialContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if targetAddr == "" {
+		return sconn, nil
+	}
+	err = target.WriteRequest(sconn, targetAddr)
+	if err == nil {
+		err = target.ReadReply(sconn)
+	}
+	if err != nil {
+		sconn.Close()
+		return nil, err
+	}
+	return sconn, nil
+}
+
+// socksAcceptLoop accepts SOCKS connections and forwards each over its own
+// splitpt stream, of the client of the bridge whose arguments tor passes with
+// the connection. A connection whose arguments are not a valid splitpt bridge
+// line is rejected. If standalone is true, the SOCKS target is passed on to
+// the server, and the TOML's client carries every connection; otherwise the
+// server forwards the stream to tor.
+func socksAcceptLoop(ln *pt.SocksListener, clients *bridgeClients, standalone bool, shutdown chan struct{}, wg *sync.WaitGroup) error {
 	log.Printf("socksAcceptLoop()")
 	defer ln.Close()
 	for {
@@ -51,23 +88,37 @@ func socksAcceptLoop(ln *pt.SocksListener, sptConfig *spt.SplitPTConfig, shutdow
 				pt.Log(pt.LogSeverityError, "accept error: "+err.Error())
 				continue
 			}
+			log.Printf("Returning from socksAcceptLoop")
+			return err
 		}
 		log.Printf("SOCKS accepted %v", conn.Req)
 		wg.Add(1)
 
 		go func() {
 			defer wg.Done()
-			transport, err := spt.NewSplitPTClient(*sptConfig)
-			if err != nil {
-				log.Printf("Transport error: %s", err)
-				conn.Reject()
-				return
+			defer conn.Close()
+			var targetAddr string
+			client := clients.def
+			if standalone {
+				targetAddr = conn.Req.Target
+			} else {
+				var err error
+				client, err = clients.get(conn.Req.Args)
+				if err != nil {
+					log.Printf("Rejecting SOCKS connection: %s", err)
+					pt.Log(pt.LogSeverityError, err.Error())
+					conn.Reject()
+					return
+				}
 			}
-			log.Printf("Dialing...")
-			sconn, err := transport.Dial()
+			sconn, err := dialStream(client, targetAddr)
 			if err != nil {
 				log.Printf("Dial error: %s", err)
-				conn.Reject()
+				if e, ok := err.(*target.ReplyError); ok {
+					conn.RejectReason(e.Code)
+				} else {
+					conn.Reject()
+				}
 				return
 			}
 
@@ -76,8 +127,6 @@ func socksAcceptLoop(ln *pt.SocksListener, sptConfig *spt.SplitPTConfig, shutdow
 			copyLoop(conn, sconn)
 		}()
 	}
-	log.Printf("Returning from socksAcceptLoop")
-	return nil
 }
 
 func handler(conn *pt.SocksConn) error {
@@ -103,6 +152,12 @@ func main() {
 	// Parse command line args
 	logFilename := flag.String("log", "", "name of log file")
 	tomlFilename := flag.String("toml", "", "name of toml config file")
+	socksAddr := flag.String("socks", "", "run as a standalone SOCKS5 proxy on this address instead of as a Tor PT")
+	httpAddr := flag.String("http", "", "run as a standalone HTTP CONNECT proxy on this address instead of as a Tor PT")
+	traceFilename := flag.String("trace", "", "record a packet trace of every path to this file")
+	traceTCP := flag.Bool("trace-tcp", false, "also record TCP reads and writes in the packet trace")
+	controlPath := flag.String("control", "", "accept commands to add and remove paths on a unix socket at this path")
+	stateDir := flag.String("state", "", "keep state in this directory instead of TOR_PT_STATE_LOCATION")
 	flag.Parse()
 
 	// Logging
@@ -120,20 +175,89 @@ func main() {
 	log.SetOutput(logOutput)
 
 	log.Println("--- Setting up SplitPT ---")
-	//var spt.ClientTOMLConfig tomlConfig
 	if *tomlFilename == "" {
 		log.Printf("toml filename cannot be empty")
 		return
 	}
-	sptConfig, err := spt.GetClientTOMLConfig(*tomlFilename)
+	sptConfig, err := splitpt.LoadConfig(*tomlFilename)
 	if err != nil {
 		log.Printf("Error with toml config: %v", err)
 		return
 	}
+	var opts []splitpt.Option
+	if *traceFilename != "" {
+		recorder, err := trace.Create(*traceFilename, trace.Client)
+		if err != nil {
+			log.Printf("Error creating trace: %v", err)
+			return
+		}
+		recorder.TCP = *traceTCP
+		defer recorder.Close()
+		opts = append(opts, splitpt.WithRecorder(recorder))
+	}
+	standalone := *socksAddr != "" || *httpAddr != ""
+	if *stateDir != "" {
+		err = os.MkdirAll(*stateDir, 0700)
+	} else if !standalone {
+		// TOR_PT_STATE_LOCATION is only set when running under tor.
+		// Standalone, nothing is remembered across restarts without
+		// -state.
+		*stateDir, err = pt.MakeStateDir()
+	}
+	if err != nil {
+		log.Printf("Error creating state directory: %v", err)
+		return
+	}
+	if *stateDir != "" {
+		opts = append(opts, splitpt.WithStateDir(*stateDir))
+	}
+	if !standalone {
+		// Under tor, stdout is tor's.
+		opts = append(opts, splitpt.WithReporter(&ptproto.Writer{W: pt.Stdout}))
+	}
+	m := metrics.New()
+	opts = append(opts, splitpt.WithMetrics(m))
+	// Without connections in the TOML, every path comes from the Bridge
+	// lines of tor.
+	var client *splitpt.Client
+	if len(sptConfig.Connections["connections"]) > 0 {
+		client, err = splitpt.NewClient(*sptConfig, opts...)
+		if err != nil {
+			log.Printf("Error creating client: %v", err)
+			return
+		}
+	} else if standalone || *controlPath != "" {
+		log.Printf("-socks, -http and -control need connections in the TOML")
+		return
+	}
+	clients := newBridgeClients(*sptConfig, opts, *stateDir, client)
+	defer clients.close()
+	metricsCtx, stopMetrics := context.WithCancel(context.Background())
+	defer stopMetrics()
+	go m.LogEvery(metricsCtx, log.Default(), metricsInterval)
+	if *controlPath != "" {
+		ln, err := net.Listen("unix", *controlPath)
+		if err != nil {
+			log.Printf("Error listening for control connections: %v", err)
+			return
+		}
+		defer ln.Close()
+		log.Printf("Started control listener at %v", ln.Addr())
+		go controlAcceptLoop(ln, client)
+	}
 	//log.Println(len(tomlConfig.Connections))
 	log.Println("Finished getting config from TOML file")
 	log.Println("--- Starting SplitPT ---")
 
+	if standalone {
+		err := runStandalone(clients, *socksAddr, *httpAddr)
+		if err != nil {
+			log.Printf("Error running standalone proxy: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// splitpt setup
 
 	// begin goptlib client process
@@ -163,7 +287,7 @@ func main() {
 				break
 			}
 			log.Printf("Started SOCKS listenener at %v", ln.Addr())
-			go socksAcceptLoop(ln, sptConfig, shutdown, &wg)
+			go socksAcceptLoop(ln, clients, false, shutdown, &wg)
 			pt.Cmethod(methodName, ln.Version(), ln.Addr())
 			listeners = append(listeners, ln)
 		default:
@@ -200,3 +324,46 @@ func main() {
 	log.Println("SplitPT is done")
 
 }
+
+// runStandalone serves SOCKS5 and/or HTTP CONNECT proxies for applications
+// other than tor, until SIGTERM or SIGINT.
+func runStandalone(clients *bridgeClients, socksAddr, httpAddr string) error {
+	listeners := make([]net.Listener, 0)
+	shutdown := make(chan struct{})
+	var wg sync.WaitGroup
+
+	if socksAddr != "" {
+		ln, err := pt.ListenSocks("tcp", socksAddr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Started SOCKS listener at %v", ln.Addr())
+		go socksAcceptLoop(ln, clients, true, shutdown, &wg)
+		listeners = append(listeners, ln)
+	}
+	if httpAddr != "" {
+		ln, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		log.Printf("Started HTTP CONNECT listener at %v", ln.Addr())
+		go httpAcceptLoop(ln, clients.def, shutdown, &wg)
+		listeners = append(listeners, ln)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+	<-sigChan
+	log.Printf("stopping splitpt")
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	close(shutdown)
+	wg.Wait()
+	log.Println("SplitPT is done")
+	return nil
+}
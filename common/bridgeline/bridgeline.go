@@ -0,0 +1,279 @@
+/*
+Package bridgeline encodes and parses the bridge lines that describe splitpt
+bridges to users: every path a client may split a session over, and how.
+
+A splitpt bridge line is an ordinary torrc Bridge line for the splitpt
+transport, so that tor accepts it and passes its arguments on to the client.
+Each path is a path= argument, holding the path's transport method, address
+and the arguments of its PT, separated by commas:
+
+	Bridge splitpt 192.0.2.1:9090 <FINGERPRINT> path=obfs4,192.0.2.1:9090,cert=AAAA,iat-mode=0 path=obfs4,192.0.2.1:9091,cert=BBBB,iat-mode=1 alg=round-robin tuning=lossy
+
+Commas and backslashes in the arguments of a path are escaped with a
+backslash. Paths keep their order. Tor does not allow whitespace in any
+argument.
+*/
+package bridgeline
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Transport is the name of the splitpt transport in bridge lines.
+const Transport = "splitpt"
+
+// Bridge is a splitpt bridge.
+type Bridge struct {
+	// Addr is the address tor connects to for the bridge. Paths are
+	// dialed at their own addresses; tor only needs one. It is the
+	// address of the first path if empty.
+	Addr string
+	// Fingerprint is the fingerprint of the tor bridge behind the splitpt
+	// server, or empty.
+	Fingerprint string
+	Paths       []Path
+	// Key, if not nil, is the server's session key.
+	Key []byte
+	// Alg, if not empty, is the splitting algorithm the server suggests
+	// clients use, such as "round-robin".
+	Alg string
+	// Tuning, if not empty, is the preset of the server's KCP and smux
+	// tuning, such as "lossy", which clients check theirs against.
+	Tuning string
+}
+
+// Path is one path of a Bridge.
+type Path struct {
+	// Method is the transport method of the PT that carries the path,
+	// such as "obfs4".
+	Method string
+	Addr   string
+	// Args are the KEY=VALUE arguments of the PT, such as an obfs4
+	// cert.
+	Args []string
+}
+
+// Validate checks that b can be encoded as a bridge line that parses back to
+// b.
+func (b *Bridge) Validate() error {
+	if b.Addr != "" {
+		if err := checkAddr(b.Addr); err != nil {
+			return err
+		}
+	}
+	if strings.IndexFunc(b.Fingerprint, invalidToken) >= 0 || strings.ContainsRune(b.Fingerprint, '=') {
+		return fmt.Errorf("invalid fingerprint %q", b.Fingerprint)
+	}
+	if len(b.Paths) == 0 {
+		return errors.New("bridge has no paths")
+	}
+	for _, p := range b.Paths {
+		if p.Method == "" || strings.IndexFunc(p.Method, invalidToken) >= 0 || strings.ContainsAny(p.Method, ",=\\") {
+			return fmt.Errorf("invalid path method %q", p.Method)
+		}
+		if err := checkAddr(p.Addr); err != nil {
+			return err
+		}
+		for _, arg := range p.Args {
+			if !strings.Contains(arg, "=") || strings.IndexFunc(arg, invalidToken) >= 0 {
+				return fmt.Errorf("invalid path argument %q", arg)
+			}
+		}
+	}
+	if b.Key != nil && len(b.Key) == 0 {
+		return errors.New("empty key")
+	}
+	if strings.IndexFunc(b.Alg, invalidToken) >= 0 {
+		return fmt.Errorf("invalid algorithm %q", b.Alg)
+	}
+	if strings.IndexFunc(b.Tuning, invalidToken) >= 0 {
+		return fmt.Errorf("invalid tuning %q", b.Tuning)
+	}
+	return nil
+}
+
+// checkAddr checks a HOST:PORT address. The host may be a placeholder, such
+// as "<IP_ADDRESS>", for the server's public address.
+func checkAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "" || strings.IndexFunc(addr, invalidToken) >= 0 || strings.ContainsAny(addr, ",=\\") {
+		return fmt.Errorf("invalid address %q", addr)
+	}
+	return nil
+}
+
+// invalidToken reports whether r may not appear in an argument of a bridge
+// line.
+func invalidToken(r rune) bool {
+	return r <= ' ' || r > '~'
+}
+
+// String encodes b as a torrc Bridge line. b should be valid.
+func (b *Bridge) String() string {
+	addr := b.Addr
+	if addr == "" && len(b.Paths) > 0 {
+		addr = b.Paths[0].Addr
+	}
+	fields := []string{"Bridge", Transport, addr}
+	if b.Fingerprint != "" {
+		fields = append(fields, b.Fingerprint)
+	}
+	return strings.Join(append(fields, b.Args()...), " ")
+}
+
+// Args returns the KEY=VALUE arguments of b's bridge line, which tor passes
+// to the client.
+func (b *Bridge) Args() []string {
+	var args []string
+	for _, p := range b.Paths {
+		elems := []string{p.Method, p.Addr}
+		for _, arg := range p.Args {
+			elems = append(elems, escape(arg))
+		}
+		args = append(args, "path="+strings.Join(elems, ","))
+	}
+	if b.Key != nil {
+		args = append(args, "key="+base64.RawStdEncoding.EncodeToString(b.Key))
+	}
+	if b.Alg != "" {
+		args = append(args, "alg="+b.Alg)
+	}
+	if b.Tuning != "" {
+		args = append(args, "tuning="+b.Tuning)
+	}
+	return args
+}
+
+// escape escapes the commas and backslashes of a path argument.
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `,`, `\,`).Replace(s)
+}
+
+// Parse parses a bridge line, with or without the leading "Bridge" keyword.
+// The transport must be splitpt.
+func Parse(line string) (*Bridge, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "Bridge" {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 || fields[0] != Transport {
+		return nil, fmt.Errorf("not a %s bridge line: %q", Transport, line)
+	}
+	b := &Bridge{Addr: fields[1]}
+	fields = fields[2:]
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		b.Fingerprint = fields[0]
+		fields = fields[1:]
+	}
+	args := make(map[string][]string)
+	for _, field := range fields {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad bridge line argument %q", field)
+		}
+		args[k] = append(args[k], v)
+	}
+	err := b.setArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	err = b.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ParseArgs makes a Bridge from the arguments of a bridge line, as tor passes
+// them to the client, such as the pt.Args of a SOCKS connection. The Bridge
+// has no Addr or Fingerprint.
+func ParseArgs(args map[string][]string) (*Bridge, error) {
+	b := &Bridge{}
+	err := b.setArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	err = b.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// setArgs sets the fields of b that are given by arguments. Unknown
+// arguments are ignored, so that older clients can use bridge lines with
+// arguments added later.
+func (b *Bridge) setArgs(args map[string][]string) error {
+	for _, v := range args["path"] {
+		p, err := parsePath(v)
+		if err != nil {
+			return err
+		}
+		b.Paths = append(b.Paths, p)
+	}
+	if v, err := single(args, "key"); err != nil {
+		return err
+	} else if v != "" {
+		key, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(v, "="))
+		if err != nil {
+			return fmt.Errorf("bad key: %w", err)
+		}
+		b.Key = key
+	}
+	alg, err := single(args, "alg")
+	if err != nil {
+		return err
+	}
+	b.Alg = alg
+	tuning, err := single(args, "tuning")
+	if err != nil {
+		return err
+	}
+	b.Tuning = tuning
+	return nil
+}
+
+// single returns the value of an argument that may be given at most once.
+func single(args map[string][]string, key string) (string, error) {
+	switch len(args[key]) {
+	case 0:
+		return "", nil
+	case 1:
+		return args[key][0], nil
+	}
+	return "", fmt.Errorf("more than one %s argument", key)
+}
+
+// parsePath parses the value of a path= argument.
+func parsePath(s string) (Path, error) {
+	var elems []string
+	var e strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			if i+1 >= len(s) {
+				return Path{}, fmt.Errorf("bad escape in path %q", s)
+			}
+			i++
+			e.WriteByte(s[i])
+		case c == ',':
+			elems = append(elems, e.String())
+			e.Reset()
+		default:
+			e.WriteByte(c)
+		}
+	}
+	elems = append(elems, e.String())
+	if len(elems) < 2 {
+		return Path{}, fmt.Errorf("path %q needs a method and address", s)
+	}
+	p := Path{Method: elems[0], Addr: elems[1]}
+	if len(elems) > 2 {
+		p.Args = elems[2:]
+	}
+	return p, nil
+}
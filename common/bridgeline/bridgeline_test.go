@@ -0,0 +1,105 @@
+package bridgeline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, b := range []Bridge{
+		{
+			Paths: []Path{{Method: "obfs4", Addr: "192.0.2.1:9090", Args: []string{"cert=AAAA/+B", "iat-mode=0"}}},
+		},
+		{
+			Addr:        "192.0.2.1:443",
+			Fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567",
+			Paths: []Path{
+				{Method: "obfs4", Addr: "192.0.2.1:9090", Args: []string{"cert=AAAA", "iat-mode=1"}},
+				{Method: "webtunnel", Addr: "[2001:db8::1]:443", Args: []string{`url=https://example.com/a,b\c`}},
+				{Method: "obfs4", Addr: "<IP_ADDRESS>:9091"},
+			},
+			Key:    []byte{0, 1, 2, 3, 254, 255},
+			Alg:    "adaptive-bandwidth",
+			Tuning: "lossy",
+		},
+	} {
+		line := b.String()
+		got, err := Parse(line)
+		if err != nil {
+			t.Errorf("%s: %v", line, err)
+			continue
+		}
+		want := b
+		if want.Addr == "" {
+			want.Addr = want.Paths[0].Addr
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("%s: got %+v, want %+v", line, *got, want)
+		}
+		if again := got.String(); again != line {
+			t.Errorf("got %s, want %s", again, line)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	b, err := Parse(`splitpt 192.0.2.1:9090 path=obfs4,192.0.2.1:9090,cert=a\,b,iat-mode=0 extra=ignored alg=round-robin key=AAEC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Bridge{
+		Addr:  "192.0.2.1:9090",
+		Paths: []Path{{Method: "obfs4", Addr: "192.0.2.1:9090", Args: []string{"cert=a,b", "iat-mode=0"}}},
+		Key:   []byte{0, 1, 2},
+		Alg:   "round-robin",
+	}
+	if !reflect.DeepEqual(b, want) {
+		t.Errorf("got %+v, want %+v", b, want)
+	}
+
+	for _, line := range []string{
+		"",
+		"Bridge obfs4 192.0.2.1:9090 cert=AAAA iat-mode=0",
+		"Bridge splitpt 192.0.2.1:9090",
+		"Bridge splitpt 192.0.2.1 path=obfs4,192.0.2.1:9090",
+		"Bridge splitpt 192.0.2.1:9090 path=obfs4",
+		"Bridge splitpt 192.0.2.1:9090 path=obfs4,192.0.2.1",
+		"Bridge splitpt 192.0.2.1:9090 path=obfs4,192.0.2.1:9090,iat-mode",
+		`Bridge splitpt 192.0.2.1:9090 path=obfs4,192.0.2.1:9090,cert=a\`,
+		"Bridge splitpt 192.0.2.1:9090 path=,192.0.2.1:9090",
+		"Bridge splitpt 192.0.2.1:9090 FINGERPRINT path=obfs4,192.0.2.1:9090 junk",
+		"Bridge splitpt 192.0.2.1:9090 path=obfs4,192.0.2.1:9090 key=!!",
+		"Bridge splitpt 192.0.2.1:9090 path=obfs4,192.0.2.1:9090 alg=a alg=b",
+		"Bridge splitpt 192.0.2.1:9090 path=obfs4,192.0.2.1:9090 tuning=bulk tuning=lossy",
+	} {
+		if b, err := Parse(line); err == nil {
+			t.Errorf("%q: got %+v, want error", line, b)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	b := Bridge{
+		Paths: []Path{
+			{Method: "obfs4", Addr: "192.0.2.1:9090", Args: []string{"cert=AAAA", "iat-mode=0"}},
+			{Method: "obfs4", Addr: "192.0.2.2:9090", Args: []string{"cert=BBBB", "iat-mode=0"}},
+		},
+		Alg: "round-robin",
+	}
+	// Tor passes the arguments on as a map of lists, keeping the order of
+	// repeated keys.
+	args := map[string][]string{
+		"path": {`obfs4,192.0.2.1:9090,cert=AAAA,iat-mode=0`, `obfs4,192.0.2.2:9090,cert=BBBB,iat-mode=0`},
+		"alg":  {"round-robin"},
+	}
+	got, err := ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, b) {
+		t.Errorf("got %+v, want %+v", *got, b)
+	}
+	if _, err := ParseArgs(map[string][]string{"alg": {"round-robin"}}); err == nil {
+		t.Error("arguments without paths were accepted")
+	}
+}
@@ -0,0 +1,384 @@
+package harness
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt"
+)
+
+// fakePTEnv makes the test binary act as a backend PT server instead of
+// running the tests, so that backends can be tested without lyrebird.
+const fakePTEnv = "SPLITPT_TEST_FAKE_PT"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakePTEnv) == "1" {
+		if os.Getenv("TOR_PT_CLIENT_TRANSPORTS") != "" {
+			fakePTClient()
+		} else {
+			fakePTServer()
+		}
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakePTServer is a managed PT server without obfuscation. It forwards every
+// connection to TOR_PT_ORPORT, and writes its pid to the state directory.
+func fakePTServer() {
+	method, addr, _ := strings.Cut(os.Getenv("TOR_PT_SERVER_BINDADDR"), "-")
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Printf("SMETHOD-ERROR %s %s\n", method, err)
+		return
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	os.WriteFile(filepath.Join(os.Getenv("TOR_PT_STATE_LOCATION"), "pid"), pid, 0600)
+	iatMode := "0"
+	for _, option := range strings.Split(os.Getenv("TOR_PT_SERVER_TRANSPORT_OPTIONS"), ";") {
+		if v, ok := strings.CutPrefix(option, method+":iat-mode="); ok {
+			iatMode = v
+		}
+	}
+	fmt.Println("VERSION 1")
+	fmt.Printf("LOG SEVERITY=notice MESSAGE=\"listening on %s\"\n", ln.Addr())
+	fmt.Printf("SMETHOD %s %s ARGS:cert=fake,iat-mode=%s\n", method, ln.Addr(), iatMode)
+	fmt.Println("SMETHODS DONE")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			or, err := net.Dial("tcp", os.Getenv("TOR_PT_ORPORT"))
+			if err != nil {
+				return
+			}
+			defer or.Close()
+			go io.Copy(or, conn)
+			io.Copy(conn, or)
+		}()
+	}
+}
+
+// fakePTClient is a managed PT client without obfuscation. Its SOCKS5 proxy
+// connects straight to the address asked for. It writes its pid to a file of
+// its own in the state directory.
+func fakePTClient() {
+	method := os.Getenv("TOR_PT_CLIENT_TRANSPORTS")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("CMETHOD-ERROR %s %s\n", method, err)
+		return
+	}
+	pid := strconv.Itoa(os.Getpid())
+	os.WriteFile(filepath.Join(os.Getenv("TOR_PT_STATE_LOCATION"), "pid-"+pid), []byte(pid), 0600)
+	fmt.Println("VERSION 1")
+	fmt.Printf("CMETHOD %s socks5 %s\n", method, ln.Addr())
+	fmt.Println("CMETHODS DONE")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			addr, err := socksHandshake(conn)
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			// Answer that the connection succeeded, bound to 0.0.0.0:0.
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+// socksHandshake reads the greeting, username/password authentication and
+// CONNECT request of a SOCKS5 client from conn, and returns the address it
+// asks for. Any credentials are accepted.
+func socksHandshake(conn net.Conn) (string, error) {
+	read := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(conn, buf)
+		return buf, err
+	}
+	greeting, err := read(2)
+	if err != nil {
+		return "", err
+	}
+	methods, err := read(int(greeting[1]))
+	if err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(methods, 2) < 0 {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		header, err := read(2)
+		if err != nil {
+			return "", err
+		}
+		_, err = read(int(header[1]))
+		if err != nil {
+			return "", err
+		}
+		plen, err := read(1)
+		if err != nil {
+			return "", err
+		}
+		_, err = read(int(plen[0]))
+		if err != nil {
+			return "", err
+		}
+		conn.Write([]byte{1, 0})
+	}
+	request, err := read(4)
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip, err := read(4)
+		if err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		n, err := read(1)
+		if err != nil {
+			return "", err
+		}
+		name, err := read(int(n[0]))
+		if err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("address type %d", request[3])
+	}
+	port, err := read(2)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// freeAddr returns a loopback address that nothing is listening on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestBackends(t *testing.T) {
+	t.Setenv(fakePTEnv, "1")
+	logger := log.New(io.Discard, "", 0)
+	ln, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sln, err := splitpt.Listen(ln, splitpt.ServerConfig{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sln.Close()
+	go func() {
+		for {
+			conn, err := sln.Accept()
+			if err != nil {
+				return
+			}
+			go Echo(conn)
+		}
+	}()
+
+	stateDir := t.TempDir()
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	backends, err := splitpt.StartBackends(splitpt.BackendConfig{
+		LyrebirdPath: os.Args[0],
+		Backends: []splitpt.Backend{
+			{BindAddr: addrs[0]},
+			{BindAddr: addrs[1], Options: []string{"iat-mode=1"}},
+		},
+		SplittingAlg: "round-robin",
+		StateDir:     stateDir,
+		Logger:       logger,
+	}, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backends.Close()
+
+	want := fmt.Sprintf("Bridge splitpt %s <FINGERPRINT> path=obfs4,%s,cert=fake,iat-mode=0 path=obfs4,%s,cert=fake,iat-mode=1 alg=round-robin", addrs[0], addrs[0], addrs[1])
+	if line := backends.BridgeLine(); line != want {
+		t.Fatalf("bridge line\n%s\nwant\n%s", line, want)
+	}
+	data, err := os.ReadFile(filepath.Join(stateDir, splitpt.BridgeLineFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), "\n"+want+"\n") {
+		t.Fatalf("bridge line file has\n%s", data)
+	}
+
+	// A client given the bridge line splits over both backends.
+	config := splitpt.Config{
+		LyrebirdPath: "unused",
+		BridgeLine:   backends.BridgeLine(),
+	}
+	dial := func(ctx context.Context, conn splitpt.Connection) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", conn.Bridge)
+	}
+	client, err := splitpt.NewClient(config, splitpt.WithLogger(logger), splitpt.WithDialer(dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	h := &Harness{Client: client}
+	transfer(t, h, randomBytes(t, 64*1024))
+
+	// A backend that exits is launched again.
+	pidFile := filepath.Join(stateDir, "obfs4-"+addrs[0][strings.LastIndex(addrs[0], ":")+1:], "pid")
+	pid, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(string(pid))
+	p, err := os.FindProcess(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Kill()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		newPid, err := os.ReadFile(pidFile)
+		if err == nil && string(newPid) != string(pid) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backend was not launched again")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	conn, err := net.DialTimeout("tcp", addrs[0], time.Second)
+	if err != nil {
+		t.Fatalf("relaunched backend is not listening: %v", err)
+	}
+	conn.Close()
+}
+
+// livePIDs returns how many of the fake PT clients that wrote their pids to
+// dir are still running.
+func livePIDs(t *testing.T, dir string) int {
+	files, err := filepath.Glob(filepath.Join(dir, "pid-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := 0
+	for _, file := range files {
+		n, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(file), "pid-"))
+		p, err := os.FindProcess(n)
+		if err == nil && p.Signal(syscall.Signal(0)) == nil {
+			live++
+		}
+	}
+	return live
+}
+
+func TestChildPTPerPath(t *testing.T) {
+	t.Setenv(fakePTEnv, "1")
+	logger := log.New(io.Discard, "", 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sln, err := splitpt.Listen(ln, splitpt.ServerConfig{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sln.Close()
+	go func() {
+		for {
+			conn, err := sln.Accept()
+			if err != nil {
+				return
+			}
+			go Echo(conn)
+		}
+	}()
+
+	// One path at a time, rotated between two connections to the server,
+	// each through a child PT of its own.
+	stateDir := t.TempDir()
+	path := splitpt.Connection{Transport: "lyrebird", Bridge: ln.Addr().String()}
+	config := splitpt.Config{
+		LyrebirdPath: os.Args[0],
+		SplittingAlg: "round-robin",
+		ActivePaths:  1,
+		RotateEvery:  100 * time.Millisecond,
+		Connections:  map[string][]splitpt.Connection{"connections": {path, path}},
+	}
+	client, err := splitpt.NewClient(config, splitpt.WithLogger(logger), splitpt.WithStateDir(stateDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := client.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	h := &Harness{Client: client}
+	for i := 0; i < 8; i++ {
+		echo(t, conn, randomBytes(t, 4*1024))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The child PTs of rotated-out paths are gone.
+	ptDir := filepath.Join(stateDir, "lyrebird")
+	if files, _ := filepath.Glob(filepath.Join(ptDir, "pid-*")); len(files) < 4 {
+		t.Fatalf("%d child PTs launched, want one per rotation", len(files))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for livePIDs(t, ptDir) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d child PTs running for one path", livePIDs(t, ptDir))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	transfer(t, h, []byte("hello"))
+	client.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for livePIDs(t, ptDir) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("child PTs running after the client closed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+Package harness runs a splitpt client and server in one process, with the
+paths between them provided by in-memory pipes or loopback TCP connections
+instead of child PTs. It is meant for tests and local experiments.
+
+	h, err := harness.Start(harness.Config{SplittingAlg: "round-robin", Paths: 3})
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	conn, err := h.Client.DialContext(ctx)
+	// By default the server echoes every stream back.
+*/
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt"
+	"anticensorshiptrafficsplitting/splitpt/common/metrics"
+	"anticensorshiptrafficsplitting/splitpt/common/netem"
+	"anticensorshiptrafficsplitting/splitpt/common/trace"
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
+)
+
+var errBlocked = errors.New("path is blocked")
+
+// Config describes a harness.
+type Config struct {
+	// SplittingAlg is passed through to the client's splitpt.Config.
+	SplittingAlg string
+	// Paths is the number of paths between client and server, the
+	// client's pool of bridges.
+	Paths int
+	// Bridges, if not zero, is how many different bridges the paths go
+	// to: path i goes to bridge i modulo Bridges, as when a client's TOML
+	// lists a bridge more than once. WrapPath and Blocked are then given
+	// the bridge rather than the path.
+	Bridges int
+	// ActivePaths, RotateEvery and AttachWait are passed through to the
+	// client's splitpt.Config.
+	ActivePaths int
+	RotateEvery time.Duration
+	AttachWait  time.Duration
+	// StateDir, if not empty, is where the client keeps its state.
+	StateDir string
+	// Loopback makes the paths loopback TCP connections instead of
+	// in-memory pipes.
+	Loopback bool
+	// Listeners is how many listeners the server accepts paths on, one
+	// if zero. Path i is dialed to listener i modulo Listeners.
+	Listeners int
+	// Health is passed through to the client's splitpt.Config.
+	Health splitpt.HealthCheck
+	// Netem, if not empty, holds a profile for each path, which the client
+	// applies as it would a netem section in its TOML config.
+	Netem []netem.Profile
+	// WrapPath, if not nil, is applied to the client end of path i each
+	// time it is dialed, for example to impair it.
+	WrapPath func(i int, conn net.Conn) net.Conn
+	// Blocked, if not nil, makes dialing path i fail whenever it returns
+	// true, like a bridge a censor blocks.
+	Blocked func(i int) bool
+	// Handler is run for every stream the server accepts. It owns the
+	// stream. If nil, Echo is used.
+	Handler func(conn net.Conn)
+	// Reporter, if not nil, receives the client's log and status
+	// messages for tor.
+	Reporter splitpt.Reporter
+	// RateLimit and Metrics are passed through to the server's
+	// splitpt.ServerConfig.
+	RateLimit tt.RateLimit
+	Metrics   *metrics.Metrics
+	// ClientMetrics, if not nil, counts the client's events.
+	ClientMetrics *metrics.Metrics
+	// Recorder, if not nil, records the client's trace.
+	Recorder *trace.Recorder
+	// Tuning is passed through to both the client's splitpt.Config and
+	// the server's splitpt.ServerConfig.
+	Tuning splitpt.Tuning
+	// Logger is used by both client and server. If nil, log output is
+	// discarded.
+	Logger *log.Logger
+}
+
+// Harness is a running client and server pair.
+type Harness struct {
+	Client   *splitpt.Client
+	Listener *splitpt.Listener
+
+	config Config
+	lns    []net.Listener
+	wg     sync.WaitGroup
+}
+
+// Start starts a server and creates a client connected to it. The client
+// dials its paths lazily, on its first DialContext.
+func Start(config Config) (*Harness, error) {
+	if config.Paths <= 0 {
+		return nil, errors.New("harness needs at least one path")
+	}
+	if len(config.Netem) != 0 && len(config.Netem) != config.Paths {
+		return nil, errors.New("harness needs one netem profile per path")
+	}
+	if config.Handler == nil {
+		config.Handler = Echo
+	}
+	if config.Logger == nil {
+		config.Logger = log.New(io.Discard, "", 0)
+	}
+
+	if config.Listeners <= 0 {
+		config.Listeners = 1
+	}
+	var lns []net.Listener
+	for i := 0; i < config.Listeners; i++ {
+		var ln net.Listener
+		if config.Loopback {
+			var err error
+			ln, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				for _, ln := range lns {
+					ln.Close()
+				}
+				return nil, err
+			}
+		} else {
+			ln = NewPipeListener()
+		}
+		lns = append(lns, ln)
+	}
+	sln, err := splitpt.Listen(lns[0], splitpt.ServerConfig{
+		Logger:    config.Logger,
+		RateLimit: config.RateLimit,
+		Metrics:   config.Metrics,
+		Tuning:    config.Tuning,
+	})
+	if err != nil {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil, err
+	}
+	for _, ln := range lns[1:] {
+		err := sln.AddListener(ln)
+		if err != nil {
+			sln.Close()
+			return nil, err
+		}
+	}
+
+	h := &Harness{
+		Listener: sln,
+		config:   config,
+		lns:      lns,
+	}
+	clientConfig := splitpt.Config{
+		SplittingAlg: config.SplittingAlg,
+		ActivePaths:  config.ActivePaths,
+		RotateEvery:  config.RotateEvery,
+		AttachWait:   config.AttachWait,
+		Health:       config.Health,
+		Tuning:       config.Tuning,
+		Connections:  map[string][]splitpt.Connection{},
+	}
+	for i := 0; i < config.Paths; i++ {
+		bridge := i
+		if config.Bridges > 0 {
+			bridge %= config.Bridges
+		}
+		conn := splitpt.Connection{
+			Transport: "harness",
+			Bridge:    fmt.Sprintf("path%d", bridge),
+		}
+		if len(config.Netem) != 0 {
+			conn.Netem = &config.Netem[i]
+		}
+		clientConfig.Connections["connections"] = append(clientConfig.Connections["connections"], conn)
+	}
+	opts := []splitpt.Option{
+		splitpt.WithLogger(config.Logger),
+		splitpt.WithDialer(h.dialPath),
+		splitpt.WithStateDir(config.StateDir),
+	}
+	if config.Reporter != nil {
+		opts = append(opts, splitpt.WithReporter(config.Reporter))
+	}
+	if config.ClientMetrics != nil {
+		opts = append(opts, splitpt.WithMetrics(config.ClientMetrics))
+	}
+	if config.Recorder != nil {
+		opts = append(opts, splitpt.WithRecorder(config.Recorder))
+	}
+	h.Client, err = splitpt.NewClient(clientConfig, opts...)
+	if err != nil {
+		sln.Close()
+		return nil, err
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.serve()
+	}()
+	return h, nil
+}
+
+// Close closes the client and the server and waits for the server's accept
+// loop to finish. Stream handlers that are still running are not waited for.
+func (h *Harness) Close() error {
+	err := h.Client.Close()
+	err2 := h.Listener.Close()
+	if err == nil {
+		err = err2
+	}
+	h.wg.Wait()
+	return err
+}
+
+func (h *Harness) serve() {
+	for {
+		conn, err := h.Listener.Accept()
+		if err != nil {
+			return
+		}
+		go h.config.Handler(conn)
+	}
+}
+
+// dialPath is the client's splitpt.DialFunc.
+func (h *Harness) dialPath(ctx context.Context, conn splitpt.Connection) (net.Conn, error) {
+	i, err := strconv.Atoi(strings.TrimPrefix(conn.Bridge, "path"))
+	if err != nil {
+		return nil, err
+	}
+	if h.config.Blocked != nil && h.config.Blocked(i) {
+		return nil, errBlocked
+	}
+	var c net.Conn
+	switch ln := h.lns[i%len(h.lns)].(type) {
+	case *PipeListener:
+		c, err = ln.DialContext(ctx)
+	default:
+		var d net.Dialer
+		c, err = d.DialContext(ctx, "tcp", ln.Addr().String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.config.WrapPath != nil {
+		c = h.config.WrapPath(i, c)
+	}
+	return c, nil
+}
+
+// Echo copies everything read from conn back to it, then closes it.
+func Echo(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
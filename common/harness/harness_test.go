@@ -0,0 +1,989 @@
+package harness
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt"
+	"anticensorshiptrafficsplitting/splitpt/common/link"
+	"anticensorshiptrafficsplitting/splitpt/common/metrics"
+	"anticensorshiptrafficsplitting/splitpt/common/netem"
+	"anticensorshiptrafficsplitting/splitpt/common/split"
+	"anticensorshiptrafficsplitting/splitpt/common/trace"
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
+)
+
+var splittingAlgs = []string{"round-robin", "random", "adaptive-bandwidth", "per-stream", "redundant", "flowlet", "size-class"}
+
+// transfer writes data to a new stream and checks that the echo server sends
+// exactly the same bytes back.
+func transfer(t *testing.T, h *Harness, data []byte) {
+	err := tryTransfer(h, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tryTransfer is transfer for goroutines other than the test's, returning an
+// error instead of failing the test.
+func tryTransfer(h *Harness, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := h.Client.DialContext(ctx)
+	if err != nil {
+		return fmt.Errorf("DialContext: %w", err)
+	}
+	defer conn.Close()
+	return tryEcho(conn, data)
+}
+
+// echo writes data to a stream to the echo server and checks that exactly the
+// same bytes come back.
+func echo(t *testing.T, conn net.Conn, data []byte) {
+	err := tryEcho(conn, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tryEcho is echo, returning an error instead of failing the test.
+func tryEcho(conn net.Conn, data []byte) error {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		errCh <- err
+	}()
+	got := make([]byte, len(data))
+	_, err := io.ReadFull(conn, got)
+	if err != nil {
+		return fmt.Errorf("reading echo: %w", err)
+	}
+	if err := <-errCh; err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+	if !bytes.Equal(got, data) {
+		return errors.New("echoed data differs from data sent")
+	}
+	return nil
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTransfer(t *testing.T) {
+	for _, alg := range splittingAlgs {
+		for _, loopback := range []bool{false, true} {
+			for _, paths := range []int{1, 3} {
+				name := fmt.Sprintf("%s/paths=%d/loopback=%v", alg, paths, loopback)
+				t.Run(name, func(t *testing.T) {
+					h, err := Start(Config{SplittingAlg: alg, Paths: paths, Loopback: loopback})
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer h.Close()
+					transfer(t, h, randomBytes(t, 64*1024))
+				})
+			}
+		}
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	for _, alg := range splittingAlgs {
+		t.Run(alg, func(t *testing.T) {
+			h, err := Start(Config{SplittingAlg: alg, Paths: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			errs := make(chan error, 4)
+			for i := 0; i < 4; i++ {
+				data := randomBytes(t, 16*1024)
+				go func() {
+					errs <- tryTransfer(h, data)
+				}()
+			}
+			for i := 0; i < 4; i++ {
+				if err := <-errs; err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	// Redundant sends copies of packets back over the other listeners.
+	for _, alg := range []string{"round-robin", "redundant"} {
+		t.Run(alg, func(t *testing.T) {
+			// The paths of one session arrive on different listeners.
+			h, err := Start(Config{SplittingAlg: alg, Paths: 3, Listeners: 3, Loopback: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			transfer(t, h, randomBytes(t, 64*1024))
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	m := metrics.New()
+	h, err := Start(Config{
+		SplittingAlg: "round-robin",
+		Paths:        2,
+		RateLimit:    tt.RateLimit{SessionRate: 128 * 1024, SessionBurst: 16 * 1024},
+		Metrics:      m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	start := time.Now()
+	transfer(t, h, randomBytes(t, 192*1024))
+	// Both directions are limited, and the echo overlaps them, so the
+	// transfer takes at least the time to send the data once.
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("192 KiB echoed in %v at 128 KiB/s", elapsed)
+	}
+	if m.Get("throttled_bytes_in") == 0 && m.Get("throttled_bytes_out") == 0 {
+		t.Errorf("nothing throttled: %s", m)
+	}
+}
+
+func TestTuning(t *testing.T) {
+	for _, preset := range []string{"default", "low-latency", "bulk", "lossy"} {
+		t.Run(preset, func(t *testing.T) {
+			h, err := Start(Config{
+				SplittingAlg: "round-robin",
+				Paths:        2,
+				Tuning:       splitpt.Tuning{Preset: preset},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			transfer(t, h, randomBytes(t, 256*1024))
+		})
+	}
+
+	mtu := 1200
+	for _, c := range []struct {
+		client, server splitpt.Tuning
+		ok             bool
+	}{
+		{splitpt.Tuning{}, splitpt.Tuning{Preset: "bulk"}, true},
+		{splitpt.Tuning{Preset: "low-latency"}, splitpt.Tuning{Preset: "lossy"}, true},
+		{splitpt.Tuning{Preset: "bulk", MTU: mtu}, splitpt.Tuning{Preset: "default"}, true},
+		// The server acknowledges packets only every 100ms, after the
+		// client would retransmit them.
+		{splitpt.Tuning{Preset: "low-latency"}, splitpt.Tuning{Preset: "default"}, false},
+		{splitpt.Tuning{KeepAliveInterval: 2 * time.Minute, KeepAliveTimeout: 3 * time.Minute}, splitpt.Tuning{}, false},
+		{splitpt.Tuning{Preset: "fast"}, splitpt.Tuning{}, false},
+	} {
+		err := c.client.CompatibleWith(c.server)
+		if (err == nil) != c.ok {
+			t.Errorf("%+v with %+v: %v", c.client, c.server, err)
+		}
+	}
+
+	// The client checks its tuning against the server's, and takes the
+	// server's preset if it has none.
+	config := splitpt.Config{
+		SplittingAlg: "round-robin",
+		Connections:  map[string][]splitpt.Connection{"connections": {{Transport: "harness", Bridge: "path0"}}},
+		Tuning:       splitpt.Tuning{Preset: "lossy"},
+		ServerTuning: "default",
+	}
+	if _, err := splitpt.NewClient(config); err == nil {
+		t.Error("client tuned for lossy paths accepted a default server")
+	}
+	config.Tuning = splitpt.Tuning{}
+	config.ServerTuning = "lossy"
+	c, err := splitpt.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestDistributedServer(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	// The central node reassembles the paths that both edges forward.
+	sln, err := splitpt.Listen(NewPipeListener(), splitpt.ServerConfig{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sln.Close()
+	go func() {
+		for {
+			conn, err := sln.Accept()
+			if err != nil {
+				return
+			}
+			go Echo(conn)
+		}
+	}()
+	linkln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sln.AddListener(link.Listen(linkln, key, logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var edges []string
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		edge, err := splitpt.ListenEdge(ln, splitpt.EdgeConfig{Central: linkln.Addr().String(), Key: key, Logger: logger})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer edge.Close()
+		edges = append(edges, edge.Addr().String())
+	}
+
+	config := splitpt.Config{
+		SplittingAlg: "round-robin",
+		Connections: map[string][]splitpt.Connection{"connections": {
+			{Transport: "harness", Bridge: edges[0]},
+			{Transport: "harness", Bridge: edges[1]},
+		}},
+	}
+	dial := func(ctx context.Context, conn splitpt.Connection) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", conn.Bridge)
+	}
+	client, err := splitpt.NewClient(config, splitpt.WithLogger(logger), splitpt.WithDialer(dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	h := &Harness{Client: client}
+	transfer(t, h, randomBytes(t, 64*1024))
+
+	// An edge with the wrong key forwards nothing.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogue, err := splitpt.ListenEdge(ln, splitpt.EdgeConfig{Central: linkln.Addr().String(), Key: []byte("fedcba9876543210"), Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rogue.Close()
+	conn, err := net.Dial("tcp", rogue.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("path through an edge with the wrong key: %v", err)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	h, err := Start(Config{SplittingAlg: "round-robin", Paths: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	transfer(t, h, []byte("hello"))
+	err = h.Client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.Client.DialContext(context.Background())
+	if err == nil {
+		t.Fatal("DialContext after Close succeeded")
+	}
+}
+
+func TestDialWhileDialing(t *testing.T) {
+	for _, alg := range []string{"round-robin", "per-stream"} {
+		t.Run(alg, func(t *testing.T) {
+			dialing := make(chan struct{}, 1)
+			release := make(chan struct{})
+			h, err := Start(Config{
+				SplittingAlg: alg,
+				Paths:        1,
+				Blocked: func(i int) bool {
+					// Hold up every dial.
+					select {
+					case dialing <- struct{}{}:
+					default:
+					}
+					<-release
+					return false
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			defer close(release)
+			go h.Client.DialContext(context.Background())
+			<-dialing
+
+			// Another dial gives up when its ctx is done, and Close
+			// does not wait for the held-up dial either.
+			done := make(chan error, 2)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				_, err := h.Client.DialContext(ctx)
+				done <- err
+				done <- h.Client.Close()
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("DialContext: %v, want %v", err, context.DeadlineExceeded)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("DialContext waited for another dial past its ctx")
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Close waited for a dial")
+			}
+		})
+	}
+}
+
+func TestImpairedPaths(t *testing.T) {
+	for _, alg := range splittingAlgs {
+		t.Run(alg, func(t *testing.T) {
+			h, err := Start(Config{
+				SplittingAlg: alg,
+				Paths:        2,
+				Netem: []netem.Profile{
+					{Latency: 5 * time.Millisecond, Jitter: 2 * time.Millisecond},
+					{Latency: 20 * time.Millisecond, Loss: 0.01, MinRTO: 50 * time.Millisecond},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			transfer(t, h, randomBytes(t, 32*1024))
+		})
+	}
+}
+
+// countingConn counts the bytes written to a path.
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestAdaptiveBandwidthShare(t *testing.T) {
+	written := make([]atomic.Int64, 2)
+	h, err := Start(Config{
+		SplittingAlg: "adaptive-bandwidth",
+		Paths:        2,
+		Netem: []netem.Profile{
+			{Latency: 10 * time.Millisecond, Bandwidth: 50000},
+			{Latency: 10 * time.Millisecond, Bandwidth: 1000000},
+		},
+		WrapPath: func(i int, conn net.Conn) net.Conn {
+			return countingConn{Conn: conn, written: &written[i]}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	transfer(t, h, randomBytes(t, 512*1024))
+	slow, fast := written[0].Load(), written[1].Load()
+	if fast < 2*slow {
+		t.Fatalf("fast path carried %d bytes, slow path %d", fast, slow)
+	}
+}
+
+func TestPerStreamMigration(t *testing.T) {
+	var lock sync.Mutex
+	var dialed []net.Conn
+	h, err := Start(Config{
+		SplittingAlg: "per-stream",
+		Paths:        2,
+		WrapPath: func(i int, conn net.Conn) net.Conn {
+			lock.Lock()
+			defer lock.Unlock()
+			dialed = append(dialed, conn)
+			return conn
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := h.Client.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, randomBytes(t, 16*1024))
+
+	// Break the stream's path. The stream should carry on over another.
+	lock.Lock()
+	if len(dialed) != 1 {
+		t.Fatalf("per-stream client dialed %d paths for one stream", len(dialed))
+	}
+	dialed[0].Close()
+	lock.Unlock()
+	echo(t, conn, randomBytes(t, 16*1024))
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(dialed) != 2 {
+		t.Fatalf("dialed %d paths, want a replacement for the broken one", len(dialed))
+	}
+}
+
+func TestPerStreamTrace(t *testing.T) {
+	var buf bytes.Buffer
+	rec, err := trace.NewRecorder(&buf, trace.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := Start(Config{SplittingAlg: "per-stream", Paths: 2, Recorder: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer(t, h, []byte("hello"))
+	transfer(t, h, []byte("hello"))
+	h.Close()
+	rec.Close()
+
+	// The two streams are pinned to sessions of their own, each with a
+	// path 0, which the trace keeps apart.
+	r, err := trace.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := make(map[trace.SessionID]bool)
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Path != 0 {
+			t.Fatalf("record of path %d in a single-path session", record.Path)
+		}
+		sessions[record.Session] = true
+	}
+	if len(sessions) != 2 || sessions[trace.SessionID{}] {
+		t.Fatalf("trace has sessions %v, want two", sessions)
+	}
+}
+
+func TestRedundantStalledPath(t *testing.T) {
+	h, err := Start(Config{
+		SplittingAlg: "redundant",
+		Paths:        2,
+		Netem: []netem.Profile{
+			{Latency: 10 * time.Minute},
+			{},
+		},
+		// The stalled path may be the one that carries the session
+		// secret, which the other then waits for.
+		AttachWait: 1 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	// Every packet also takes the unimpaired path, so the stall, which
+	// outlasts the deadlines of transfer, does not hold up the transfer.
+	transfer(t, h, randomBytes(t, 32*1024))
+}
+
+// blackholeConn silently discards everything written to it, like a path a
+// censor black-holes without closing.
+type blackholeConn struct {
+	net.Conn
+}
+
+func (c blackholeConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestHealthCheckBlackhole(t *testing.T) {
+	m := metrics.New()
+	var written atomic.Int64
+	h, err := Start(Config{
+		SplittingAlg: "round-robin",
+		Paths:        2,
+		Health: splitpt.HealthCheck{HealthConfig: split.HealthConfig{
+			Interval:        50 * time.Millisecond,
+			Timeout:         200 * time.Millisecond,
+			QuarantineAfter: 2,
+		}},
+		// The black-holed path may be the one that carries the session
+		// secret, which the other then waits for.
+		AttachWait:    1 * time.Second,
+		ClientMetrics: m,
+		WrapPath: func(i int, conn net.Conn) net.Conn {
+			if i == 0 {
+				return countingConn{Conn: blackholeConn{conn}, written: &written}
+			}
+			return conn
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	transfer(t, h, randomBytes(t, 64*1024))
+	// The path is quarantined after missing two probes, well within the
+	// time given.
+	deadline := time.Now().Add(10 * time.Second)
+	for m.Get("path_quarantines") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("black-holed path was not quarantined")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Once quarantined, the path carries little of the next transfer:
+	// at most what was already queued on it.
+	before := written.Load()
+	transfer(t, h, randomBytes(t, 64*1024))
+	if n := written.Load() - before; n > 16*1024 {
+		t.Fatalf("quarantined path carried %d bytes of 64 KiB", n)
+	}
+}
+
+func TestHotSwapPaths(t *testing.T) {
+	for _, alg := range splittingAlgs {
+		t.Run(alg, func(t *testing.T) {
+			var added atomic.Int64
+			h, err := Start(Config{
+				SplittingAlg: alg,
+				Paths:        2,
+				WrapPath: func(i int, conn net.Conn) net.Conn {
+					if i == 2 {
+						return countingConn{Conn: conn, written: &added}
+					}
+					return conn
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, err := h.Client.DialContext(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			echo(t, conn, randomBytes(t, 16*1024))
+
+			// Rotate both original paths out for a new one. The stream
+			// should carry on.
+			err = h.Client.AddPath(ctx, splitpt.Connection{Transport: "harness", Bridge: "path2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, bridge := range []string{"path0", "path1"} {
+				err = h.Client.RemovePath(bridge)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := h.Client.RemovePath("path2"); err == nil {
+				t.Fatal("removed the last path")
+			}
+			echo(t, conn, randomBytes(t, 16*1024))
+			if added.Load() == 0 {
+				t.Fatal("new path carried nothing")
+			}
+		})
+	}
+}
+
+// dialLog records the client end of every path dialed.
+type dialLog struct {
+	lock   sync.Mutex
+	dialed map[int][]net.Conn
+}
+
+func (l *dialLog) wrap(i int, conn net.Conn) net.Conn {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.dialed == nil {
+		l.dialed = make(map[int][]net.Conn)
+	}
+	l.dialed[i] = append(l.dialed[i], conn)
+	return conn
+}
+
+// paths returns the paths dialed so far.
+func (l *dialLog) paths() map[int]int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	counts := make(map[int]int)
+	for i, conns := range l.dialed {
+		counts[i] = len(conns)
+	}
+	return counts
+}
+
+// fail closes every conn dialed for path i.
+func (l *dialLog) fail(i int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, conn := range l.dialed[i] {
+		conn.Close()
+	}
+}
+
+func TestBridgePool(t *testing.T) {
+	stateDir := t.TempDir()
+	var dials dialLog
+	h, err := Start(Config{
+		SplittingAlg: "round-robin",
+		Paths:        4,
+		ActivePaths:  2,
+		StateDir:     stateDir,
+		WrapPath:     dials.wrap,
+		Blocked:      func(i int) bool { return i == 0 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := h.Client.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, randomBytes(t, 16*1024))
+	// Path 0 is blocked, so the next two in the pool are used.
+	if got := dials.paths(); len(got) != 2 || got[1] != 1 || got[2] != 1 {
+		t.Fatalf("dialed paths %v, want 1 and 2", got)
+	}
+
+	// Break path 1. It is replaced with path 3, the only good bridge
+	// left, and the stream carries on.
+	dials.fail(1)
+	echo(t, conn, randomBytes(t, 16*1024))
+	if got := dials.paths(); got[3] != 1 {
+		t.Fatalf("dialed paths %v, want a replacement on path 3", got)
+	}
+	h.Close()
+
+	// A new client remembers the bad bridges, and avoids them even though
+	// they work again.
+	var dials2 dialLog
+	h2, err := Start(Config{
+		SplittingAlg: "round-robin",
+		Paths:        4,
+		ActivePaths:  2,
+		StateDir:     stateDir,
+		WrapPath:     dials2.wrap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+	transfer(t, h2, []byte("hello"))
+	if got := dials2.paths(); len(got) != 2 || got[2] != 1 || got[3] != 1 {
+		t.Fatalf("restarted client dialed paths %v, want 2 and 3", got)
+	}
+}
+
+func TestSameBridgeTwice(t *testing.T) {
+	var dials dialLog
+	h, err := Start(Config{
+		SplittingAlg: "round-robin",
+		Paths:        2,
+		Bridges:      1,
+		WrapPath:     dials.wrap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := h.Client.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, randomBytes(t, 16*1024))
+	if got := dials.paths(); got[0] != 2 {
+		t.Fatalf("dialed paths %v, want 2 to the one bridge", got)
+	}
+
+	// Break one of the two paths to the bridge. It is replaced with
+	// another to the same bridge.
+	dials.lock.Lock()
+	dials.dialed[0][0].Close()
+	dials.lock.Unlock()
+	echo(t, conn, randomBytes(t, 16*1024))
+	deadline := time.Now().Add(5 * time.Second)
+	for dials.paths()[0] != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("dialed paths %v, want a replacement to the bridge", dials.paths())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAddPathDuringRedial(t *testing.T) {
+	var dials dialLog
+	var slow atomic.Bool
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	h, err := Start(Config{
+		SplittingAlg: "round-robin",
+		Paths:        4,
+		ActivePaths:  2,
+		WrapPath:     dials.wrap,
+		Blocked: func(i int) bool {
+			// Hold up the first replacement dial.
+			if slow.CompareAndSwap(true, false) {
+				close(dialing)
+				<-release
+			}
+			return false
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := h.Client.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, randomBytes(t, 16*1024))
+
+	// While path 1 is being replaced, the session still has two paths,
+	// so a path added to the pool stands by.
+	slow.Store(true)
+	dials.fail(1)
+	<-dialing
+	err = h.Client.AddPath(ctx, splitpt.Connection{Transport: "harness", Bridge: "path4"})
+	close(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, randomBytes(t, 16*1024))
+	deadline := time.Now().Add(5 * time.Second)
+	for dials.paths()[2] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("dialed paths %v, want a replacement on path 2", dials.paths())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := dials.paths(); len(got) != 3 {
+		t.Fatalf("dialed paths %v, want 0, 1 and a replacement on 2", got)
+	}
+}
+
+func TestBridgeRotation(t *testing.T) {
+	var dials dialLog
+	h, err := Start(Config{
+		SplittingAlg: "round-robin",
+		Paths:        3,
+		ActivePaths:  2,
+		RotateEvery:  100 * time.Millisecond,
+		WrapPath:     dials.wrap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := h.Client.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 5; i++ {
+		echo(t, conn, randomBytes(t, 4*1024))
+		time.Sleep(100 * time.Millisecond)
+	}
+	if got := dials.paths(); len(got) != 3 {
+		t.Fatalf("dialed paths %v, want every bridge in turn", got)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	stateDir := t.TempDir()
+	h, err := Start(Config{
+		SplittingAlg: "adaptive-bandwidth",
+		Paths:        2,
+		StateDir:     stateDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer(t, h, randomBytes(t, 1024*1024))
+	h.Close()
+
+	var state struct {
+		Version int
+		Bridges map[string]struct {
+			Dials int
+			Rate  float64
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(stateDir, "splitpt-state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != 1 {
+		t.Fatalf("state file has version %d, want 1", state.Version)
+	}
+	for _, bridge := range []string{"path0", "path1"} {
+		r := state.Bridges[bridge]
+		if r.Dials != 1 || r.Rate == 0 {
+			t.Fatalf("state of %s is %+v, want 1 dial and a rate", bridge, r)
+		}
+	}
+
+	// A state file of an unknown version is left alone.
+	future := []byte(`{"version": 99}`)
+	err = os.WriteFile(filepath.Join(stateDir, "splitpt-state.json"), future, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := Start(Config{
+		SplittingAlg: "adaptive-bandwidth",
+		Paths:        2,
+		StateDir:     stateDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer(t, h2, []byte("hello"))
+	h2.Close()
+	data, err = os.ReadFile(filepath.Join(stateDir, "splitpt-state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, future) {
+		t.Fatalf("state file of version 99 was overwritten with %s", data)
+	}
+}
+
+// statusLog is a splitpt.Reporter that records status updates.
+type statusLog struct {
+	lock     sync.Mutex
+	statuses []string
+	warnings int
+}
+
+func (l *statusLog) Log(severity, message string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if severity == "warning" {
+		l.warnings++
+	}
+}
+
+func (l *statusLog) Status(transport string, kv ...string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.statuses = append(l.statuses, transport+" "+strings.Join(kv, " "))
+}
+
+func (l *statusLog) has(prefix string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, s := range l.statuses {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReporter(t *testing.T) {
+	var statuses statusLog
+	h, err := Start(Config{
+		SplittingAlg: "round-robin",
+		Paths:        2,
+		Blocked:      func(i int) bool { return i == 1 },
+		Reporter:     &statuses,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	transfer(t, h, []byte("hello"))
+
+	if !statuses.has("splitpt ADDRESS path0 PATH 0 CONNECT Success") {
+		t.Fatalf("no success reported for path 0 in %q", statuses.statuses)
+	}
+	if !statuses.has("splitpt ADDRESS path1 PATH 1 CONNECT Failed ERRMSG ") {
+		t.Fatalf("no failure reported for path 1 in %q", statuses.statuses)
+	}
+	if statuses.warnings == 0 {
+		t.Fatal("no warning logged for the blocked path")
+	}
+}
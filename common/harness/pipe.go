@@ -0,0 +1,65 @@
+package harness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+var errListenerClosed = errors.New("pipe listener is closed")
+
+type pipeAddr struct{}
+
+func (addr pipeAddr) Network() string { return "pipe" }
+func (addr pipeAddr) String() string  { return "pipe" }
+
+// PipeListener is a net.Listener whose connections are in-memory pipes,
+// created by calling DialContext.
+type PipeListener struct {
+	queue     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewPipeListener returns a new PipeListener.
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		queue:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// DialContext returns the client end of a new pipe whose server end will be
+// returned by Accept.
+func (ln *PipeListener) DialContext(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case ln.queue <- server:
+		return client, nil
+	case <-ln.closed:
+		return nil, errListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (ln *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.queue:
+		return conn, nil
+	case <-ln.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (ln *PipeListener) Close() error {
+	err := errListenerClosed
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+		err = nil
+	})
+	return err
+}
+
+func (ln *PipeListener) Addr() net.Addr { return pipeAddr{} }
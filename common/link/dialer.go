@@ -0,0 +1,142 @@
+package link
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/xtaci/smux"
+)
+
+// Dialer forwards paths to the central node over a link, which it dials when
+// first needed and again whenever it has closed. It is used on edge nodes and
+// is safe for concurrent use.
+type Dialer struct {
+	// Addr is the address of the central node's link listener.
+	Addr string
+	Key  []byte
+
+	lock sync.Mutex
+	sess *smux.Session
+	// dialing, if not nil, is closed when the link being dialed is ready
+	// or has failed, and cancelDial gives up on it.
+	dialing    chan struct{}
+	cancelDial context.CancelFunc
+	closed     bool
+}
+
+// DialPath returns a conn to the central node for one path. The path's bytes,
+// starting with its session ID, are to be copied to it unchanged, and its
+// replies copied back. After Close, it returns net.ErrClosed.
+func (d *Dialer) DialPath(ctx context.Context) (net.Conn, error) {
+	sess, err := d.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := sess.OpenStream()
+	if err != nil {
+		// The link may have failed since it was last used.
+		sess.Close()
+		sess, err = d.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stream, err = sess.OpenStream()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stream, nil
+}
+
+// session returns the open link, dialing a new one if there is none. Only one
+// link is dialed at a time, without holding d.lock, and callers that find a
+// dial in progress wait for it.
+func (d *Dialer) session(ctx context.Context) (*smux.Session, error) {
+	d.lock.Lock()
+	for {
+		if d.closed {
+			d.lock.Unlock()
+			return nil, net.ErrClosed
+		}
+		if d.sess != nil && !d.sess.IsClosed() {
+			sess := d.sess
+			d.lock.Unlock()
+			return sess, nil
+		}
+		if d.dialing == nil {
+			break
+		}
+		dialing := d.dialing
+		d.lock.Unlock()
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		d.lock.Lock()
+	}
+	dialing := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
+	d.dialing = dialing
+	d.cancelDial = cancel
+	d.lock.Unlock()
+
+	sess, err := d.dial(ctx)
+	cancel()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.dialing = nil
+	d.cancelDial = nil
+	close(dialing)
+	if d.closed {
+		if sess != nil {
+			sess.Close()
+		}
+		return nil, net.ErrClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.sess = sess
+	return sess, nil
+}
+
+// dial dials a link and runs its handshake, giving up when ctx is done.
+func (d *Dialer) dial(ctx context.Context) (*smux.Session, error) {
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	// Closing conn interrupts the handshake.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	rconn, err := handshake(conn, d.Key, true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sess, err := smux.Client(rconn, smuxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// Close closes the link and gives up on any link being dialed. Later calls to
+// DialPath fail.
+func (d *Dialer) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.closed = true
+	if d.cancelDial != nil {
+		d.cancelDial()
+	}
+	if d.sess == nil {
+		return nil
+	}
+	return d.sess.Close()
+}
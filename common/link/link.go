@@ -0,0 +1,224 @@
+/*
+Package link connects the edge nodes of a distributed splitpt server to its
+central node, so that paths through bridges on different hosts can be
+reassembled into one session.
+
+An edge node accepts paths like any splitpt server, but instead of
+reassembling them it forwards each one, unchanged, over a link to the central
+node: the path's session ID followed by its frames. The central node accepts
+the forwarded paths from a Listener, which it adds to its splitpt listener, so
+that they join the sessions of paths from every other edge and from its own
+addresses.
+
+A link is a TCP connection on which the nodes first prove to each other that
+they hold the same pre-shared key, then exchange records encrypted and
+authenticated with keys derived from it, and the nonces both chose. The
+forwarded paths are smux streams over the records.
+
+	// On the central node:
+	ln, err := net.Listen("tcp", ":7000")
+	sln.AddListener(link.Listen(ln, key, logger))
+
+	// On an edge node, for each accepted path:
+	conn, err := dialer.DialPath(ctx)
+*/
+package link
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// version is the first byte an edge sends on a link.
+	version = 1
+	// nonceLen is the length of the nonce each node sends in the
+	// handshake.
+	nonceLen = 32
+	// MinKeyLen is the length of the shortest key that may be used.
+	MinKeyLen = 16
+	// maxRecord is the most plaintext bytes in a record.
+	maxRecord = 16 * 1024
+	// handshakeTimeout bounds the handshake of a link.
+	handshakeTimeout = 10 * time.Second
+)
+
+// ErrAuth is returned when the other end of a link does not prove that it
+// holds the key, or a record fails to authenticate.
+var ErrAuth = errors.New("link authentication failed")
+
+// LoadKey reads a key from a file that holds it in base64.
+func LoadKey(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("bad link key in %s: %w", filename, err)
+	}
+	if len(key) < MinKeyLen {
+		return nil, fmt.Errorf("link key in %s is shorter than %d bytes", filename, MinKeyLen)
+	}
+	return key, nil
+}
+
+// mac returns the handshake MAC of a node with the given role.
+func mac(key []byte, role string, edgeNonce, centralNonce []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("splitpt link " + role))
+	h.Write(edgeNonce)
+	h.Write(centralNonce)
+	return h.Sum(nil)
+}
+
+// handshake authenticates a link and returns it wrapped in records. edge says
+// which end of the link this is.
+func handshake(conn net.Conn, key []byte, edge bool) (net.Conn, error) {
+	if len(key) < MinKeyLen {
+		return nil, fmt.Errorf("link key is shorter than %d bytes", MinKeyLen)
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	edgeNonce := make([]byte, nonceLen)
+	centralNonce := make([]byte, nonceLen)
+	buf := make([]byte, 1+nonceLen+sha256.Size)
+	if edge {
+		buf[0] = version
+		if _, err := rand.Read(edgeNonce); err != nil {
+			return nil, err
+		}
+		copy(buf[1:], edgeNonce)
+		if _, err := conn.Write(buf[:1+nonceLen]); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:nonceLen+sha256.Size]); err != nil {
+			return nil, err
+		}
+		copy(centralNonce, buf)
+		if !hmac.Equal(buf[nonceLen:nonceLen+sha256.Size], mac(key, "central", edgeNonce, centralNonce)) {
+			return nil, ErrAuth
+		}
+		if _, err := conn.Write(mac(key, "edge", edgeNonce, centralNonce)); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := io.ReadFull(conn, buf[:1+nonceLen]); err != nil {
+			return nil, err
+		}
+		if buf[0] != version {
+			return nil, fmt.Errorf("unknown link version %d", buf[0])
+		}
+		copy(edgeNonce, buf[1:])
+		if _, err := rand.Read(centralNonce); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(append(centralNonce, mac(key, "central", edgeNonce, centralNonce)...)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:sha256.Size]); err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(buf[:sha256.Size], mac(key, "edge", edgeNonce, centralNonce)) {
+			return nil, ErrAuth
+		}
+	}
+	edgeAEAD, err := newAEAD(mac(key, "edge records", edgeNonce, centralNonce))
+	if err != nil {
+		return nil, err
+	}
+	centralAEAD, err := newAEAD(mac(key, "central records", edgeNonce, centralNonce))
+	if err != nil {
+		return nil, err
+	}
+	if edge {
+		return &recordConn{Conn: conn, write: edgeAEAD, read: centralAEAD}, nil
+	}
+	return &recordConn{Conn: conn, write: centralAEAD, read: edgeAEAD}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// recordConn is a link after its handshake. Each record is a 2-byte length
+// followed by that much AES-GCM ciphertext, whose nonce counts the records
+// sent in its direction.
+type recordConn struct {
+	net.Conn
+
+	readLock  sync.Mutex
+	read      cipher.AEAD
+	readSeq   uint64
+	plaintext []byte
+
+	writeLock sync.Mutex
+	write     cipher.AEAD
+	writeSeq  uint64
+}
+
+func nonce(aead cipher.AEAD, seq uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], seq)
+	return n
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	for len(c.plaintext) == 0 {
+		var length [2]byte
+		if _, err := io.ReadFull(c.Conn, length[:]); err != nil {
+			return 0, err
+		}
+		record := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			return 0, err
+		}
+		plaintext, err := c.read.Open(record[:0], nonce(c.read, c.readSeq), record, nil)
+		if err != nil {
+			return 0, ErrAuth
+		}
+		c.readSeq++
+		c.plaintext = plaintext
+	}
+	n := copy(p, c.plaintext)
+	c.plaintext = c.plaintext[n:]
+	return n, nil
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	var n int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxRecord)]
+		record := make([]byte, 2, 2+len(chunk)+c.write.Overhead())
+		record = c.write.Seal(record, nonce(c.write, c.writeSeq), chunk, nil)
+		binary.BigEndian.PutUint16(record, uint16(len(record)-2))
+		c.writeSeq++
+		if _, err := c.Conn.Write(record); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
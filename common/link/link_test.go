@@ -0,0 +1,206 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// handshakePair runs both ends of a handshake over a pipe.
+func handshakePair(edgeKey, centralKey []byte) (edge, central net.Conn, edgeErr, centralErr error) {
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		central, centralErr = handshake(c2, centralKey, false)
+		if centralErr != nil {
+			c2.Close()
+		}
+		close(done)
+	}()
+	edge, edgeErr = handshake(c1, edgeKey, true)
+	if edgeErr != nil {
+		c1.Close()
+	}
+	<-done
+	return
+}
+
+func TestHandshake(t *testing.T) {
+	edge, central, err1, err2 := handshakePair(testKey, testKey)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	defer edge.Close()
+	defer central.Close()
+	data := make([]byte, 3*maxRecord+5)
+	rand.Read(data)
+	go edge.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(central, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data changed on the link")
+	}
+	go central.Write([]byte("reply"))
+	got = make([]byte, 5)
+	if _, err := io.ReadFull(edge, got); err != nil || string(got) != "reply" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+	_, _, err1, err2 = handshakePair(otherKey, testKey)
+	if !errors.Is(err1, ErrAuth) {
+		t.Errorf("edge with the wrong key: %v", err1)
+	}
+	if err2 == nil {
+		t.Error("central accepted an edge with the wrong key")
+	}
+}
+
+// flipConn flips a bit of everything written after the handshake.
+type flipConn struct {
+	net.Conn
+	armed bool
+}
+
+func (c *flipConn) Write(p []byte) (int, error) {
+	if c.armed {
+		p = append([]byte(nil), p...)
+		p[len(p)-1] ^= 1
+	}
+	return c.Conn.Write(p)
+}
+
+func TestTamperedRecord(t *testing.T) {
+	c1, c2 := net.Pipe()
+	flip := &flipConn{Conn: c1}
+	done := make(chan net.Conn)
+	go func() {
+		central, err := handshake(c2, testKey, false)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- central
+	}()
+	edge, err := handshake(flip, testKey, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	central := <-done
+	if central == nil {
+		return
+	}
+	flip.armed = true
+	go edge.Write([]byte("hello"))
+	_, err = central.Read(make([]byte, 5))
+	if !errors.Is(err, ErrAuth) {
+		t.Errorf("tampered record read with %v", err)
+	}
+}
+
+func TestForwardPaths(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Listen(ln, testKey, log.New(io.Discard, "", 0))
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	d := &Dialer{Addr: ln.Addr().String(), Key: testKey}
+	defer d.Close()
+	for i := 0; i < 3; i++ {
+		conn, err := d.DialPath(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("path"))
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "path" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+		conn.Close()
+		if i == 1 {
+			// A link that fails is dialed again.
+			d.lock.Lock()
+			d.sess.Close()
+			d.lock.Unlock()
+		}
+	}
+
+	bad := &Dialer{Addr: ln.Addr().String(), Key: []byte("fedcba9876543210")}
+	if _, err := bad.DialPath(context.Background()); !errors.Is(err, ErrAuth) {
+		t.Errorf("dialer with the wrong key: %v", err)
+	}
+}
+
+func TestDialerClose(t *testing.T) {
+	// The central node accepts links but never answers their handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := &Dialer{Addr: ln.Addr().String(), Key: testKey}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := d.DialPath(context.Background())
+			errs <- err
+		}()
+	}
+	for {
+		d.lock.Lock()
+		dialing := d.dialing != nil
+		d.lock.Unlock()
+		if dialing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Close returns without waiting for the handshake, which gives up.
+	d.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Errorf("DialPath during Close: %v", err)
+			}
+		case <-time.After(handshakeTimeout / 2):
+			t.Fatal("DialPath still dialing after Close")
+		}
+	}
+	if _, err := d.DialPath(context.Background()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("DialPath after Close: %v", err)
+	}
+}
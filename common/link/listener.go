@@ -0,0 +1,139 @@
+package link
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// smuxConfig is the configuration of the smux sessions over links.
+func smuxConfig() *smux.Config {
+	config := smux.DefaultConfig()
+	config.Version = 2
+	config.KeepAliveTimeout = 1 * time.Minute
+	return config
+}
+
+// Listener is a net.Listener for the paths that edge nodes forward over links.
+// It is used on the central node.
+type Listener struct {
+	ln     net.Listener
+	key    []byte
+	logger *log.Logger
+
+	queue     chan net.Conn
+	lock      sync.Mutex
+	sessions  map[*smux.Session]struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Listen accepts links from edge nodes holding key on ln, and returns a
+// Listener for the paths they forward. The Listener takes ownership of ln.
+// Failed handshakes are logged to logger, or the standard logger if it is nil.
+func Listen(ln net.Listener, key []byte, logger *log.Logger) *Listener {
+	if logger == nil {
+		logger = log.Default()
+	}
+	l := &Listener{
+		ln:       ln,
+		key:      key,
+		logger:   logger,
+		queue:    make(chan net.Conn),
+		sessions: make(map[*smux.Session]struct{}),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLinks()
+	return l
+}
+
+func (l *Listener) acceptLinks() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			l.Close()
+			return
+		}
+		go func() {
+			err := l.serveLink(conn)
+			if err != nil {
+				l.logger.Printf("Link from %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// serveLink authenticates a link and queues the paths forwarded on it until
+// it closes.
+func (l *Listener) serveLink(conn net.Conn) error {
+	defer conn.Close()
+	rconn, err := handshake(conn, l.key, false)
+	if err != nil {
+		return err
+	}
+	sess, err := smux.Server(rconn, smuxConfig())
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	l.lock.Lock()
+	select {
+	case <-l.closed:
+		l.lock.Unlock()
+		return nil
+	default:
+	}
+	l.sessions[sess] = struct{}{}
+	l.lock.Unlock()
+	defer func() {
+		l.lock.Lock()
+		delete(l.sessions, sess)
+		l.lock.Unlock()
+	}()
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			return nil
+		}
+		select {
+		case l.queue <- stream:
+		case <-l.closed:
+			stream.Close()
+			return nil
+		}
+	}
+}
+
+// Accept returns the next path forwarded by an edge node.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case conn := <-l.queue:
+		return conn, nil
+	}
+}
+
+// Addr returns the address links are accepted on.
+func (l *Listener) Addr() net.Addr { return l.ln.Addr() }
+
+// Close stops accepting links and closes every link.
+func (l *Listener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		l.lock.Lock()
+		close(l.closed)
+		for sess := range l.sessions {
+			sess.Close()
+		}
+		l.lock.Unlock()
+		err = l.ln.Close()
+	})
+	return err
+}
@@ -0,0 +1,101 @@
+/*
+Package metrics counts events of interest to operators, such as how often a
+splitting algorithm switches paths.
+
+A Metrics is a set of named counters. Like trace.Recorder, a nil *Metrics
+counts nothing, so code that reports events need not check whether anyone is
+collecting them. The splitpt client and server log their counters
+periodically; programs embedding splitpt can read them with Snapshot.
+*/
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics is a set of named counters. Its methods are safe to call from
+// multiple goroutines.
+type Metrics struct {
+	lock     sync.Mutex
+	counters map[string]uint64
+}
+
+// New returns an empty Metrics.
+func New() *Metrics {
+	return &Metrics{counters: make(map[string]uint64)}
+}
+
+// Add adds n to the named counter.
+func (m *Metrics) Add(name string, n uint64) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.counters[name] += n
+}
+
+// Get returns the value of the named counter.
+func (m *Metrics) Get(name string) uint64 {
+	if m == nil {
+		return 0
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.counters[name]
+}
+
+// Snapshot returns a copy of every counter.
+func (m *Metrics) Snapshot() map[string]uint64 {
+	snapshot := make(map[string]uint64)
+	if m == nil {
+		return snapshot
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for name, n := range m.counters {
+		snapshot[name] = n
+	}
+	return snapshot
+}
+
+// String formats every counter as "name=value", sorted by name.
+func (m *Metrics) String() string {
+	snapshot := m.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%d", name, snapshot[name])
+	}
+	return b.String()
+}
+
+// LogEvery logs the counters to logger every interval until ctx is done. It
+// logs nothing until some counter has been set.
+func (m *Metrics) LogEvery(ctx context.Context, logger *log.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s := m.String(); s != "" {
+				logger.Printf("Metrics: %s", s)
+			}
+		}
+	}
+}
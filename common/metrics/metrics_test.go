@@ -0,0 +1,29 @@
+package metrics
+
+import "testing"
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.Add("b", 2)
+	m.Add("a", 1)
+	m.Add("b", 3)
+	if got := m.Get("b"); got != 5 {
+		t.Fatalf("b = %d, want 5", got)
+	}
+	if got := m.String(); got != "a=1 b=5" {
+		t.Fatalf("String() = %q", got)
+	}
+	snapshot := m.Snapshot()
+	m.Add("a", 1)
+	if snapshot["a"] != 1 {
+		t.Fatal("snapshot changed with the counters")
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.Add("a", 1)
+	if m.Get("a") != 0 || m.String() != "" || len(m.Snapshot()) != 0 {
+		t.Fatal("nil Metrics counted something")
+	}
+}
@@ -0,0 +1,355 @@
+/*
+Package netem emulates an impaired network path on top of a net.Conn.
+
+A Conn returned by Wrap delays the data passing through it in both directions
+according to a Profile: fixed latency plus jitter, a bandwidth cap, random loss
+and periodic blackouts. Because splitpt paths are stream connections, loss is
+modeled the way TCP experiences it: nothing is dropped, but a lost segment is
+delivered only after a retransmission timeout, and everything behind it waits.
+Data is never reordered within a path.
+
+netem is meant for tests and for reproducing Shadow-like experiments locally;
+the client applies a profile to a path when its config has a netem section.
+*/
+package netem
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errClosed = errors.New("operation on closed connection")
+
+// Linux's minimum retransmission timeout.
+const defaultMinRTO = 200 * time.Millisecond
+
+// readChunkSize is the largest amount of data scheduled as a single unit in
+// the read direction.
+const readChunkSize = 16 * 1024
+
+// queueLen is how many chunks may be in flight in each direction before
+// writes and the underlying reads block.
+const queueLen = 256
+
+// Profile describes the impairments applied to each direction of a path.
+type Profile struct {
+	// Latency is the one-way delay added to all data.
+	Latency time.Duration `toml:"latency"`
+	// Jitter is the maximum random deviation from Latency, in either
+	// direction.
+	Jitter time.Duration `toml:"jitter"`
+	// Bandwidth caps throughput, in bytes per second. Zero means no cap.
+	Bandwidth int `toml:"bandwidth"`
+	// Loss is the probability, from 0 to 1, that a chunk of data is lost
+	// and must wait for a retransmission.
+	Loss float64 `toml:"loss"`
+	// MinRTO is the smallest retransmission timeout used when data is
+	// lost. If zero, 200ms is used.
+	MinRTO time.Duration `toml:"min_rto"`
+	// BlackoutEvery and BlackoutFor make the path deliver nothing for
+	// BlackoutFor out of every BlackoutEvery. Data sent during a blackout
+	// is delivered when it ends.
+	BlackoutEvery time.Duration `toml:"blackout_every"`
+	BlackoutFor   time.Duration `toml:"blackout_for"`
+	// Seed seeds the random number generator. If zero, a seed is chosen
+	// from the current time.
+	Seed int64 `toml:"seed"`
+}
+
+// IsZero reports whether the profile applies no impairment at all.
+func (p Profile) IsZero() bool {
+	return p.Latency == 0 && p.Jitter == 0 && p.Bandwidth == 0 && p.Loss == 0 &&
+		(p.BlackoutEvery == 0 || p.BlackoutFor == 0)
+}
+
+// chunk is a piece of data with the time it may be delivered.
+type chunk struct {
+	p  []byte
+	at time.Time
+}
+
+// schedule computes delivery times for one direction of a Conn.
+type schedule struct {
+	profile *Profile
+	start   time.Time
+	rng     *rand.Rand
+	// linkFree is when the emulated link finishes transmitting everything
+	// scheduled so far, for the bandwidth cap.
+	linkFree time.Time
+	// last is the delivery time of the previous chunk, to keep order.
+	last time.Time
+}
+
+// deliveryTime returns when n bytes handed over at now should arrive.
+func (s *schedule) deliveryTime(now time.Time, n int) time.Time {
+	p := s.profile
+	sent := now
+	if p.Bandwidth > 0 {
+		if s.linkFree.After(sent) {
+			sent = s.linkFree
+		}
+		sent = sent.Add(time.Duration(int64(n) * int64(time.Second) / int64(p.Bandwidth)))
+		s.linkFree = sent
+	}
+
+	at := sent.Add(p.Latency)
+	if p.Jitter > 0 {
+		at = at.Add(time.Duration(s.rng.Int63n(int64(2*p.Jitter)+1)) - p.Jitter)
+	}
+	if at.Before(sent) {
+		at = sent
+	}
+
+	// Each loss costs a retransmission timeout, doubling for consecutive
+	// losses of the same data.
+	rto := p.MinRTO
+	if rto == 0 {
+		rto = defaultMinRTO
+	}
+	if rtt := 2*p.Latency + 4*p.Jitter; rtt > rto {
+		rto = rtt
+	}
+	for p.Loss > 0 && s.rng.Float64() < p.Loss {
+		at = at.Add(rto)
+		rto *= 2
+	}
+
+	at = s.afterBlackout(at)
+	// TCP delivers in order: nothing overtakes earlier data.
+	if at.Before(s.last) {
+		at = s.last
+	}
+	s.last = at
+	return at
+}
+
+// afterBlackout returns t, or the end of the blackout that t falls in.
+func (s *schedule) afterBlackout(t time.Time) time.Time {
+	p := s.profile
+	if p.BlackoutEvery <= 0 || p.BlackoutFor <= 0 {
+		return t
+	}
+	since := t.Sub(s.start)
+	// The first blackout begins one period after the start.
+	if since < p.BlackoutEvery {
+		return t
+	}
+	offset := since % p.BlackoutEvery
+	if offset < p.BlackoutFor {
+		return t.Add(p.BlackoutFor - offset)
+	}
+	return t
+}
+
+// Conn is a net.Conn whose data is delayed according to a Profile.
+type Conn struct {
+	net.Conn
+	profile Profile
+
+	writeLock  sync.Mutex
+	writeSched schedule
+	writeQueue chan chunk
+
+	readLock     sync.Mutex
+	readSched    schedule
+	readQueue    chan chunk
+	pending      *chunk
+	readBuf      []byte
+	readDeadline atomic.Value // time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	// The error that ended either direction.
+	errLock sync.Mutex
+	err     error
+}
+
+// Wrap returns a Conn that impairs both directions of conn according to
+// profile. Closing the Conn closes conn.
+func Wrap(conn net.Conn, profile Profile) *Conn {
+	seed := profile.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	now := time.Now()
+	c := &Conn{
+		Conn:       conn,
+		profile:    profile,
+		writeQueue: make(chan chunk, queueLen),
+		readQueue:  make(chan chunk, queueLen),
+		closed:     make(chan struct{}),
+	}
+	c.writeSched = schedule{profile: &c.profile, start: now, rng: rand.New(rand.NewSource(seed))}
+	c.readSched = schedule{profile: &c.profile, start: now, rng: rand.New(rand.NewSource(seed + 1))}
+	c.readDeadline.Store(time.Time{})
+	go c.writeLoop()
+	go c.readLoop()
+	return c
+}
+
+// Profile returns the profile the Conn was created with.
+func (c *Conn) Profile() Profile { return c.profile }
+
+// setErr records err as the reason the Conn stopped working, unless a reason
+// has already been recorded.
+func (c *Conn) setErr(err error) {
+	c.errLock.Lock()
+	defer c.errLock.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *Conn) loadErr() error {
+	c.errLock.Lock()
+	defer c.errLock.Unlock()
+	if c.err == nil {
+		return errClosed
+	}
+	return c.err
+}
+
+// writeLoop delivers scheduled chunks to the underlying conn.
+func (c *Conn) writeLoop() {
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		var ch chunk
+		select {
+		case <-c.closed:
+			return
+		case ch = <-c.writeQueue:
+		}
+		if d := time.Until(ch.at); d > 0 {
+			timer.Reset(d)
+			select {
+			case <-c.closed:
+				return
+			case <-timer.C:
+			}
+		}
+		_, err := c.Conn.Write(ch.p)
+		if err != nil {
+			c.setErr(err)
+			c.Close()
+			return
+		}
+	}
+}
+
+// readLoop reads from the underlying conn and schedules what it reads for
+// delivery to Read.
+func (c *Conn) readLoop() {
+	defer close(c.readQueue)
+	for {
+		buf := make([]byte, readChunkSize)
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			at := c.readSched.deliveryTime(time.Now(), n)
+			select {
+			case c.readQueue <- chunk{buf[:n], at}:
+			case <-c.closed:
+				return
+			}
+		}
+		if err != nil {
+			c.setErr(err)
+			return
+		}
+	}
+}
+
+// Write schedules p for delivery and returns without waiting for it, unless
+// too much data is already in flight.
+func (c *Conn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.loadErr()
+	default:
+	}
+	// Copy the slice so that the caller may reuse p.
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	at := c.writeSched.deliveryTime(time.Now(), len(buf))
+	select {
+	case c.writeQueue <- chunk{buf, at}:
+		return len(p), nil
+	case <-c.closed:
+		return 0, c.loadErr()
+	}
+}
+
+// Read returns data from the underlying conn once its delivery time has come.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if len(c.readBuf) == 0 {
+		var deadline <-chan time.Time
+		if t := c.readDeadline.Load().(time.Time); !t.IsZero() {
+			timer := time.NewTimer(time.Until(t))
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		if c.pending == nil {
+			select {
+			case ch, ok := <-c.readQueue:
+				if !ok {
+					return 0, c.loadErr()
+				}
+				c.pending = &ch
+			case <-deadline:
+				return 0, os.ErrDeadlineExceeded
+			case <-c.closed:
+				return 0, c.loadErr()
+			}
+		}
+		if d := time.Until(c.pending.at); d > 0 {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-deadline:
+				return 0, os.ErrDeadlineExceeded
+			case <-c.closed:
+				return 0, c.loadErr()
+			}
+		}
+		c.readBuf = c.pending.p
+		c.pending = nil
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Close closes the underlying conn. Data still scheduled for delivery is
+// discarded.
+func (c *Conn) Close() error {
+	err := errClosed
+	c.closeOnce.Do(func() {
+		c.setErr(errClosed)
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// SetDeadline sets the read deadline. Writes never block on the network, so
+// write deadlines are ignored.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,111 @@
+package netem
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// timeTransfer writes data through a Conn with profile and returns how long
+// it took to arrive, and what arrived.
+func timeTransfer(t *testing.T, profile Profile, data []byte) (time.Duration, []byte) {
+	a, b := net.Pipe()
+	c := Wrap(a, profile)
+	defer c.Close()
+	defer b.Close()
+
+	start := time.Now()
+	go c.Write(data)
+	got := make([]byte, len(data))
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := io.ReadFull(b, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start), got
+}
+
+func TestLatency(t *testing.T) {
+	elapsed, _ := timeTransfer(t, Profile{Latency: 100 * time.Millisecond}, []byte("x"))
+	if elapsed < 100*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("took %v with 100ms latency", elapsed)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	// 20 KB at 100 KB/s takes 200ms.
+	elapsed, _ := timeTransfer(t, Profile{Bandwidth: 100 * 1024}, make([]byte, 20*1024))
+	if elapsed < 200*time.Millisecond {
+		t.Fatalf("took %v, faster than the bandwidth cap", elapsed)
+	}
+}
+
+func TestOrderPreserved(t *testing.T) {
+	a, b := net.Pipe()
+	c := Wrap(a, Profile{Latency: 10 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.2, MinRTO: 20 * time.Millisecond, Seed: 1})
+	defer c.Close()
+	defer b.Close()
+
+	var want []byte
+	for i := 0; i < 100; i++ {
+		p := []byte{byte(i)}
+		want = append(want, p...)
+		_, err := c.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make([]byte, len(want))
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := io.ReadFull(b, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("data reordered: %v", got)
+	}
+}
+
+func TestReadDirection(t *testing.T) {
+	a, b := net.Pipe()
+	c := Wrap(a, Profile{Latency: 100 * time.Millisecond})
+	defer c.Close()
+	defer b.Close()
+
+	start := time.Now()
+	go b.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(c, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("read took %v with 100ms latency", elapsed)
+	}
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = c.Read(buf)
+	if err == nil || !err.(net.Error).Timeout() {
+		t.Fatalf("Read past deadline returned %v", err)
+	}
+}
+
+func TestBlackout(t *testing.T) {
+	start := time.Now()
+	s := schedule{profile: &Profile{BlackoutEvery: time.Second, BlackoutFor: 300 * time.Millisecond}, start: start}
+	for _, test := range []struct {
+		offset, want time.Duration
+	}{
+		{500 * time.Millisecond, 500 * time.Millisecond},
+		{1100 * time.Millisecond, 1300 * time.Millisecond},
+		{1400 * time.Millisecond, 1400 * time.Millisecond},
+		{2000 * time.Millisecond, 2300 * time.Millisecond},
+	} {
+		got := s.afterBlackout(start.Add(test.offset)).Sub(start)
+		if got != test.want {
+			t.Errorf("data due at %v delivered at %v, want %v", test.offset, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package ptproto
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Method is a transport method a child PT offers as a client: a SOCKS proxy
+// that connects through the transport.
+type Method struct {
+	Name string
+	// Protocol is the SOCKS version, "socks4" or "socks5".
+	Protocol string
+	Addr     string
+}
+
+// VersionError reports a VERSION-ERROR: the PT supports none of the
+// protocol versions it was offered.
+type VersionError struct{ Message string }
+
+func (e *VersionError) Error() string {
+	return "PT supports no offered protocol version: " + e.Message
+}
+
+// EnvError reports an ENV-ERROR: the PT was launched with a missing or bad
+// environment variable.
+type EnvError struct{ Message string }
+
+func (e *EnvError) Error() string {
+	return "PT environment error: " + e.Message
+}
+
+// MethodError reports that a PT cannot provide a method: it sent a
+// CMETHOD-ERROR, or finished its methods without the one wanted.
+type MethodError struct {
+	Method  string
+	Message string
+}
+
+func (e *MethodError) Error() string {
+	return fmt.Sprintf("PT cannot provide method %s: %s", e.Method, e.Message)
+}
+
+// SyntaxError reports a line of the protocol that could not be understood.
+type SyntaxError struct {
+	Line    string
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bad PT line %q: %s", e.Line, e.Message)
+}
+
+// ClientStartup follows the lines a child PT writes as it starts up as a
+// client, until it offers the method wanted or fails to.
+type ClientStartup struct {
+	// Method is the name of the method wanted.
+	Method string
+}
+
+// Line handles one line the PT wrote. It returns the method once the PT
+// offers it, or an error if the PT cannot provide it, either of which ends
+// the startup. Lines that are not part of the startup, such as LOG and
+// STATUS, and methods other than the one wanted, are ignored.
+func (s *ClientStartup) Line(text string) (*Method, error) {
+	l, err := ParseLine(text)
+	if err != nil {
+		keyword, _, _ := strings.Cut(text, " ")
+		switch keyword {
+		case "VERSION-ERROR", "ENV-ERROR", "CMETHOD-ERROR", "CMETHOD", "CMETHODS":
+			return nil, &SyntaxError{text, err.Error()}
+		}
+		// A garbled LOG line, say, does not stop the PT from working.
+		return nil, nil
+	}
+	switch l.Keyword {
+	case "VERSION-ERROR":
+		return nil, &VersionError{strings.Join(l.Args, " ")}
+	case "ENV-ERROR":
+		return nil, &EnvError{strings.Join(l.Args, " ")}
+	case "CMETHOD-ERROR":
+		if len(l.Args) < 1 {
+			return nil, &SyntaxError{text, "missing method name"}
+		}
+		if l.Args[0] == s.Method {
+			return nil, &MethodError{s.Method, strings.Join(l.Args[1:], " ")}
+		}
+	case "CMETHOD":
+		if len(l.Args) < 3 {
+			return nil, &SyntaxError{text, "want a method name, protocol and address"}
+		}
+		if l.Args[0] != s.Method {
+			return nil, nil
+		}
+		m := &Method{Name: l.Args[0], Protocol: l.Args[1], Addr: l.Args[2]}
+		if m.Protocol != "socks4" && m.Protocol != "socks5" {
+			return nil, &MethodError{s.Method, "unsupported proxy protocol " + m.Protocol}
+		}
+		return m, nil
+	case "CMETHODS":
+		if len(l.Args) == 1 && l.Args[0] == "DONE" {
+			return nil, &MethodError{s.Method, "method not offered"}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,212 @@
+/*
+Package ptproto parses and formats the lines of the pluggable transport
+managed proxy protocol (pt-spec.txt), which PTs write to their standard
+output for tor to read.
+
+splitpt is both sides of the protocol: it reads the lines of the child PTs
+it launches, and writes its own, and those it passes on, for tor.
+
+	line, err := ptproto.ParseLine(`LOG SEVERITY=notice MESSAGE="Connected"`)
+	if err != nil {
+		return err
+	}
+	message, _ := line.Get("MESSAGE")
+*/
+package ptproto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Line is one line of the protocol: a keyword followed by space-separated
+// arguments. Quoted values of KEY=VALUE arguments are unquoted.
+type Line struct {
+	Keyword string
+	Args    []string
+}
+
+// Get returns the value of the first KEY=VALUE argument with the given key.
+func (l Line) Get(key string) (string, bool) {
+	for _, arg := range l.Args {
+		k, v, ok := strings.Cut(arg, "=")
+		if ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// KeyValues returns the KEY=VALUE arguments of l as alternating keys and
+// values, skipping arguments that are not of that form.
+func (l Line) KeyValues() []string {
+	var kv []string
+	for _, arg := range l.Args {
+		k, v, ok := strings.Cut(arg, "=")
+		if ok {
+			kv = append(kv, k, v)
+		}
+	}
+	return kv
+}
+
+// ParseLine parses a line, without its newline. A value that begins with a
+// double quote is a CString, as in LOG and STATUS lines, and may contain
+// spaces.
+func ParseLine(s string) (Line, error) {
+	var l Line
+	for s != "" {
+		if s[0] == ' ' {
+			s = s[1:]
+			continue
+		}
+		var arg string
+		var err error
+		arg, s, err = parseArg(s)
+		if err != nil {
+			return Line{}, err
+		}
+		if l.Keyword == "" {
+			l.Keyword = arg
+		} else {
+			l.Args = append(l.Args, arg)
+		}
+	}
+	if l.Keyword == "" {
+		return Line{}, errors.New("empty line")
+	}
+	return l, nil
+}
+
+// parseArg parses the argument at the start of s, returning it and the rest
+// of s.
+func parseArg(s string) (string, string, error) {
+	i := strings.IndexAny(s, " \"")
+	if i < 0 {
+		return s, "", nil
+	}
+	if s[i] == ' ' {
+		return s[:i], s[i:], nil
+	}
+	value, rest, err := parseCString(s[i:])
+	if err != nil {
+		return "", "", err
+	}
+	if rest != "" && rest[0] != ' ' {
+		return "", "", fmt.Errorf("garbage after quoted string: %q", rest)
+	}
+	return s[:i] + value, rest, nil
+}
+
+// parseCString decodes the CString (control-spec.txt section 2.1.1) at the
+// start of s, returning it and the rest of s.
+func parseCString(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), s[i+1:], nil
+		case c != '\\':
+			b.WriteByte(c)
+		case i+1 >= len(s):
+			return "", "", errors.New("unterminated escape")
+		default:
+			i++
+			switch e := s[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0', '1', '2', '3':
+				if i+2 >= len(s) || !isOctal(s[i+1]) || !isOctal(s[i+2]) {
+					return "", "", errors.New("bad octal escape")
+				}
+				b.WriteByte((e-'0')<<6 | (s[i+1]-'0')<<3 | (s[i+2] - '0'))
+				i += 2
+			default:
+				b.WriteByte(e)
+			}
+		}
+	}
+	return "", "", errors.New("unterminated quoted string")
+}
+
+func isOctal(c byte) bool { return '0' <= c && c <= '7' }
+
+// Quote encodes s as a CString, escaping everything but printable ASCII other
+// than the double quote and backslash.
+func Quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range []byte(s) {
+		if c == ' ' || c == '!' || ('#' <= c && c <= '[') || (']' <= c && c <= '~') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// KeyValue formats a KEY=VALUE argument, quoting the value if it is empty or
+// contains anything but printable ASCII other than the double quote and
+// backslash.
+func KeyValue(key, value string) string {
+	if value == "" || strings.IndexFunc(value, needsQuote) >= 0 {
+		value = Quote(value)
+	}
+	return key + "=" + value
+}
+
+func needsQuote(r rune) bool {
+	return r <= ' ' || r > '~' || r == '"' || r == '\\'
+}
+
+// Format formats a line from a keyword and alternating keys and values, quoting
+// values as needed.
+func Format(keyword string, kv ...string) string {
+	var b strings.Builder
+	b.WriteString(keyword)
+	for i := 0; i+1 < len(kv); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(KeyValue(kv[i], kv[i+1]))
+	}
+	return b.String()
+}
+
+// Writer writes LOG and STATUS lines to W, as a PT does for tor. It is safe
+// for concurrent use.
+type Writer struct {
+	W    io.Writer
+	lock sync.Mutex
+}
+
+// Log writes a LOG line. Severities other than "error", "warning", "notice",
+// "info" and "debug" are written as "notice".
+func (w *Writer) Log(severity, message string) {
+	switch severity {
+	case "error", "warning", "notice", "info", "debug":
+	default:
+		severity = "notice"
+	}
+	w.writeLine("LOG SEVERITY=" + severity + " MESSAGE=" + Quote(message))
+}
+
+// Status writes a STATUS line about transport, with alternating keys and
+// values.
+func (w *Writer) Status(transport string, kv ...string) {
+	w.writeLine(Format("STATUS", append([]string{"TRANSPORT", transport}, kv...)...))
+}
+
+func (w *Writer) writeLine(line string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	fmt.Fprintln(w.W, line)
+}
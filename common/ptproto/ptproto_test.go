@@ -0,0 +1,125 @@
+package ptproto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		want Line
+	}{
+		{"CMETHODS DONE", Line{"CMETHODS", []string{"DONE"}}},
+		{"CMETHOD obfs4 socks5 127.0.0.1:1234", Line{"CMETHOD", []string{"obfs4", "socks5", "127.0.0.1:1234"}}},
+		{`LOG SEVERITY=notice MESSAGE="Hello, \"world\"\n"`, Line{"LOG", []string{"SEVERITY=notice", "MESSAGE=Hello, \"world\"\n"}}},
+		{`STATUS TRANSPORT=obfs4  CONNECT=Failed ERRMSG="no route \342\234\227"`, Line{"STATUS", []string{"TRANSPORT=obfs4", "CONNECT=Failed", "ERRMSG=no route ✗"}}},
+	} {
+		got, err := ParseLine(test.line)
+		if err != nil {
+			t.Errorf("ParseLine(%q): %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseLine(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+	for _, line := range []string{"", `LOG MESSAGE="unterminated`, `LOG MESSAGE="a"b`, `LOG MESSAGE="\08"`} {
+		if _, err := ParseLine(line); err == nil {
+			t.Errorf("ParseLine(%q) succeeded", line)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	kv := []string{"TRANSPORT", "splitpt", "ADDRESS", "192.0.2.1:443", "ERRMSG", "dial \"x\": refused\n", "EMPTY", ""}
+	s := Format("STATUS", kv...)
+	want := `STATUS TRANSPORT=splitpt ADDRESS=192.0.2.1:443 ERRMSG="dial \042x\042: refused\012" EMPTY=""`
+	if s != want {
+		t.Fatalf("Format = %s, want %s", s, want)
+	}
+	line, err := ParseLine(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line.Keyword != "STATUS" || !reflect.DeepEqual(line.KeyValues(), kv) {
+		t.Fatalf("round trip gave %q", line)
+	}
+	if v, ok := line.Get("ERRMSG"); !ok || v != kv[5] {
+		t.Fatalf("Get(ERRMSG) = %q, %v", v, ok)
+	}
+}
+
+func TestClientStartup(t *testing.T) {
+	for _, test := range []struct {
+		lines []string
+		addr  string
+		err   interface{}
+	}{
+		{[]string{"VERSION 1", `LOG SEVERITY=notice MESSAGE="hi"`, "CMETHOD meek_lite socks5 127.0.0.1:1", "CMETHOD obfs4 socks5 127.0.0.1:2"}, "127.0.0.1:2", nil},
+		{[]string{"VERSION-ERROR no-version"}, "", &VersionError{}},
+		{[]string{"VERSION 1", "ENV-ERROR No TOR_PT_STATE_LOCATION"}, "", &EnvError{}},
+		{[]string{"VERSION 1", "CMETHOD-ERROR obfs4 no such method"}, "", &MethodError{}},
+		{[]string{"VERSION 1", "CMETHOD-ERROR webtunnel no", "CMETHOD meek_lite socks5 127.0.0.1:1", "CMETHODS DONE"}, "", &MethodError{}},
+		{[]string{"VERSION 1", "CMETHOD obfs4 socks5"}, "", &SyntaxError{}},
+		{[]string{"VERSION 1", "CMETHOD obfs4 http 127.0.0.1:1"}, "", &MethodError{}},
+		{[]string{"VERSION 1", `LOG MESSAGE="garbled`, "CMETHOD obfs4 socks5 127.0.0.1:2"}, "127.0.0.1:2", nil},
+	} {
+		s := ClientStartup{Method: "obfs4"}
+		var m *Method
+		var err error
+		for _, line := range test.lines {
+			m, err = s.Line(line)
+			if m != nil || err != nil {
+				break
+			}
+		}
+		if test.err == nil {
+			if err != nil || m == nil || m.Addr != test.addr {
+				t.Errorf("%q: got %+v, %v, want %s", test.lines, m, err, test.addr)
+			}
+			continue
+		}
+		if reflect.TypeOf(err) != reflect.TypeOf(test.err) {
+			t.Errorf("%q: got error %v, want a %T", test.lines, err, test.err)
+		}
+	}
+}
+
+func TestServerStartup(t *testing.T) {
+	s := ServerStartup{Method: "obfs4"}
+	m, err := s.Line("SMETHOD meek 0.0.0.0:80")
+	if m != nil || err != nil {
+		t.Fatalf("other method gave %+v, %v", m, err)
+	}
+	m, err = s.Line(`SMETHOD obfs4 0.0.0.0:9090 ARGS:cert=AbC/d\=\=,iat-mode=0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ServerMethod{Name: "obfs4", Addr: "0.0.0.0:9090", Args: []string{"cert=AbC/d==", "iat-mode=0"}}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("got %+v, want %+v", m, want)
+	}
+	if _, err := s.Line("SMETHOD-ERROR obfs4 address in use"); err == nil {
+		t.Fatal("SMETHOD-ERROR gave no error")
+	}
+	if _, err := s.Line("SMETHODS DONE"); err == nil {
+		t.Fatal("SMETHODS DONE without the method gave no error")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &Writer{W: &buf}
+	w.Log("warning", "a \"b\"")
+	w.Log("loud", "c")
+	w.Status("splitpt", "ADDRESS", "192.0.2.1:443", "CONNECT", "Success")
+	want := `LOG SEVERITY=warning MESSAGE="a \042b\042"
+LOG SEVERITY=notice MESSAGE="c"
+STATUS TRANSPORT=splitpt ADDRESS=192.0.2.1:443 CONNECT=Success
+`
+	if buf.String() != want {
+		t.Fatalf("wrote\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,90 @@
+package ptproto
+
+import (
+	"strings"
+)
+
+// ServerMethod is a transport method a child PT offers as a server.
+type ServerMethod struct {
+	Name string
+	Addr string
+	// Args holds the KEY=VALUE arguments that clients need to connect,
+	// such as an obfs4 cert, unescaped.
+	Args []string
+}
+
+// ServerStartup follows the lines a child PT writes as it starts up as a
+// server, until it offers the method wanted or fails to.
+type ServerStartup struct {
+	// Method is the name of the method wanted.
+	Method string
+}
+
+// Line handles one line the PT wrote, like ClientStartup.Line.
+func (s *ServerStartup) Line(text string) (*ServerMethod, error) {
+	l, err := ParseLine(text)
+	if err != nil {
+		keyword, _, _ := strings.Cut(text, " ")
+		switch keyword {
+		case "VERSION-ERROR", "ENV-ERROR", "SMETHOD-ERROR", "SMETHOD", "SMETHODS":
+			return nil, &SyntaxError{text, err.Error()}
+		}
+		return nil, nil
+	}
+	switch l.Keyword {
+	case "VERSION-ERROR":
+		return nil, &VersionError{strings.Join(l.Args, " ")}
+	case "ENV-ERROR":
+		return nil, &EnvError{strings.Join(l.Args, " ")}
+	case "SMETHOD-ERROR":
+		if len(l.Args) < 1 {
+			return nil, &SyntaxError{text, "missing method name"}
+		}
+		if l.Args[0] == s.Method {
+			return nil, &MethodError{s.Method, strings.Join(l.Args[1:], " ")}
+		}
+	case "SMETHOD":
+		if len(l.Args) < 2 {
+			return nil, &SyntaxError{text, "want a method name and address"}
+		}
+		if l.Args[0] != s.Method {
+			return nil, nil
+		}
+		m := &ServerMethod{Name: l.Args[0], Addr: l.Args[1]}
+		for _, option := range l.Args[2:] {
+			if args, ok := strings.CutPrefix(option, "ARGS:"); ok {
+				m.Args = append(m.Args, splitArgs(args)...)
+			}
+		}
+		return m, nil
+	case "SMETHODS":
+		if len(l.Args) == 1 && l.Args[0] == "DONE" {
+			return nil, &MethodError{s.Method, "method not offered"}
+		}
+	}
+	return nil, nil
+}
+
+// splitArgs splits the comma-separated KEY=VALUE arguments of an SMETHOD
+// line's ARGS option, in which commas, equals signs and backslashes may be
+// escaped with a backslash.
+func splitArgs(s string) []string {
+	var args []string
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case c == ',':
+			args = append(args, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if b.Len() > 0 {
+		args = append(args, b.String())
+	}
+	return args
+}
@@ -0,0 +1,96 @@
+package split
+
+import (
+	"net"
+
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
+)
+
+// minShare is the smallest fraction of an equal share that any path gets, so
+// that every path keeps carrying enough traffic to be measured.
+const minShare = 0.1
+
+// AdaptiveBandwidthPacketConn implements the net.PacketConn interface by
+// sending packets on each connection in proportion to its measured capacity.
+// Capacities are estimated continuously from the server's feedback frames
+// (see pathStats), so the split follows bridges whose capacity changes over
+// time. Packets are spread with smooth weighted round-robin, which
+// interleaves paths instead of sending bursts on each.
+type AdaptiveBandwidthPacketConn struct {
+	*splitConn
+	// Smooth weighted round-robin state, one entry per path. getConn is
+	// only called from the loop that dispatches packets to paths, so it
+	// needs no lock.
+	current []float64
+	weights []float64
+}
+
+func NewAdaptiveBandwidthPacketConn(
+	sessionID tt.SessionID,
+	connList []net.Conn,
+	remote net.Addr,
+	opts ...Option,
+) *AdaptiveBandwidthPacketConn {
+	c := &AdaptiveBandwidthPacketConn{}
+	c.splitConn = newSplitConn(sessionID, connList, remote, c, opts)
+	c.start()
+	return c
+}
+
+// getConn returns the next connection to write a packet to
+func (c *AdaptiveBandwidthPacketConn) getConn(p []byte) *path {
+	if len(c.weights) != len(c.paths) {
+		// Paths were added or removed. Start over.
+		c.current = make([]float64, len(c.paths))
+		c.weights = make([]float64, len(c.paths))
+	}
+	capacityWeights(c.paths, c.weights)
+	best := 0
+	var total float64
+	for i, w := range c.weights {
+		c.current[i] += w
+		total += w
+		if c.current[i] > c.current[best] {
+			best = i
+		}
+	}
+	c.current[best] -= total
+	return c.paths[best]
+}
+
+// capacityWeights sets weights[i] to the estimated capacity of paths[i].
+// Paths without an estimate get the mean of the others, and no path gets less
+// than minShare of an equal share. Excluded paths get nothing.
+func capacityWeights(paths []*path, weights []float64) {
+	var known, sum float64
+	for i, p := range paths {
+		weights[i] = p.stats.capacity()
+		if weights[i] > 0 && !p.excluded.Load() {
+			known++
+			sum += weights[i]
+		}
+	}
+	mean := 1.0
+	if known > 0 {
+		mean = sum / known
+	}
+	var active float64
+	sum = 0
+	for i, p := range paths {
+		if p.excluded.Load() {
+			weights[i] = 0
+			continue
+		}
+		if weights[i] == 0 {
+			weights[i] = mean
+		}
+		active++
+		sum += weights[i]
+	}
+	floor := minShare * sum / active
+	for i, p := range paths {
+		if weights[i] < floor && !p.excluded.Load() {
+			weights[i] = floor
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package split
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
+)
+
+// DefaultFlowletGap is the idle gap that ends a flowlet if none is
+// configured. It is longer than KCP's default 100ms flush interval, so that a
+// transfer in progress stays on one path.
+const DefaultFlowletGap = 200 * time.Millisecond
+
+// FlowletPacketConn implements the net.PacketConn interface by sending bursts
+// of packets, flowlets, on one connection at a time. When no packet has been
+// sent for longer than the gap, the next packet starts a new flowlet on a
+// different connection, chosen at random in proportion to the connections'
+// measured capacities (see AdaptiveBandwidthPacketConn). Packets within a
+// flowlet are not reordered, but a page load made of several bursts is still
+// spread across bridges. Each switch counts towards the "flowlet_switches"
+// metric.
+type FlowletPacketConn struct {
+	*splitConn
+	gap time.Duration
+	// Flowlet state. getConn is only called from the loop that dispatches
+	// packets to paths, so it needs no lock.
+	current *path
+	last    time.Time
+	weights []float64
+}
+
+// NewFlowletPacketConn returns a FlowletPacketConn that starts a new flowlet
+// after an idle gap longer than gap, or DefaultFlowletGap if gap is zero.
+func NewFlowletPacketConn(
+	sessionID tt.SessionID,
+	connList []net.Conn,
+	remote net.Addr,
+	gap time.Duration,
+	opts ...Option,
+) *FlowletPacketConn {
+	if gap == 0 {
+		gap = DefaultFlowletGap
+	}
+	c := &FlowletPacketConn{gap: gap}
+	c.splitConn = newSplitConn(sessionID, connList, remote, c, opts)
+	c.start()
+	return c
+}
+
+// getConn returns the next connection to write a packet to
+func (c *FlowletPacketConn) getConn(p []byte) *path {
+	now := time.Now()
+	if c.current == nil || c.current.excluded.Load() || now.Sub(c.last) > c.gap {
+		next := c.choose()
+		if c.current != nil && next != c.current {
+			c.metrics.Add("flowlet_switches", 1)
+		}
+		c.current = next
+	}
+	c.last = now
+	return c.current
+}
+
+// choose picks the path for a new flowlet, weighted by capacity, excluding
+// the current path if there is another.
+func (c *FlowletPacketConn) choose() *path {
+	if len(c.weights) != len(c.paths) {
+		c.weights = make([]float64, len(c.paths))
+	}
+	capacityWeights(c.paths, c.weights)
+	var total float64
+	for i, p := range c.paths {
+		if p == c.current && len(c.activePaths()) > 1 {
+			c.weights[i] = 0
+		}
+		total += c.weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range c.weights {
+		if r < w {
+			return c.paths[i]
+		}
+		r -= w
+	}
+	// Rounding left r just short of total.
+	for i := len(c.paths) - 1; i >= 0; i-- {
+		if c.weights[i] > 0 {
+			return c.paths[i]
+		}
+	}
+	return c.paths[0]
+}
@@ -0,0 +1,301 @@
+package split
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// HealthState is what a SplittingPacketConn knows about whether a path works.
+type HealthState int32
+
+const (
+	// Healthy paths answer their probes.
+	Healthy HealthState = iota
+	// Degraded paths have recently missed a probe. They are still used.
+	Degraded
+	// Quarantined paths have missed several probes in a row, as when a
+	// censor black-holes a connection without closing it. Schedulers skip
+	// them, unless every path is quarantined.
+	Quarantined
+	// Probing paths were quarantined for long enough to be tried again.
+	// They are reinstated after answering several probes in a row, and
+	// quarantined again if they miss one. Schedulers skip them. A
+	// SplittingPacketConn that redials its paths replaces a probing path
+	// that misses a probe, rather than keeping it in quarantine.
+	Probing
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Quarantined:
+		return "quarantined"
+	case Probing:
+		return "probing"
+	}
+	return "unknown"
+}
+
+// HealthConfig configures path health checking. Zero fields take the
+// defaults given.
+type HealthConfig struct {
+	// Interval is how often each path is probed. Default 1s.
+	Interval time.Duration `toml:"interval"`
+	// Timeout is how long a probe may go unanswered before it counts as
+	// missed. Default 5s.
+	Timeout time.Duration `toml:"timeout"`
+	// QuarantineAfter is how many probes in a row a path may miss before
+	// it is quarantined. Default 3.
+	QuarantineAfter int `toml:"quarantine_after"`
+	// QuarantineFor is how long a path stays quarantined before it is
+	// probed again. Default 30s.
+	QuarantineFor time.Duration `toml:"quarantine_for"`
+	// ReinstateAfter is how many probes in a row a probing path must
+	// answer to be healthy again. Default 2.
+	ReinstateAfter int `toml:"reinstate_after"`
+}
+
+func (config HealthConfig) withDefaults() HealthConfig {
+	if config.Interval == 0 {
+		config.Interval = 1 * time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.QuarantineAfter == 0 {
+		config.QuarantineAfter = 3
+	}
+	if config.QuarantineFor == 0 {
+		config.QuarantineFor = 30 * time.Second
+	}
+	if config.ReinstateAfter == 0 {
+		config.ReinstateAfter = 2
+	}
+	return config
+}
+
+// WithHealthCheck makes the SplittingPacketConn probe each of its paths and
+// stop sending packets on paths that stop answering, until they answer again.
+func WithHealthCheck(config HealthConfig) Option {
+	return func(c *splitConn) {
+		config = config.withDefaults()
+		c.health = &config
+	}
+}
+
+// pathHealth is the health state machine of one path.
+type pathHealth struct {
+	lock          sync.Mutex
+	state         HealthState
+	misses        int
+	successes     int
+	quarantinedAt time.Time
+	nextSeq       uint64
+	// outstanding maps the sequence numbers of unanswered probes to when
+	// they were queued, or written once they have been.
+	outstanding map[uint64]time.Time
+}
+
+func (h *pathHealth) get() HealthState {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.state
+}
+
+// tick expires probes that have timed out and advances the state machine. It
+// returns the sequence number of a probe to send, if one should be sent now,
+// and the state before and after.
+func (h *pathHealth) tick(config *HealthConfig, now time.Time) (seq uint64, send bool, from, to HealthState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	from = h.state
+	for s, sentAt := range h.outstanding {
+		if now.Sub(sentAt) > config.Timeout {
+			delete(h.outstanding, s)
+			h.miss(config, now)
+		}
+	}
+	if h.state == Quarantined && now.Sub(h.quarantinedAt) > config.QuarantineFor {
+		h.state = Probing
+		h.successes = 0
+	}
+	if h.state != Quarantined {
+		if h.outstanding == nil {
+			h.outstanding = make(map[uint64]time.Time)
+		}
+		seq = h.nextSeq
+		h.nextSeq++
+		h.outstanding[seq] = now
+		send = true
+	}
+	return seq, send, from, h.state
+}
+
+// sent records that probe seq is being written now, so that its timeout does
+// not count the time it waited to be written.
+func (h *pathHealth) sent(seq uint64, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.outstanding[seq]; ok {
+		h.outstanding[seq] = now
+	}
+}
+
+func (h *pathHealth) miss(config *HealthConfig, now time.Time) {
+	h.successes = 0
+	h.misses++
+	switch h.state {
+	case Healthy:
+		h.state = Degraded
+		fallthrough
+	case Degraded:
+		if h.misses >= config.QuarantineAfter {
+			h.state = Quarantined
+			h.quarantinedAt = now
+		}
+	case Probing:
+		h.state = Quarantined
+		h.quarantinedAt = now
+	}
+}
+
+// reply records the answer to probe seq and returns the state before and
+// after.
+func (h *pathHealth) reply(config *HealthConfig, seq uint64) (from, to HealthState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	from = h.state
+	if _, ok := h.outstanding[seq]; !ok {
+		// Too late, or not ours.
+		return from, from
+	}
+	delete(h.outstanding, seq)
+	h.misses = 0
+	h.successes++
+	switch h.state {
+	case Degraded:
+		h.state = Healthy
+	case Probing:
+		if h.successes >= config.ReinstateAfter {
+			h.state = Healthy
+		}
+	}
+	return from, h.state
+}
+
+// monitor probes every path that has begun each health check interval until
+// the splitConn is closed. A path waiting to attach to the session is not
+// probed, so that the wait does not count against it.
+func (c *splitConn) monitor() {
+	ticker := time.NewTicker(c.health.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			changed := false
+			for _, p := range c.pathList() {
+				if !p.begun.Load() {
+					continue
+				}
+				seq, send, from, to := p.health.tick(c.health, now)
+				if from != to {
+					c.logTransition(p, from, to)
+					changed = true
+				}
+				if from == Probing && to == Quarantined && c.redial != nil {
+					// The path did not recover in quarantine.
+					// Stopping it has it redialed, elsewhere
+					// if the redial function can.
+					log.Printf("[Split Packet Conn] path %d: replacing", p.index)
+					c.metrics.Add("path_replacements", 1)
+					p.stop()
+					continue
+				}
+				if send {
+					select {
+					case p.probes <- seq:
+					default:
+					}
+				}
+			}
+			if changed {
+				c.updateExcluded()
+			}
+		}
+	}
+}
+
+// onProbeReply is called by the read loop of path p.
+func (c *splitConn) onProbeReply(p *path, seq uint64) {
+	if c.health == nil {
+		return
+	}
+	from, to := p.health.reply(c.health, seq)
+	if from != to {
+		c.logTransition(p, from, to)
+		c.updateExcluded()
+	}
+}
+
+func (c *splitConn) logTransition(p *path, from, to HealthState) {
+	log.Printf("[Split Packet Conn] path %d: %v -> %v", p.index, from, to)
+	if to == Quarantined {
+		c.metrics.Add("path_quarantines", 1)
+	}
+}
+
+// updateExcluded marks the paths that schedulers should skip: those that are
+// quarantined or probing, as long as some path is not.
+func (c *splitConn) updateExcluded() {
+	c.pathsLock.RLock()
+	defer c.pathsLock.RUnlock()
+	c.updateExcludedLocked()
+}
+
+// updateExcludedLocked is updateExcluded for callers holding pathsLock.
+func (c *splitConn) updateExcludedLocked() {
+	c.excludedLock.Lock()
+	defer c.excludedLock.Unlock()
+	var active []*path
+	for _, p := range c.paths {
+		if s := p.health.get(); s != Quarantined && s != Probing {
+			active = append(active, p)
+		}
+	}
+	if len(active) == 0 {
+		active = c.paths
+	}
+	for _, p := range c.paths {
+		p.excluded.Store(true)
+	}
+	for _, p := range active {
+		p.excluded.Store(false)
+	}
+	c.active.Store(&active)
+}
+
+// activePaths returns the paths that schedulers should choose from. It is
+// called with pathsLock held.
+func (c *splitConn) activePaths() []*path {
+	if active := c.active.Load(); active != nil {
+		return *active
+	}
+	return c.paths
+}
+
+// PathHealth returns the health state of each path, in the order the paths
+// were added.
+func (c *splitConn) PathHealth() []HealthState {
+	paths := c.pathList()
+	states := make([]HealthState, len(paths))
+	for i, p := range paths {
+		states[i] = p.health.get()
+	}
+	return states
+}
@@ -0,0 +1,61 @@
+package split
+
+import (
+	"net"
+	"sync/atomic"
+
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
+)
+
+// RedundantPacketConn implements the net.PacketConn interface by sending each
+// packet on k distinct connections, taking the connections in turn, and
+// keeping only the first copy of each packet received. The server does the
+// same in the other direction. A packet is then delayed only as much as the
+// fastest of its paths, at the cost of k times the bandwidth, which suits
+// paths that are intermittently throttled to almost nothing.
+type RedundantPacketConn struct {
+	*splitConn
+	state uint32
+	k     int
+}
+
+// NewRedundantPacketConn returns a RedundantPacketConn that sends k copies of
+// each packet. k is limited to the number of connections.
+func NewRedundantPacketConn(
+	sessionID tt.SessionID,
+	connList []net.Conn,
+	remote net.Addr,
+	k int,
+	opts ...Option,
+) *RedundantPacketConn {
+	if k > len(connList) {
+		k = len(connList)
+	}
+	if k < 1 {
+		k = 1
+	}
+	c := &RedundantPacketConn{k: k}
+	c.splitConn = newSplitConn(sessionID, connList, remote, c, opts)
+	c.redundancy = k
+	if k > 1 {
+		c.dedup = tt.NewDedupFilter(tt.DedupWindow)
+	}
+	c.start()
+	return c
+}
+
+// getConn returns the next connection to write a packet to
+func (c *RedundantPacketConn) getConn(p []byte) *path {
+	return c.getConns(p)[0]
+}
+
+// getConns returns the k connections to write a packet to
+func (c *RedundantPacketConn) getConns(p []byte) []*path {
+	active := c.activePaths()
+	start := int((atomic.AddUint32(&c.state, 1) - 1) % uint32(len(active)))
+	paths := make([]*path, min(c.k, len(active)))
+	for i := range paths {
+		paths[i] = active[(start+i)%len(active)]
+	}
+	return paths
+}
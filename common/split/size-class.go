@@ -0,0 +1,107 @@
+package split
+
+import (
+	"net"
+	"sync/atomic"
+
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
+)
+
+// DefaultSizeThreshold is the packet size, in bytes, below which a
+// SizeClassPacketConn treats packets as small if no threshold is configured.
+// It is above a KCP packet carrying one Tor cell and its smux header, and
+// below a full-sized KCP packet.
+const DefaultSizeThreshold = 600
+
+// PathClass says which packets a path should carry in a SizeClassPacketConn.
+type PathClass int
+
+const (
+	// ClassAny paths carry both small and bulk packets.
+	ClassAny PathClass = iota
+	// ClassLatency paths carry small packets, such as KCP ACKs.
+	ClassLatency
+	// ClassBulk paths carry large packets.
+	ClassBulk
+)
+
+// SizeClassPacketConn implements the net.PacketConn interface by sending
+// packets smaller than a threshold, such as ACKs and small cells, on the
+// low-latency connections and larger packets on the bulk connections, so that
+// ACKs do not queue behind bulk data. Each class of packet takes its
+// connections in turn. If no connection is suited to a class, its packets go
+// to every connection.
+type SizeClassPacketConn struct {
+	*splitConn
+	threshold int
+	// The paths suited to each class, rebuilt for each packet in case
+	// paths were added or removed. getConn is only called from the loop
+	// that dispatches packets to paths, so they need no lock.
+	small, bulk []*path
+	smallState  uint32
+	bulkState   uint32
+}
+
+// NewSizeClassPacketConn returns a SizeClassPacketConn in which classes[i] is
+// the class of connList[i]. If threshold is zero, DefaultSizeThreshold is
+// used.
+func NewSizeClassPacketConn(
+	sessionID tt.SessionID,
+	connList []net.Conn,
+	remote net.Addr,
+	threshold int,
+	classes []PathClass,
+	opts ...Option,
+) *SizeClassPacketConn {
+	if threshold == 0 {
+		threshold = DefaultSizeThreshold
+	}
+	c := &SizeClassPacketConn{threshold: threshold}
+	c.splitConn = newSplitConn(sessionID, connList, remote, c, opts)
+	for i, p := range c.paths {
+		if i < len(classes) {
+			p.class = classes[i]
+		}
+	}
+	c.start()
+	return c
+}
+
+// AddPathClass is AddPath for a path of the given class.
+func (c *SizeClassPacketConn) AddPathClass(index int, conn net.Conn, class PathClass) error {
+	return c.addPath(index, conn, class)
+}
+
+// getConn returns the next connection to write a packet to
+func (c *SizeClassPacketConn) getConn(p []byte) *path {
+	c.small, c.bulk = c.small[:0], c.bulk[:0]
+	for _, q := range c.paths {
+		if q.class != ClassBulk {
+			c.small = append(c.small, q)
+		}
+		if q.class != ClassLatency {
+			c.bulk = append(c.bulk, q)
+		}
+	}
+	if len(p) < c.threshold {
+		return next(c.small, c.paths, &c.smallState)
+	}
+	return next(c.bulk, c.paths, &c.bulkState)
+}
+
+// next returns the next path of paths in turn, skipping excluded paths unless
+// all of them are. If paths is empty, it chooses from all instead.
+func next(paths, all []*path, state *uint32) *path {
+	if len(paths) == 0 {
+		paths = all
+	}
+	var p *path
+	for range paths {
+		index := (atomic.AddUint32(state, 1) - 1) % uint32(len(paths))
+		p = paths[index]
+		if !p.excluded.Load() {
+			break
+		}
+	}
+	return p
+}
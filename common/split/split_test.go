@@ -0,0 +1,791 @@
+package split
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt/common/metrics"
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
+)
+
+// readPacket reads the next packet from a path, skipping control frames.
+func readPacket(r io.Reader) ([]byte, error) {
+	for {
+		f, err := tt.ReadFrame(r)
+		if err != nil || !f.IsControl() {
+			return f.Body, err
+		}
+	}
+}
+
+// acceptPath reads the session ID and the FrameAttach that begin a path, and
+// accepts the path as the server would.
+func acceptPath(conn net.Conn, br *bufio.Reader) (tt.SessionID, error) {
+	var id tt.SessionID
+	_, err := io.ReadFull(br, id[:])
+	if err != nil {
+		return id, err
+	}
+	f, err := tt.ReadFrame(br)
+	if err != nil {
+		return id, err
+	}
+	if f.Type != tt.FrameAttach {
+		return id, fmt.Errorf("path began with frame type %d", f.Type)
+	}
+	return id, tt.WriteControl(conn, tt.FrameAttachOK, nil)
+}
+
+// readPath reads the session ID and then n packets from a path.
+func readPath(conn net.Conn, n int) (tt.SessionID, [][]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	id, err := acceptPath(conn, br)
+	if err != nil {
+		return id, nil, err
+	}
+	var packets [][]byte
+	for i := 0; i < n; i++ {
+		p, err := readPacket(br)
+		if err != nil {
+			return id, packets, err
+		}
+		packets = append(packets, p)
+	}
+	return id, packets, nil
+}
+
+func TestRoundRobinPacketConn(t *testing.T) {
+	const paths, perPath = 3, 4
+	var clientEnds, serverEnds []net.Conn
+	for i := 0; i < paths; i++ {
+		c, s := net.Pipe()
+		clientEnds = append(clientEnds, c)
+		serverEnds = append(serverEnds, s)
+	}
+	sessionID := tt.NewSessionID()
+	pconn := NewRoundRobinPacketConn(sessionID, clientEnds, stringAddr{"test", "remote"})
+	defer pconn.Close()
+
+	results := make(chan [][]byte, paths)
+	for _, s := range serverEnds {
+		go func(s net.Conn) {
+			id, packets, err := readPath(s, perPath)
+			if err != nil {
+				t.Errorf("reading path: %v", err)
+			} else if id != sessionID {
+				t.Errorf("path sent session ID %v, want %v", id, sessionID)
+			}
+			results <- packets
+		}(s)
+	}
+	for i := 0; i < paths*perPath; i++ {
+		// WriteTo drops packets when the send queue is full, so pace them.
+		pconn.WriteTo([]byte{byte(i)}, pconn.RemoteAddr())
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < paths; i++ {
+		packets := <-results
+		if len(packets) != perPath {
+			t.Fatalf("path got %d packets, want %d", len(packets), perPath)
+		}
+		// Each path sees every paths'th packet.
+		for j := 1; j < len(packets); j++ {
+			if packets[j][0]-packets[j-1][0] != paths {
+				t.Fatalf("path got packets %v, not every %dth", packets, paths)
+			}
+		}
+	}
+
+	// Packets arriving on any path come out of ReadFrom.
+	go tt.WritePacket(serverEnds[1], []byte("downstream"))
+	buf := make([]byte, 100)
+	n, _, err := pconn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte("downstream")) {
+		t.Fatalf("ReadFrom returned %q", buf[:n])
+	}
+}
+
+func TestRandomPacketConnUsesAllPaths(t *testing.T) {
+	const paths = 2
+	var clientEnds []net.Conn
+	counts := make(chan int, paths)
+	for i := 0; i < paths; i++ {
+		c, s := net.Pipe()
+		clientEnds = append(clientEnds, c)
+		go func(s net.Conn) {
+			br := bufio.NewReader(s)
+			acceptPath(s, br)
+			n := 0
+			for {
+				s.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				if _, err := readPacket(br); err != nil {
+					break
+				}
+				n++
+			}
+			counts <- n
+		}(s)
+	}
+	pconn := NewRandomPacketConn(tt.NewSessionID(), clientEnds, stringAddr{"test", "remote"})
+	defer pconn.Close()
+	for i := 0; i < 100; i++ {
+		pconn.WriteTo([]byte{byte(i)}, pconn.RemoteAddr())
+		time.Sleep(time.Millisecond)
+	}
+	total := 0
+	for i := 0; i < paths; i++ {
+		n := <-counts
+		if n == 0 {
+			t.Fatal("a path received no packets")
+		}
+		total += n
+	}
+	if total != 100 {
+		t.Fatalf("paths received %d packets in total, want 100", total)
+	}
+}
+
+func TestPathStats(t *testing.T) {
+	var s pathStats
+	start := time.Now()
+	// Send 1000 bytes every 10ms; the path delivers them after 20ms.
+	for i := 0; i < 100; i++ {
+		now := start.Add(time.Duration(i) * 10 * time.Millisecond)
+		s.onSend(1000, now)
+		if i >= 2 {
+			s.onAck(uint64(1000*(i-1)), now.Sub(start), now)
+		}
+	}
+	if rate := s.capacity(); rate < 90e3 || rate > 110e3 {
+		t.Fatalf("capacity %.0f B/s, want about 100000", rate)
+	}
+	if s.minDelay != 20*time.Millisecond || s.delay != 20*time.Millisecond {
+		t.Fatalf("delay %v, min %v, want 20ms", s.delay, s.minDelay)
+	}
+
+	// The same rate with a growing queue discounts the capacity.
+	base := start.Add(time.Second)
+	for i := 0; i < 100; i++ {
+		now := base.Add(time.Duration(i) * 10 * time.Millisecond)
+		s.onSend(2000, now)
+		s.onAck(s.acked+1000, now.Sub(start), now)
+	}
+	if s.delay < 100*time.Millisecond {
+		t.Fatalf("delay %v did not grow with the queue", s.delay)
+	}
+	if rate := s.capacity(); rate > 50e3 {
+		t.Fatalf("capacity %.0f B/s of a bloated path, want under 50000", rate)
+	}
+}
+
+func TestAdaptiveBandwidthWeights(t *testing.T) {
+	c := &AdaptiveBandwidthPacketConn{
+		splitConn: &splitConn{paths: []*path{{index: 0}, {index: 1}, {index: 2}}},
+		current:   make([]float64, 3),
+		weights:   make([]float64, 3),
+	}
+	// Without estimates, paths are used equally.
+	counts := make([]int, 3)
+	for i := 0; i < 300; i++ {
+		counts[c.getConn(nil).index]++
+	}
+	for i, n := range counts {
+		if n != 100 {
+			t.Fatalf("path %d got %d of 300 packets without estimates", i, n)
+		}
+	}
+
+	c.paths[0].stats = pathStats{rate: 300, delay: time.Second, minDelay: time.Second}
+	c.paths[1].stats = pathStats{rate: 100, delay: time.Second, minDelay: time.Second}
+	c.paths[2].stats = pathStats{rate: 1, delay: time.Second, minDelay: time.Second}
+	counts = make([]int, 3)
+	for i := 0; i < 1000; i++ {
+		counts[c.getConn(nil).index]++
+	}
+	if counts[0] < 2*counts[1] {
+		t.Fatalf("faster path got %d packets, slower got %d", counts[0], counts[1])
+	}
+	if counts[2] == 0 {
+		t.Fatalf("slowest path got no packets")
+	}
+}
+
+func TestRedundantPacketConn(t *testing.T) {
+	const paths, k, count = 3, 2, 30
+	var clientEnds, serverEnds []net.Conn
+	for i := 0; i < paths; i++ {
+		c, s := net.Pipe()
+		clientEnds = append(clientEnds, c)
+		serverEnds = append(serverEnds, s)
+	}
+	pconn := NewRedundantPacketConn(tt.NewSessionID(), clientEnds, stringAddr{"test", "remote"}, k)
+	defer pconn.Close()
+
+	type result struct {
+		redundancy int
+		packets    [][]byte
+		err        error
+	}
+	results := make(chan result, paths)
+	for _, s := range serverEnds {
+		go func(s net.Conn) {
+			var r result
+			s.SetReadDeadline(time.Now().Add(5 * time.Second))
+			br := bufio.NewReader(s)
+			_, r.err = acceptPath(s, br)
+			for r.err == nil && len(r.packets) < count*k/paths {
+				var f tt.Frame
+				f, r.err = tt.ReadFrame(br)
+				if r.err != nil {
+					break
+				}
+				if f.Type == tt.FrameRedundancy {
+					r.redundancy, r.err = tt.ParseRedundancy(f.Body)
+				} else if !f.IsControl() {
+					r.packets = append(r.packets, f.Body)
+				}
+			}
+			results <- r
+		}(s)
+	}
+	for i := 0; i < count; i++ {
+		pconn.WriteTo([]byte{byte(i)}, pconn.RemoteAddr())
+		time.Sleep(time.Millisecond)
+	}
+	copies := make(map[byte]int)
+	for i := 0; i < paths; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("reading path: %v", r.err)
+		}
+		if r.redundancy != k {
+			t.Fatalf("path announced redundancy %d, want %d", r.redundancy, k)
+		}
+		for _, p := range r.packets {
+			copies[p[0]]++
+		}
+	}
+	for i := 0; i < count; i++ {
+		if copies[byte(i)] != k {
+			t.Fatalf("packet %d sent %d times, want %d", i, copies[byte(i)], k)
+		}
+	}
+
+	// Only the first copy of a packet comes out of ReadFrom.
+	go func() {
+		tt.WritePacket(serverEnds[0], []byte("once"))
+		tt.WritePacket(serverEnds[1], []byte("once"))
+		tt.WritePacket(serverEnds[2], []byte("twice"))
+	}()
+	buf := make([]byte, 100)
+	for _, want := range []string{"once", "twice"} {
+		n, _, err := pconn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatalf("ReadFrom returned %q, want %q", buf[:n], want)
+		}
+	}
+}
+
+func TestFlowletPacketConn(t *testing.T) {
+	m := metrics.New()
+	c := &FlowletPacketConn{
+		splitConn: &splitConn{paths: []*path{{index: 0}, {index: 1}, {index: 2}}, metrics: m},
+		gap:       20 * time.Millisecond,
+		weights:   make([]float64, 3),
+	}
+	first := c.getConn(nil)
+	for i := 0; i < 10; i++ {
+		if p := c.getConn(nil); p != first {
+			t.Fatalf("flowlet moved from path %d to %d without a gap", first.index, p.index)
+		}
+	}
+	time.Sleep(40 * time.Millisecond)
+	if p := c.getConn(nil); p == first {
+		t.Fatalf("flowlet stayed on path %d after a gap", p.index)
+	}
+	if n := m.Get("flowlet_switches"); n != 1 {
+		t.Fatalf("counted %d switches, want 1", n)
+	}
+}
+
+func TestSizeClassPacketConn(t *testing.T) {
+	var clientEnds []net.Conn
+	for i := 0; i < 3; i++ {
+		c, _ := net.Pipe()
+		clientEnds = append(clientEnds, c)
+	}
+	classes := []PathClass{ClassLatency, ClassBulk, ClassAny}
+	pconn := NewSizeClassPacketConn(tt.NewSessionID(), clientEnds, stringAddr{"test", "remote"}, 100, classes)
+	defer pconn.Close()
+
+	small := make(map[int]int)
+	bulk := make(map[int]int)
+	for i := 0; i < 10; i++ {
+		small[pconn.getConn(make([]byte, 99)).index]++
+		bulk[pconn.getConn(make([]byte, 100)).index]++
+	}
+	if small[0] != 5 || small[2] != 5 {
+		t.Fatalf("small packets went to paths %v, want latency and unclassed paths", small)
+	}
+	if bulk[1] != 5 || bulk[2] != 5 {
+		t.Fatalf("bulk packets went to paths %v, want bulk and unclassed paths", bulk)
+	}
+}
+
+// waitForHealth polls until path i of pconn is in state want.
+func waitForHealth(t *testing.T, pconn SplittingPacketConn, i int, want HealthState) {
+	deadline := time.Now().Add(5 * time.Second)
+	for pconn.PathHealth()[i] != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("path %d is %v, want %v", i, pconn.PathHealth()[i], want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	const paths = 2
+	var clientEnds []net.Conn
+	var answer [paths]atomic.Bool
+	var packets [paths]atomic.Int32
+	answer[0].Store(true)
+	for i := 0; i < paths; i++ {
+		c, s := net.Pipe()
+		clientEnds = append(clientEnds, c)
+		// Act as the server, answering probes only while answer[i] is
+		// set.
+		go func(i int, s net.Conn) {
+			br := bufio.NewReader(s)
+			acceptPath(s, br)
+			for {
+				f, err := tt.ReadFrame(br)
+				if err != nil {
+					return
+				}
+				switch {
+				case f.Type == tt.FrameProbe && answer[i].Load():
+					tt.WriteControl(s, tt.FrameProbeReply, f.Body)
+				case !f.IsControl():
+					packets[i].Add(1)
+				}
+			}
+		}(i, s)
+	}
+	pconn := NewRoundRobinPacketConn(tt.NewSessionID(), clientEnds, stringAddr{"test", "remote"},
+		WithHealthCheck(HealthConfig{
+			Interval:        10 * time.Millisecond,
+			Timeout:         30 * time.Millisecond,
+			QuarantineAfter: 2,
+			QuarantineFor:   100 * time.Millisecond,
+			ReinstateAfter:  2,
+		}))
+	defer pconn.Close()
+
+	waitForHealth(t, pconn, 1, Quarantined)
+	if s := pconn.PathHealth()[0]; s != Healthy {
+		t.Fatalf("answering path is %v", s)
+	}
+	before := packets[1].Load()
+	for i := 0; i < 10; i++ {
+		pconn.WriteTo([]byte{byte(i)}, pconn.RemoteAddr())
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := packets[1].Load() - before; n != 0 {
+		t.Fatalf("quarantined path got %d packets", n)
+	}
+
+	// Once it answers again, the path is reinstated after probing.
+	answer[1].Store(true)
+	waitForHealth(t, pconn, 1, Healthy)
+	before = packets[1].Load()
+	for i := 0; i < 10; i++ {
+		pconn.WriteTo([]byte{byte(i)}, pconn.RemoteAddr())
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if packets[1].Load() == before {
+		t.Fatal("reinstated path got no packets")
+	}
+}
+
+// TestHealthCheckReplace checks that a path that stays quarantined is
+// replaced with a new conn from the redial function.
+func TestHealthCheckReplace(t *testing.T) {
+	// serve acts as the server of a path, answering probes if answer is
+	// set.
+	serve := func(s net.Conn, answer bool) {
+		br := bufio.NewReader(s)
+		acceptPath(s, br)
+		for {
+			f, err := tt.ReadFrame(br)
+			if err != nil {
+				return
+			}
+			if f.Type == tt.FrameProbe && answer {
+				tt.WriteControl(s, tt.FrameProbeReply, f.Body)
+			}
+		}
+	}
+	var clientEnds []net.Conn
+	for i := 0; i < 2; i++ {
+		c, s := net.Pipe()
+		clientEnds = append(clientEnds, c)
+		go serve(s, i == 0)
+	}
+	m := metrics.New()
+	redialed := make(chan int, 1)
+	pconn := NewRoundRobinPacketConn(tt.NewSessionID(), clientEnds, stringAddr{"test", "remote"},
+		WithMetrics(m),
+		WithRedial(func(index int) (net.Conn, error) {
+			c, s := net.Pipe()
+			go serve(s, true)
+			select {
+			case redialed <- index:
+			default:
+			}
+			return c, nil
+		}),
+		WithHealthCheck(HealthConfig{
+			Interval:        10 * time.Millisecond,
+			Timeout:         30 * time.Millisecond,
+			QuarantineAfter: 2,
+			QuarantineFor:   50 * time.Millisecond,
+		}))
+	defer pconn.Close()
+
+	select {
+	case index := <-redialed:
+		if index != 1 {
+			t.Fatalf("redialed path %d, want 1", index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("quarantined path not replaced")
+	}
+	if n := m.Get("path_replacements"); n != 1 {
+		t.Fatalf("counted %d replacements, want 1", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		states := pconn.PathHealth()
+		if len(states) == 2 && states[0] == Healthy && states[1] == Healthy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("paths are %v after replacement", states)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestProbesAheadOfPackets checks that a probe is sent ahead of the packets
+// queued on a busy path.
+func TestProbesAheadOfPackets(t *testing.T) {
+	c, s := net.Pipe()
+	pconn := NewRoundRobinPacketConn(tt.NewSessionID(), []net.Conn{c}, stringAddr{"test", "remote"},
+		WithHealthCheck(HealthConfig{Interval: 50 * time.Millisecond, Timeout: time.Minute}))
+	defer pconn.Close()
+	br := bufio.NewReader(s)
+	if _, err := acceptPath(s, br); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is read from the path while its queue fills up and the
+	// first probe is queued behind the packets.
+	for i := 0; i < pathQueueLen; i++ {
+		pconn.WriteTo(make([]byte, 1000), pconn.RemoteAddr())
+	}
+	time.Sleep(100 * time.Millisecond)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packets := 0
+	for {
+		f, err := tt.ReadFrame(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Type == tt.FrameProbe {
+			break
+		}
+		if !f.IsControl() {
+			packets++
+		}
+	}
+	// Only the packets already buffered when the probe was queued may go
+	// ahead of it.
+	if packets > 8 {
+		t.Fatalf("probe sent after %d of %d queued packets", packets, pathQueueLen)
+	}
+}
+
+// TestHealthCheckPathChurn adds and removes paths while the health monitor
+// runs, for the race detector.
+func TestHealthCheckPathChurn(t *testing.T) {
+	c, s := net.Pipe()
+	go collectPath(s)
+	pconn := NewRoundRobinPacketConn(tt.NewSessionID(), []net.Conn{c}, stringAddr{"test", "remote"},
+		WithHealthCheck(HealthConfig{Interval: time.Millisecond}))
+	defer pconn.Close()
+	for i := 1; i <= 50; i++ {
+		c, s := net.Pipe()
+		go collectPath(s)
+		err := pconn.AddPath(i, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+		err = pconn.RemovePath(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(pconn.PathHealth()); n != 1 {
+		t.Fatalf("%d paths after adding and removing 50 of them", n)
+	}
+}
+
+// collectPath reads the session ID and then packets from a path until it
+// fails, and returns them on the channel.
+func collectPath(conn net.Conn) <-chan [][]byte {
+	ch := make(chan [][]byte, 1)
+	go func() {
+		br := bufio.NewReader(conn)
+		var packets [][]byte
+		if _, err := acceptPath(conn, br); err == nil {
+			for {
+				p, err := readPacket(br)
+				if err != nil {
+					break
+				}
+				packets = append(packets, p)
+			}
+		}
+		ch <- packets
+	}()
+	return ch
+}
+
+func TestAddRemovePath(t *testing.T) {
+	c0, s0 := net.Pipe()
+	c1, s1 := net.Pipe()
+	pconn := NewRoundRobinPacketConn(tt.NewSessionID(), []net.Conn{c0}, stringAddr{"test", "remote"})
+	defer pconn.Close()
+	got0, got1 := collectPath(s0), collectPath(s1)
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			pconn.WriteTo([]byte{byte(i)}, pconn.RemoteAddr())
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	err := pconn.AddPath(1, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := net.Pipe(); pconn.AddPath(1, c) == nil {
+		t.Fatal("added path 1 twice")
+	}
+	send(10)
+	err = pconn.RemovePath(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pconn.RemovePath(0); err == nil {
+		t.Fatal("removed path 0 twice")
+	}
+	if n := len(pconn.PathHealth()); n != 1 {
+		t.Fatalf("%d paths after removing one of 2", n)
+	}
+	// Every packet from now on takes path 1.
+	packets0 := <-got0
+	send(10)
+	s1.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	packets1 := <-got1
+	if len(packets0) != 5 || len(packets1) != 15 {
+		t.Fatalf("paths got %d and %d packets, want 5 and 15", len(packets0), len(packets1))
+	}
+
+	// Removing the last path closes the conn.
+	pconn.RemovePath(1)
+	_, _, err = pconn.ReadFrom(make([]byte, 100))
+	if err == nil {
+		t.Fatal("ReadFrom succeeded with no paths left")
+	}
+}
+
+func TestReplaceStalledPath(t *testing.T) {
+	c0, s0 := net.Pipe()
+	c1, s1 := net.Pipe()
+	defer s0.Close()
+	// Path 0 is accepted but then never read, so that its queue fills and
+	// the packets for it wait.
+	go acceptPath(s0, bufio.NewReader(s0))
+	got1 := collectPath(s1)
+	pconn := NewRoundRobinPacketConn(tt.NewSessionID(), []net.Conn{c0}, stringAddr{"test", "remote"})
+	defer pconn.Close()
+	for i := 0; i < 4*pathQueueLen; i++ {
+		pconn.WriteTo([]byte{byte(i)}, pconn.RemoteAddr())
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := pconn.AddPath(1, c1)
+		if err == nil {
+			err = pconn.RemovePath(0)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("replacing a stalled path blocked")
+	}
+	// The packets that were waiting go to the new path, and then so do
+	// new ones.
+	time.Sleep(50 * time.Millisecond)
+	pconn.WriteTo([]byte("after"), pconn.RemoteAddr())
+	time.Sleep(50 * time.Millisecond)
+	s1.SetReadDeadline(time.Now())
+	packets := <-got1
+	if len(packets) == 0 || string(packets[len(packets)-1]) != "after" {
+		t.Fatalf("replacement path got %d packets, not ending with the one sent after", len(packets))
+	}
+}
+
+func TestPriorStats(t *testing.T) {
+	c0, s0 := net.Pipe()
+	c1, s1 := net.Pipe()
+	defer s0.Close()
+	defer s1.Close()
+	prior := func(index int) (PathStats, bool) {
+		if index != 1 {
+			return PathStats{}, false
+		}
+		return PathStats{Rate: 5000, MinDelay: 30 * time.Millisecond}, true
+	}
+	pconn := NewAdaptiveBandwidthPacketConn(tt.NewSessionID(), []net.Conn{c0}, stringAddr{"test", "remote"}, WithPriorStats(prior))
+	defer pconn.Close()
+	err := pconn.AddPath(1, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := pconn.PathStats()
+	if len(stats) != 2 {
+		t.Fatalf("got stats of %d paths, want 2", len(stats))
+	}
+	if stats[0].Rate != 0 {
+		t.Fatalf("path 0 has rate %.0f without a prior", stats[0].Rate)
+	}
+	if stats[1].Index != 1 || stats[1].Rate != 5000 || stats[1].MinDelay != 30*time.Millisecond {
+		t.Fatalf("path 1 has %+v, want the prior", stats[1])
+	}
+}
+
+func TestAttachSecret(t *testing.T) {
+	c0, s0 := net.Pipe()
+	c1, s1 := net.Pipe()
+	defer s0.Close()
+	defer s1.Close()
+	pconn := NewRoundRobinPacketConn(tt.NewSessionID(), []net.Conn{c0, c1}, stringAddr{"test", "remote"})
+	defer pconn.Close()
+
+	servers := []net.Conn{s0, s1}
+	readers := []*bufio.Reader{bufio.NewReader(s0), bufio.NewReader(s1)}
+	// attachBody reads the session ID and the FrameAttach that begin path
+	// i, and returns the frame's body.
+	attachBody := func(i int) ([]byte, error) {
+		servers[i].SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := io.ReadFull(readers[i], make([]byte, 8))
+		if err != nil {
+			return nil, err
+		}
+		f, err := tt.ReadFrame(readers[i])
+		return f.Body, err
+	}
+	const plain, establishing = 1 + 16 + 32, 1 + 16 + 32 + 32
+
+	// Only one path carries the secret, and the other waits until the
+	// server has it.
+	first := 0
+	body, err := attachBody(first)
+	if err != nil {
+		first = 1
+		body, err = attachBody(first)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != establishing {
+		t.Fatalf("first path's attach frame has %d bytes, want %d", len(body), establishing)
+	}
+	if _, err := attachBody(1 - first); err == nil {
+		t.Fatal("second path began before the first was accepted")
+	}
+	go tt.WriteControl(servers[first], tt.FrameAttachOK, nil)
+	body, err = attachBody(1 - first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != plain {
+		t.Fatalf("second path's attach frame has %d bytes, want %d", len(body), plain)
+	}
+}
+
+func TestAttachWait(t *testing.T) {
+	c0, s0 := net.Pipe()
+	c1, s1 := net.Pipe()
+	defer s0.Close()
+	defer s1.Close()
+	pconn := NewRoundRobinPacketConn(tt.NewSessionID(), []net.Conn{c0, c1}, stringAddr{"test", "remote"}, WithAttachWait(300*time.Millisecond))
+	defer pconn.Close()
+
+	// The server never confirms the secret, so both paths carry it, the
+	// second only once the attach wait has passed.
+	start := time.Now()
+	bodies := make(chan int, 2)
+	for _, s := range []net.Conn{s0, s1} {
+		go func(s net.Conn) {
+			br := bufio.NewReader(s)
+			_, err := io.ReadFull(br, make([]byte, 8))
+			if err != nil {
+				bodies <- 0
+				return
+			}
+			f, err := tt.ReadFrame(br)
+			if err != nil {
+				bodies <- 0
+				return
+			}
+			bodies <- len(f.Body)
+		}(s)
+	}
+	const establishing = 1 + 16 + 32 + 32
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-bodies:
+			if n != establishing {
+				t.Fatalf("attach frame has %d bytes, want %d", n, establishing)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("second path did not attach after the attach wait")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("second path attached after %v, before the attach wait", elapsed)
+	}
+}
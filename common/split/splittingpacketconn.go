@@ -1,13 +1,23 @@
 package split
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"anticensorshiptrafficsplitting/splitpt/common/metrics"
+	"anticensorshiptrafficsplitting/splitpt/common/trace"
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
 )
 
 var errClosed = errors.New("operation on closed connection")
 var errNotImplemented = errors.New("not implemented")
+var errNoPaths = errors.New("no paths left")
 
 // stringAddr satisfies the net.Addr interface using fixed strings for the
 // Network and String methods.
@@ -27,7 +37,678 @@ type SplittingPacketConn interface {
 	SetDeadline(t time.Time) error
 	SetReadDeadline(t time.Time) error
 	SetWriteDeadline(t time.Time) error
-	getConn() net.Conn
+	PathHealth() []HealthState
+	PathStats() []PathStats
+	AddPath(index int, conn net.Conn) error
+	RemovePath(index int) error
+	getConn(p []byte) *path
 	loop() error
-	exchange() error
 }
+
+// Option configures optional behavior of a SplittingPacketConn.
+type Option func(*splitConn)
+
+// WithRecorder makes the SplittingPacketConn record every frame it sends or
+// receives to rec.
+func WithRecorder(rec *trace.Recorder) Option {
+	return func(c *splitConn) { c.recorder = rec }
+}
+
+// WithMetrics makes the SplittingPacketConn count events, such as path
+// switches, in m.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(c *splitConn) { c.metrics = m }
+}
+
+// WithRedial makes the SplittingPacketConn survive the failure of its paths.
+// When a path fails, it calls redial with the index of the path and carries on
+// over the conn it returns, under the same session ID, so that the server
+// attaches it to the same session.
+func WithRedial(redial func(index int) (net.Conn, error)) Option {
+	return func(c *splitConn) { c.redial = redial }
+}
+
+// path is one of the connections a splitConn splits packets across.
+type path struct {
+	index int
+	conn  net.Conn
+	bw    *bufio.Writer
+	stats pathStats
+	// queue holds the packets waiting to be written to conn.
+	queue  chan []byte
+	health pathHealth
+	// probes holds the sequence numbers of health probes to send.
+	probes chan uint64
+	// excluded is set when schedulers should not choose the path.
+	excluded atomic.Bool
+	// class is the path's class in a SizeClassPacketConn.
+	class PathClass
+	// begun is set once the beginning of the path has been sent.
+	begun atomic.Bool
+	// done is closed when the path is stopped, because its conn failed
+	// or it was removed, and removed is set in the latter case.
+	done     chan struct{}
+	stopOnce sync.Once
+	removed  atomic.Bool
+}
+
+func newPath(index int, conn net.Conn, class PathClass) *path {
+	return &path{
+		index:  index,
+		conn:   conn,
+		bw:     bufio.NewWriter(conn),
+		class:  class,
+		queue:  make(chan []byte, pathQueueLen),
+		probes: make(chan uint64, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// stop closes p's conn and signals its loops to finish.
+func (p *path) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+		p.conn.Close()
+	})
+}
+
+// pathQueueLen is how many packets may wait to be written to each path.
+const pathQueueLen = 32
+
+// scheduler chooses the path for each outgoing packet. Each splitting
+// algorithm is a scheduler.
+type scheduler interface {
+	getConn(p []byte) *path
+}
+
+// multiScheduler is a scheduler that sends some packets on more than one
+// path.
+type multiScheduler interface {
+	scheduler
+	getConns(p []byte) []*path
+}
+
+// splitConn holds the parts common to every SplittingPacketConn: the send and
+// receive queues and the loop that exchanges packets over every path. The
+// embedding type decides which path each outgoing packet takes.
+//
+// Every Turbo Tunnel design will need some sort of PacketConn adapter that
+// adapts the session layer's sequence of packets to the obfuscation layer. But
+// not every such adapter will look like splitConn. It depends on what
+// the obfuscation layer looks like. Some obfuscation layers will not need a
+// persistent connection. One could, for example, handle every ReadFrom or
+// WriteTo as an independent network operation.
+type splitConn struct {
+	sessionID  tt.SessionID
+	remoteAddr net.Addr
+	recvQueue  chan []byte
+	sendQueue  chan []byte
+	closeOnce  sync.Once
+	closed     chan struct{}
+	sched      scheduler
+	// pathsLock guards paths, which change as paths are added, removed
+	// or fail.
+	pathsLock sync.RWMutex
+	paths     []*path
+	recorder  *trace.Recorder
+	metrics   *metrics.Metrics
+	redial    func(index int) (net.Conn, error)
+	prior     func(index int) (PathStats, bool)
+	// redundancy is how many copies of each packet the embedding type
+	// sends. If it is more than 1, the server is told so, and dedup
+	// removes the copies the server sends back.
+	redundancy int
+	dedup      *tt.DedupFilter
+	// health configures health checking, if it is enabled. active holds
+	// the paths that are not excluded.
+	health       *HealthConfig
+	excludedLock sync.Mutex
+	active       atomic.Pointer[[]*path]
+	auth         sessionAuth
+	// What error to return when the splitConn is closed.
+	err atomic.Value
+}
+
+func newSplitConn(
+	sessionID tt.SessionID,
+	connList []net.Conn,
+	remote net.Addr,
+	sched scheduler,
+	opts []Option,
+) *splitConn {
+	c := &splitConn{
+		sessionID:  sessionID,
+		remoteAddr: remote,
+		recvQueue:  make(chan []byte, 32),
+		sendQueue:  make(chan []byte, 32),
+		closed:     make(chan struct{}),
+		sched:      sched,
+		auth: sessionAuth{
+			secret:  tt.NewSessionSecret(),
+			changed: make(chan struct{}),
+		},
+	}
+	for i, conn := range connList {
+		c.paths = append(c.paths, newPath(i, conn, ClassAny))
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// start begins exchanging packets. It is called by the constructor of the
+// embedding type once the splitConn is fully set up.
+func (c *splitConn) start() {
+	if c.health != nil {
+		go c.monitor()
+	}
+	for _, p := range c.paths {
+		c.seedPath(p)
+		go c.runPath(p)
+	}
+	go func() {
+		c.closeWithError(c.loop())
+	}()
+}
+
+// loop reads packets from c.sendQueue and queues them on the paths chosen by
+// the scheduler until the splitConn is closed, then stops every path.
+func (c *splitConn) loop() error {
+	defer func() {
+		for _, p := range c.pathList() {
+			p.stop()
+		}
+	}()
+	for {
+		select {
+		case <-c.closed:
+			return nil
+		case packet := <-c.sendQueue:
+			if !c.dispatch(packet) {
+				return nil
+			}
+		}
+	}
+}
+
+// runPath exchanges packets on p until it fails or is removed, then forgets
+// the path. A failed path is replaced with a new conn from c.redial, if it is
+// set, and so is a removed path that was the last one. Without a replacement,
+// the splitConn closes once it has no paths left.
+func (c *splitConn) runPath(p *path) {
+	// The path is read from at once, so that the server's answer to the
+	// beginning of the path never waits for the rest of it to be written.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer p.stop()
+		c.readPath(p)
+	}()
+	go func() {
+		defer wg.Done()
+		defer p.stop()
+		err := c.beginPath(p)
+		if err != nil {
+			log.Printf("[Split Packet Conn] path %d: error writing to conn %s", p.index, err.Error())
+			return
+		}
+		c.writePath(p)
+	}()
+	wg.Wait()
+	c.auth.release(p)
+	left := c.forgetPath(p)
+
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	if c.redial != nil && (!p.removed.Load() || left == 0) {
+		log.Printf("[Split Packet Conn] session %v: redialing path %d", c.sessionID, p.index)
+		conn, err := c.redial(p.index)
+		if err == nil {
+			err = c.addPath(p.index, conn, p.class)
+		}
+		if err == nil {
+			return
+		}
+		log.Printf("[Split Packet Conn] path %d: error redialing: %s", p.index, err.Error())
+		if left == 0 {
+			c.closeWithError(err)
+		}
+		return
+	}
+	if left == 0 {
+		c.closeWithError(errNoPaths)
+	}
+}
+
+// beginPath sends the session identifier and the proof that p belongs to the
+// session, once p may attach; everything after that is encapsulated packets.
+// It returns nil without writing anything if p is stopped first.
+func (c *splitConn) beginPath(p *path) error {
+	establish, ok := c.auth.claim(p)
+	if !ok {
+		return nil
+	}
+	_, err := p.bw.Write(c.sessionID[:])
+	if err == nil {
+		err = tt.WriteAttach(p.bw, c.sessionID, c.auth.secret, establish)
+	}
+	if err == nil && c.redundancy > 1 {
+		err = tt.WriteRedundancy(p.bw, c.redundancy)
+	}
+	if err == nil {
+		err = p.bw.Flush()
+	}
+	p.begun.Store(err == nil)
+	return err
+}
+
+// sessionAuth tracks the establishment of the session secret, which only one
+// path at a time carries to the server, so that as few paths as possible
+// expose it. The other paths wait to attach until the server has confirmed the
+// secret, so that the session ID is not seen before then, or until the attach
+// wait passes without it, when they carry the secret too.
+type sessionAuth struct {
+	secret []byte
+	// wait, if not zero, is the attach wait set by WithAttachWait.
+	wait time.Duration
+
+	lock         sync.Mutex
+	established  bool
+	establishing *path
+	// changed is closed, and replaced, when established or establishing
+	// changes.
+	changed chan struct{}
+}
+
+const (
+	// DefaultAttachWait is how long a path waits for another to establish
+	// the session secret before carrying it itself, when the delay of the
+	// other is unknown. It is shorter than the server's own wait for the
+	// secret, so that a path still attaches if the first is black-holed.
+	DefaultAttachWait = 5 * time.Second
+	// minAttachWait is the shortest attach wait derived from a measured
+	// delay.
+	minAttachWait = 1 * time.Second
+	// attachWaitDelays is how many of its minimum delays a path that
+	// establishes the secret is given to have it confirmed.
+	attachWaitDelays = 8
+)
+
+// WithAttachWait sets how long the other paths of a new session wait for the
+// server to confirm the session secret, carried by the first path, before
+// they carry it too. A longer wait keeps the secret from more bridges when
+// the first path is slow; a shorter one starts the session sooner when the
+// first path is black-holed. By default, the wait is a multiple of the first
+// path's measured delay, if it has one from WithPriorStats, between one second
+// and DefaultAttachWait, and otherwise DefaultAttachWait.
+func WithAttachWait(wait time.Duration) Option {
+	return func(c *splitConn) { c.auth.wait = wait }
+}
+
+// waitFor returns how long to wait for establishing to have the session
+// secret confirmed.
+func (a *sessionAuth) waitFor(establishing *path) time.Duration {
+	if a.wait != 0 {
+		return a.wait
+	}
+	_, minDelay := establishing.stats.estimate()
+	if minDelay == 0 {
+		return DefaultAttachWait
+	}
+	wait := attachWaitDelays * minDelay
+	if wait < minAttachWait {
+		wait = minAttachWait
+	}
+	if wait > DefaultAttachWait {
+		wait = DefaultAttachWait
+	}
+	return wait
+}
+
+// claim waits until p may attach, and returns whether it must carry the
+// session secret. It returns ok false if p is stopped first. The wait starts
+// over whenever another path takes over establishing the secret.
+func (a *sessionAuth) claim(p *path) (establish, ok bool) {
+	for {
+		a.lock.Lock()
+		if a.established {
+			a.lock.Unlock()
+			return false, true
+		}
+		if a.establishing == nil {
+			a.establishing = p
+			a.lock.Unlock()
+			return true, true
+		}
+		establishing := a.establishing
+		changed := a.changed
+		a.lock.Unlock()
+		timer := time.NewTimer(a.waitFor(establishing))
+		select {
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+			return true, true
+		case <-p.done:
+			timer.Stop()
+			return false, false
+		}
+	}
+}
+
+// confirm records that the server has accepted a path, and so knows the
+// session secret.
+func (a *sessionAuth) confirm() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.established {
+		a.established = true
+		a.establishing = nil
+		close(a.changed)
+		a.changed = make(chan struct{})
+	}
+}
+
+// release lets another path establish the session secret if p was doing so
+// and has closed.
+func (a *sessionAuth) release(p *path) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.establishing == p {
+		a.establishing = nil
+		close(a.changed)
+		a.changed = make(chan struct{})
+	}
+}
+
+// readPath reads encapsulated packets from p and writes them to c.recvQueue
+// until p's conn fails.
+func (c *splitConn) readPath(p *path) {
+	br := bufio.NewReader(p.conn)
+	for {
+		f, err := tt.ReadFrame(br)
+		if err != nil {
+			return
+		}
+		if f.Type == tt.FrameFeedback {
+			acked, serverTime, err := tt.ParseFeedback(f.Body)
+			if err != nil {
+				log.Printf("[Split Packet Conn] path %d: %v", p.index, err)
+				return
+			}
+			p.stats.onAck(acked, serverTime, time.Now())
+			continue
+		}
+		if f.Type == tt.FrameProbeReply {
+			seq, err := tt.ParseProbe(f.Body)
+			if err != nil {
+				log.Printf("[Split Packet Conn] path %d: %v", p.index, err)
+				return
+			}
+			c.onProbeReply(p, seq)
+			continue
+		}
+		if f.Type == tt.FrameAttachOK {
+			c.auth.confirm()
+			continue
+		}
+		if f.IsControl() {
+			continue
+		}
+		c.recorder.Received(trace.SessionID(c.sessionID), p.index, 2+len(f.Body))
+		if c.dedup != nil && c.dedup.Seen(f.Body) {
+			continue
+		}
+		select {
+		case <-c.closed:
+			return
+		case c.recvQueue <- f.Body:
+		}
+	}
+}
+
+// writePath encapsulates the packets queued for p into its conn until the
+// conn fails or the path is stopped.
+func (c *splitConn) writePath(p *path) {
+	for {
+		// Probes go ahead of queued packets, so that a path busy with
+		// bulk data does not miss them.
+		select {
+		case seq := <-p.probes:
+			if c.writeProbe(p, seq) != nil {
+				return
+			}
+			continue
+		default:
+		}
+		select {
+		case <-c.closed:
+			return
+		case <-p.done:
+			return
+		case seq := <-p.probes:
+			if c.writeProbe(p, seq) != nil {
+				return
+			}
+		case packet := <-p.queue:
+			err := tt.WritePacket(p.bw, packet)
+			// Flush once the queue is empty, so that a burst of
+			// packets shares writes.
+			if err == nil && len(p.queue) == 0 {
+				err = p.bw.Flush()
+			}
+			if err != nil {
+				return
+			}
+			p.stats.onSend(2+len(packet), time.Now())
+			c.recorder.Sent(trace.SessionID(c.sessionID), p.index, 2+len(packet))
+		}
+	}
+}
+
+// writeProbe writes probe seq to p and flushes it at once, together with any
+// packets buffered before it. The probe's timeout runs from now.
+func (c *splitConn) writeProbe(p *path, seq uint64) error {
+	p.health.sent(seq, time.Now())
+	err := tt.WriteProbe(p.bw, seq)
+	if err == nil {
+		err = p.bw.Flush()
+	}
+	return err
+}
+
+// AddPath starts carrying the session on conn too, as a new path with the
+// given index, which must not be in use. The server attaches conn to the
+// session when it reads the session ID, which is the first thing sent on it.
+// If AddPath fails, conn is closed. In a SizeClassPacketConn the new path
+// carries packets of any size.
+func (c *splitConn) AddPath(index int, conn net.Conn) error {
+	return c.addPath(index, conn, ClassAny)
+}
+
+// addPath adds a path with the given index carried on conn and starts
+// exchanging packets on it.
+func (c *splitConn) addPath(index int, conn net.Conn, class PathClass) error {
+	p := newPath(index, conn, class)
+	c.seedPath(p)
+	c.pathsLock.Lock()
+	select {
+	case <-c.closed:
+		c.pathsLock.Unlock()
+		conn.Close()
+		return errClosed
+	default:
+	}
+	for _, q := range c.paths {
+		if q.index == index {
+			c.pathsLock.Unlock()
+			conn.Close()
+			return fmt.Errorf("path %d already exists", index)
+		}
+	}
+	c.paths = append(c.paths, p)
+	c.updateExcludedLocked()
+	c.pathsLock.Unlock()
+	go c.runPath(p)
+	return nil
+}
+
+// RemovePath stops carrying the session on the path with the given index and
+// closes its conn. Packets queued on the path are lost, for the session layer
+// to retransmit. Removing the last path closes the splitConn, unless it
+// redials.
+func (c *splitConn) RemovePath(index int) error {
+	var p *path
+	for _, q := range c.pathList() {
+		if q.index == index {
+			p = q
+		}
+	}
+	if p == nil {
+		return fmt.Errorf("no path %d", index)
+	}
+	p.removed.Store(true)
+	p.stop()
+	c.forgetPath(p)
+	return nil
+}
+
+// forgetPath removes p from c.paths, if it is still there, and returns the
+// number of paths left.
+func (c *splitConn) forgetPath(p *path) int {
+	c.pathsLock.Lock()
+	defer c.pathsLock.Unlock()
+	// Build a new slice, as schedulers may hold on to the old one.
+	paths := make([]*path, 0, len(c.paths))
+	for _, q := range c.paths {
+		if q != p {
+			paths = append(paths, q)
+		}
+	}
+	c.paths = paths
+	p.excluded.Store(true)
+	c.updateExcludedLocked()
+	return len(paths)
+}
+
+// pathList returns the current paths. The returned slice must not be
+// modified.
+func (c *splitConn) pathList() []*path {
+	c.pathsLock.RLock()
+	defer c.pathsLock.RUnlock()
+	return c.paths
+}
+
+// dispatch queues packet on the path chosen by the scheduler, waiting if that
+// path is backed up. A multiScheduler's packet is queued on every chosen path
+// that has room, and only waits if none has. The packet is dropped if there
+// are no paths, or the path is stopped while dispatch waits. dispatch returns
+// false if the splitConn was closed while it was waiting.
+func (c *splitConn) dispatch(packet []byte) bool {
+	// Waiting on a backed-up path is done without pathsLock, so that the
+	// path can be removed or replaced meanwhile.
+	paths := c.choose(packet)
+	if len(paths) == 0 {
+		return true
+	}
+	if len(paths) > 1 {
+		queued := false
+		for _, p := range paths {
+			select {
+			case p.queue <- packet:
+				queued = true
+			default:
+			}
+		}
+		if queued {
+			return true
+		}
+	}
+	p := paths[0]
+	select {
+	case p.queue <- packet:
+		return true
+	case <-p.done:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// choose returns the paths the scheduler chooses for packet, or none if there
+// are no paths. Schedulers are only called from here, with pathsLock held, so
+// that the paths do not change under them.
+func (c *splitConn) choose(packet []byte) []*path {
+	c.pathsLock.RLock()
+	defer c.pathsLock.RUnlock()
+	if len(c.paths) == 0 {
+		return nil
+	}
+	if ms, ok := c.sched.(multiScheduler); ok {
+		return ms.getConns(packet)
+	}
+	return []*path{c.sched.getConn(packet)}
+}
+
+func (c *splitConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, &net.OpError{Op: "read", Net: c.remoteAddr.Network(), Source: c.sessionID, Addr: c.remoteAddr, Err: c.err.Load().(error)}
+	default:
+	}
+	select {
+	case <-c.closed:
+		return 0, nil, &net.OpError{Op: "read", Net: c.remoteAddr.Network(), Source: c.sessionID, Addr: c.remoteAddr, Err: c.err.Load().(error)}
+	case buf := <-c.recvQueue:
+		return copy(p, buf), c.remoteAddr, nil
+	}
+}
+
+func (c *splitConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, &net.OpError{Op: "write", Net: c.remoteAddr.Network(), Source: c.sessionID, Addr: c.remoteAddr, Err: c.err.Load().(error)}
+	default:
+	}
+	// Copy the slice so that the caller may reuse p.
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	select {
+	case c.sendQueue <- buf:
+	default: // Silently drop outgoing packets if the send queue is full.
+	}
+	return len(buf), nil
+}
+
+// closeWithError unblocks pending operations and makes future operations fail
+// with the given error. If err is nil, it becomes errClosed.
+func (c *splitConn) closeWithError(err error) error {
+	firstClose := false
+	c.closeOnce.Do(func() {
+		firstClose = true
+		// Store the error that will be returned for future operations.
+		if err == nil {
+			err = errClosed
+		}
+		c.err.Store(err)
+		close(c.closed)
+	})
+	if !firstClose {
+		return &net.OpError{Op: "close", Net: c.remoteAddr.Network(), Source: c.sessionID, Addr: c.remoteAddr, Err: c.err.Load().(error)}
+	}
+	return nil
+}
+
+func (c *splitConn) Close() error { return c.closeWithError(nil) }
+
+func (c *splitConn) LocalAddr() net.Addr  { return c.sessionID }
+func (c *splitConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *splitConn) SetDeadline(t time.Time) error      { return errNotImplemented }
+func (c *splitConn) SetReadDeadline(t time.Time) error  { return errNotImplemented }
+func (c *splitConn) SetWriteDeadline(t time.Time) error { return errNotImplemented }
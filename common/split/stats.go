@@ -0,0 +1,192 @@
+package split
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxSendMarks bounds the send history kept for each path. When it is
+	// full, new sends are merged into the most recent mark, which makes
+	// delay samples slightly too small.
+	maxSendMarks = 1024
+	// rateGain is the weight of each new sample in the smoothed delivery
+	// rate.
+	rateGain = 0.25
+	// delayGain is the weight of each new sample in the smoothed delay.
+	delayGain = 0.125
+	// idleGap is the longest interval over which newly acknowledged bytes
+	// yield a rate sample. Longer gaps mean the path was idle, not slow.
+	idleGap = 250 * time.Millisecond
+	// minDelayWindow is how long a minimum delay sample is trusted. Paths
+	// get rerouted, so the base delay is re-measured periodically.
+	minDelayWindow = 10 * time.Second
+)
+
+// sendMark records when the byte at offset was written to a path.
+type sendMark struct {
+	offset uint64
+	at     time.Time
+}
+
+// pathStats estimates a path's delivery rate and queueing delay from the
+// feedback frames the server sends on it. Each feedback frame acknowledges
+// every byte the server has received on the path so far and when, by the
+// server's clock, the last of them arrived. As in BBR, a delivery rate sample
+// divides the newly acknowledged bytes by the longer of the interval between
+// their arrivals and the interval between their sends, so that neither
+// feedback frames delayed behind downstream data nor a burst of sends can
+// suggest a rate faster than the path delivered. The delay is the time from writing a byte to
+// seeing it acknowledged, whose growth over its minimum measures how much data
+// is sitting in buffers along the path.
+type pathStats struct {
+	lock  sync.Mutex
+	sent  uint64
+	marks []sendMark
+	acked uint64
+	// ackedAt is when, by the server's clock, the acknowledged bytes
+	// arrived, and ackedSentAt is when the last acknowledged mark was
+	// sent.
+	ackedAt     time.Duration
+	ackedSentAt time.Time
+	rate        float64 // bytes per second
+	delay       time.Duration
+	minDelay    time.Duration
+	minAt       time.Time
+}
+
+// onSend records that n bytes were written to the path at now.
+func (s *pathStats) onSend(n int, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sent += uint64(n)
+	if len(s.marks) == maxSendMarks {
+		s.marks[len(s.marks)-1].offset = s.sent
+		return
+	}
+	s.marks = append(s.marks, sendMark{offset: s.sent, at: now})
+}
+
+// onAck records that the server reported receiving acked bytes in total, the
+// last of them at serverTime, in a feedback frame that arrived at now.
+func (s *pathStats) onAck(acked uint64, serverTime time.Duration, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if acked <= s.acked {
+		return
+	}
+
+	// The newest mark at or before acked was sent no later than the
+	// acknowledged byte.
+	var sentAt time.Time
+	i := 0
+	for ; i < len(s.marks) && s.marks[i].offset <= acked; i++ {
+		sentAt = s.marks[i].at
+	}
+	s.marks = s.marks[:copy(s.marks, s.marks[i:])]
+	if !sentAt.IsZero() {
+		sample := now.Sub(sentAt)
+		if s.delay == 0 {
+			s.delay = sample
+		} else {
+			s.delay += time.Duration(delayGain * float64(sample-s.delay))
+		}
+		if s.minDelay == 0 || sample <= s.minDelay || now.Sub(s.minAt) > minDelayWindow {
+			s.minDelay = sample
+			s.minAt = now
+		}
+	}
+
+	if !s.ackedSentAt.IsZero() && !sentAt.IsZero() {
+		interval := serverTime - s.ackedAt
+		if sendInterval := sentAt.Sub(s.ackedSentAt); sendInterval > interval {
+			interval = sendInterval
+		}
+		if interval > 0 && interval <= idleGap {
+			sample := float64(acked-s.acked) / interval.Seconds()
+			if s.rate == 0 {
+				s.rate = sample
+			} else {
+				s.rate += rateGain * (sample - s.rate)
+			}
+		}
+	}
+	s.acked = acked
+	s.ackedAt = serverTime
+	if !sentAt.IsZero() {
+		s.ackedSentAt = sentAt
+	}
+}
+
+// capacity returns the path's smoothed delivery rate in bytes per second,
+// discounted by the ratio of its minimum delay to its current delay, so that
+// a path's capacity shrinks as its buffers fill. It returns 0 if there is no
+// estimate yet.
+func (s *pathStats) capacity() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.rate == 0 || s.delay == 0 {
+		return 0
+	}
+	return s.rate * float64(s.minDelay) / float64(s.delay)
+}
+
+// estimate returns the path's smoothed delivery rate and minimum delay, or
+// zeros if there is no estimate yet.
+func (s *pathStats) estimate() (float64, time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rate, s.minDelay
+}
+
+// seed starts the estimates from rate and minDelay, learned earlier, if
+// there are none yet. The path is assumed to have empty buffers.
+func (s *pathStats) seed(rate float64, minDelay time.Duration, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.rate != 0 || rate <= 0 || minDelay <= 0 {
+		return
+	}
+	s.rate = rate
+	s.delay = minDelay
+	s.minDelay = minDelay
+	s.minAt = now
+}
+
+// PathStats is what a SplittingPacketConn has measured of one of its paths.
+type PathStats struct {
+	Index int
+	// Rate is the smoothed delivery rate in bytes per second, or 0 if it
+	// has not been measured yet.
+	Rate     float64
+	MinDelay time.Duration
+}
+
+// WithPriorStats makes the SplittingPacketConn start the estimates of each
+// new path from what prior returns for its index, such as the rate measured
+// on the same bridge in an earlier session, instead of from nothing.
+func WithPriorStats(prior func(index int) (PathStats, bool)) Option {
+	return func(c *splitConn) { c.prior = prior }
+}
+
+// seedPath starts p's estimates from c.prior, if it is set.
+func (c *splitConn) seedPath(p *path) {
+	if c.prior == nil {
+		return
+	}
+	if s, ok := c.prior(p.index); ok {
+		p.stats.seed(s.Rate, s.MinDelay, time.Now())
+	}
+}
+
+// PathStats returns the measurements of each path, in the order the paths
+// were added.
+func (c *splitConn) PathStats() []PathStats {
+	paths := c.pathList()
+	stats := make([]PathStats, len(paths))
+	for i, p := range paths {
+		rate, minDelay := p.stats.estimate()
+		stats[i] = PathStats{Index: p.index, Rate: rate, MinDelay: minDelay}
+	}
+	return stats
+}
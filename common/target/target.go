@@ -0,0 +1,223 @@
+/*
+Package target implements the small header exchanged at the start of each smux
+stream when splitpt runs as a standalone proxy rather than as a Tor pluggable
+transport.
+
+The client begins every stream with a request naming the "host:port" it wants
+to reach. The server dials that address and answers with a one-byte reply code
+before any application data flows. The reply codes are the SOCKS5 reply codes,
+so a client fronting a SOCKS listener can pass them straight through.
+
+A server dials targets with a Dialer, which refuses the addresses of the
+server's own host and network unless they are explicitly allowed.
+*/
+package target
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
+)
+
+// Reply codes sent by the server after it attempts to dial the target.
+const (
+	ReplySucceeded          = 0x00
+	ReplyGeneralFailure     = 0x01
+	ReplyNotAllowed         = 0x02
+	ReplyNetworkUnreachable = 0x03
+	ReplyHostUnreachable    = 0x04
+	ReplyConnectionRefused  = 0x05
+	ReplyTTLExpired         = 0x06
+)
+
+var errEmptyTarget = errors.New("empty target address")
+
+// ErrNotAllowed is returned by a Dialer for a target whose address it refuses.
+var ErrNotAllowed = errors.New("target address not allowed")
+
+// WriteRequest writes a request for addr to w. The address is encapsulated the
+// same way turbotunnel packets are, with a big-endian uint16 length prefix.
+func WriteRequest(w io.Writer, addr string) error {
+	if addr == "" {
+		return errEmptyTarget
+	}
+	return tt.WritePacket(w, []byte(addr))
+}
+
+// ReadRequest reads a request from r and returns the requested address.
+func ReadRequest(r io.Reader) (string, error) {
+	p, err := tt.ReadPacket(r)
+	if err != nil {
+		return "", err
+	}
+	if len(p) == 0 {
+		return "", errEmptyTarget
+	}
+	return string(p), nil
+}
+
+// WriteReply writes a single reply code to w.
+func WriteReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{code})
+	return err
+}
+
+// ReadReply reads a reply code from r. It returns a *ReplyError if the code
+// is anything other than ReplySucceeded.
+func ReadReply(r io.Reader) error {
+	var code [1]byte
+	_, err := io.ReadFull(r, code[:])
+	if err != nil {
+		return err
+	}
+	if code[0] != ReplySucceeded {
+		return &ReplyError{Code: code[0]}
+	}
+	return nil
+}
+
+// ReplyCode maps an error from dialing a target to the reply code that best
+// describes it.
+func ReplyCode(err error) byte {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ReplySucceeded
+	case errors.Is(err, ErrNotAllowed):
+		return ReplyNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ReplyHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReplyTTLExpired
+	default:
+		return ReplyGeneralFailure
+	}
+}
+
+// Dialer dials the targets that clients request. It refuses targets whose
+// address is loopback, private, link-local, unspecified or in Denied, which
+// would let clients reach services of the server's own host and network, such
+// as cloud metadata at 169.254.169.254, unless Allow holds the address. The address is
+// checked after the target's name is resolved, on every address dialed.
+type Dialer struct {
+	// Timeout bounds each dial, as in net.Dialer.
+	Timeout time.Duration
+	// Allow holds the otherwise refused addresses that may be dialed.
+	Allow []netip.Prefix
+}
+
+// Denied holds the prefixes that Dialer refuses beyond those that netip.Addr
+// classifies as loopback, private, link-local or unspecified.
+var Denied = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("224.0.0.0/4"),    // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and broadcast 255.255.255.255
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("100::/64"),       // discard-only
+	netip.MustParsePrefix("ff00::/8"),       // multicast
+}
+
+// Dial connects to addr, a "host:port", over TCP.
+func (d *Dialer) Dial(addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.Timeout, Control: d.control}
+	return dialer.Dial("tcp", addr)
+}
+
+func (d *Dialer) control(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !d.Allowed(addrPort.Addr()) {
+		return fmt.Errorf("%w: %v", ErrNotAllowed, addrPort.Addr())
+	}
+	return nil
+}
+
+// Allowed reports whether d may dial ip.
+func (d *Dialer) Allowed(ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	if !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsUnspecified() && !denied(ip) {
+		return true
+	}
+	for _, prefix := range d.Allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func denied(ip netip.Addr) bool {
+	for _, prefix := range Denied {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefixes parses a comma-separated list of CIDR prefixes, such as
+// "10.0.0.0/8,fd00::/8", for Dialer.Allow. A bare address stands for itself
+// alone.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ReplyError is returned by ReadReply when the server could not reach the
+// requested target.
+type ReplyError struct {
+	Code byte
+}
+
+func (e *ReplyError) Error() string {
+	switch e.Code {
+	case ReplyNotAllowed:
+		return "target not allowed by server"
+	case ReplyNetworkUnreachable:
+		return "network unreachable"
+	case ReplyHostUnreachable:
+		return "host unreachable"
+	case ReplyConnectionRefused:
+		return "connection refused"
+	case ReplyTTLExpired:
+		return "TTL expired"
+	default:
+		return "general failure"
+	}
+}
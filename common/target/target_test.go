@@ -0,0 +1,107 @@
+package target
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteRequest(&buf, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := ReadRequest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "example.com:443" {
+		t.Fatalf("got %q", addr)
+	}
+	if WriteRequest(&buf, "") == nil {
+		t.Fatal("WriteRequest accepted an empty address")
+	}
+}
+
+func TestReply(t *testing.T) {
+	var buf bytes.Buffer
+	WriteReply(&buf, ReplySucceeded)
+	WriteReply(&buf, ReplyConnectionRefused)
+	if err := ReadReply(&buf); err != nil {
+		t.Fatalf("success reply returned %v", err)
+	}
+	err := ReadReply(&buf)
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != ReplyConnectionRefused {
+		t.Fatalf("got %v, want connection refused", err)
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code byte
+	}{
+		{nil, ReplySucceeded},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, ReplyConnectionRefused},
+		{&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, ReplyHostUnreachable},
+		{errors.New("other"), ReplyGeneralFailure},
+	} {
+		if code := ReplyCode(test.err); code != test.code {
+			t.Errorf("ReplyCode(%v) = %d, want %d", test.err, code, test.code)
+		}
+	}
+}
+
+func TestDialerRefusesLocalTargets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	d := &Dialer{Timeout: time.Second}
+	for _, addr := range []string{ln.Addr().String(), "localhost:1", "[::1]:1", "0.0.0.0:1",
+		"10.1.2.3:80", "192.168.0.1:80", "169.254.169.254:80", "[fe80::1]:80", "[::ffff:127.0.0.1]:1",
+		"0.1.2.3:80", "100.64.0.1:80", "100.127.255.254:80", "224.0.0.1:80", "239.255.255.250:80",
+		"255.255.255.255:80", "[ff02::1]:80", "[ff0e::1]:80", "[::ffff:100.64.0.1]:80"} {
+		_, err := d.Dial(addr)
+		if code := ReplyCode(err); code != ReplyNotAllowed {
+			t.Errorf("dialing %s got %v, reply code %d, want %d", addr, err, code, ReplyNotAllowed)
+		}
+	}
+	if !d.Allowed(netip.MustParseAddr("192.0.2.1")) || !d.Allowed(netip.MustParseAddr("2001:db8::1")) ||
+		!d.Allowed(netip.MustParseAddr("100.128.0.1")) {
+		t.Error("public addresses refused")
+	}
+
+	d.Allow, err = ParsePrefixes("127.0.0.0/8, 10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("allowed address refused: %v", err)
+	}
+	conn.Close()
+	if !d.Allowed(netip.MustParseAddr("10.0.0.1")) || d.Allowed(netip.MustParseAddr("10.0.0.2")) {
+		t.Error("bare address in allowlist does not stand for itself alone")
+	}
+	if _, err := ParsePrefixes("10.0.0.0/33"); err == nil {
+		t.Error("parsed a bad prefix")
+	}
+}
@@ -0,0 +1,407 @@
+/*
+Package trace records per-path packet traces for offline traffic analysis.
+
+A Recorder logs the time, session, path, direction and size of every
+encapsulated frame a client or server sends or receives, and optionally of
+every read and write on the underlying connections. Traces are written in a
+compact binary format:
+
+	header:  "SPTTRACE" | version (1 byte) | vantage (1 byte) | start time (8 bytes, Unix nanoseconds, big-endian)
+	records: time since previous record (uvarint, nanoseconds) | session (uvarint) | path (uvarint) | flags (1 byte) | size (uvarint)
+
+The flags byte holds the Direction in bit 0 and the Layer in bit 1. Sessions
+are numbered from 1 in the order they first appear, 0 meaning that the
+session is not known yet. A record with bit 2 of its flags set instead
+introduces a session: its session field holds the new number, and 8 bytes of
+session ID take the place of the size.
+
+On a client, a record's path is the index of the path in its session, which
+a path keeps when it is redialed. On a server, it is the number of the
+connection, counted from 0 in the order they are accepted. Reader reads
+traces back, and the splitpt-trace command converts them to the CSV and cell
+formats used by website-fingerprinting classifiers.
+*/
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	magic   = "SPTTRACE"
+	version = 2
+	// sessionFlag marks a record that introduces a session.
+	sessionFlag = 1 << 2
+)
+
+// SessionID is the ID of the split session a record belongs to. The zero
+// SessionID stands for a session that is not known yet, as for the first
+// reads on a server's conn.
+type SessionID [8]byte
+
+func (id SessionID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Vantage is where a trace was recorded.
+type Vantage uint8
+
+const (
+	Client Vantage = iota
+	Server
+)
+
+func (v Vantage) String() string {
+	if v == Server {
+		return "server"
+	}
+	return "client"
+}
+
+// Direction is the direction of a record, relative to the client.
+type Direction uint8
+
+const (
+	// Upstream is from the client to the server.
+	Upstream Direction = iota
+	// Downstream is from the server to the client.
+	Downstream
+)
+
+func (d Direction) String() string {
+	if d == Downstream {
+		return "down"
+	}
+	return "up"
+}
+
+// Layer is what a record describes.
+type Layer uint8
+
+const (
+	// Frame records describe one encapsulated packet, including its
+	// length prefix.
+	Frame Layer = iota
+	// TCP records describe one read or write on the underlying conn.
+	TCP
+)
+
+func (l Layer) String() string {
+	if l == TCP {
+		return "tcp"
+	}
+	return "frame"
+}
+
+// Record is one entry in a trace.
+type Record struct {
+	// Time is the time of the record relative to the start of the trace.
+	Time      time.Duration
+	Session   SessionID
+	Path      int
+	Direction Direction
+	Layer     Layer
+	Size      int
+}
+
+// Recorder writes a trace. Its methods are safe to call from multiple
+// goroutines. A nil *Recorder records nothing, so callers need not check
+// whether tracing is enabled.
+type Recorder struct {
+	// TCP, if true, makes conns returned by WrapConn record TCP-layer reads
+	// and writes.
+	TCP bool
+
+	lock    sync.Mutex
+	w       *bufio.Writer
+	closer  io.Closer
+	vantage Vantage
+	start   time.Time
+	last    time.Time
+	err     error
+	// sessions numbers the sessions recorded so far.
+	sessions map[SessionID]uint64
+}
+
+// NewRecorder writes a trace header to w and returns a Recorder that appends
+// records to it. If w is an io.Closer, Close closes it.
+func NewRecorder(w io.Writer, vantage Vantage) (*Recorder, error) {
+	r := &Recorder{
+		w:        bufio.NewWriter(w),
+		vantage:  vantage,
+		start:    time.Now(),
+		sessions: make(map[SessionID]uint64),
+	}
+	r.last = r.start
+	if closer, ok := w.(io.Closer); ok {
+		r.closer = closer
+	}
+	var hdr [len(magic) + 2 + 8]byte
+	copy(hdr[:], magic)
+	hdr[len(magic)] = version
+	hdr[len(magic)+1] = byte(vantage)
+	binary.BigEndian.PutUint64(hdr[len(magic)+2:], uint64(r.start.UnixNano()))
+	_, err := r.w.Write(hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Create creates or truncates the named file and returns a Recorder that
+// writes a trace to it.
+func Create(filename string, vantage Vantage) (*Recorder, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewRecorder(f, vantage)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Record appends a record for an event happening now. Errors are remembered
+// and returned by Close.
+func (r *Recorder) Record(session SessionID, path int, dir Direction, layer Layer, size int) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return
+	}
+	delta := now.Sub(r.last)
+	if delta < 0 {
+		delta = 0
+	}
+	r.last = r.last.Add(delta)
+	var buf [7*binary.MaxVarintLen64 + 2 + len(SessionID{})]byte
+	n := 0
+	var number uint64
+	if session != (SessionID{}) {
+		var ok bool
+		number, ok = r.sessions[session]
+		if !ok {
+			// Introduce the session first, at the same time.
+			number = uint64(len(r.sessions) + 1)
+			r.sessions[session] = number
+			n += binary.PutUvarint(buf[n:], uint64(delta))
+			n += binary.PutUvarint(buf[n:], number)
+			n += binary.PutUvarint(buf[n:], 0)
+			buf[n] = sessionFlag
+			n++
+			n += copy(buf[n:], session[:])
+			delta = 0
+		}
+	}
+	n += binary.PutUvarint(buf[n:], uint64(delta))
+	n += binary.PutUvarint(buf[n:], number)
+	n += binary.PutUvarint(buf[n:], uint64(path))
+	buf[n] = byte(dir) | byte(layer)<<1
+	n++
+	n += binary.PutUvarint(buf[n:], uint64(size))
+	_, r.err = r.w.Write(buf[:n])
+}
+
+// Sent records a frame of size bytes sent on path of session by the side the
+// trace is recorded at.
+func (r *Recorder) Sent(session SessionID, path, size int) {
+	if r == nil {
+		return
+	}
+	r.Record(session, path, r.sendDirection(), Frame, size)
+}
+
+// Received records a frame of size bytes received on path of session by the
+// side the trace is recorded at.
+func (r *Recorder) Received(session SessionID, path, size int) {
+	if r == nil {
+		return
+	}
+	r.Record(session, path, 1-r.sendDirection(), Frame, size)
+}
+
+func (r *Recorder) sendDirection() Direction {
+	if r.vantage == Server {
+		return Downstream
+	}
+	return Upstream
+}
+
+// Close flushes the trace and closes the underlying writer, if it is an
+// io.Closer.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := r.err
+	if err == nil {
+		err = r.w.Flush()
+	}
+	if r.closer != nil {
+		if err2 := r.closer.Close(); err == nil {
+			err = err2
+		}
+	}
+	if r.err == nil {
+		r.err = errors.New("recorder is closed")
+	}
+	return err
+}
+
+// Reader reads a trace written by a Recorder.
+type Reader struct {
+	br      *bufio.Reader
+	vantage Vantage
+	start   time.Time
+	elapsed time.Duration
+	// sessions holds the ID of each session number.
+	sessions map[uint64]SessionID
+}
+
+// NewReader reads the trace header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	var hdr [len(magic) + 2 + 8]byte
+	_, err := io.ReadFull(br, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	if string(hdr[:len(magic)]) != magic {
+		return nil, errors.New("not a splitpt trace")
+	}
+	if hdr[len(magic)] != version {
+		return nil, fmt.Errorf("unsupported trace version %d", hdr[len(magic)])
+	}
+	return &Reader{
+		br:       br,
+		vantage:  Vantage(hdr[len(magic)+1]),
+		start:    time.Unix(0, int64(binary.BigEndian.Uint64(hdr[len(magic)+2:]))),
+		sessions: make(map[uint64]SessionID),
+	}, nil
+}
+
+// Vantage returns where the trace was recorded.
+func (r *Reader) Vantage() Vantage { return r.vantage }
+
+// Start returns the time the trace was started.
+func (r *Reader) Start() time.Time { return r.start }
+
+// Next returns the next record. It returns io.EOF at the end of the trace.
+func (r *Reader) Next() (Record, error) {
+	for {
+		delta, err := binary.ReadUvarint(r.br)
+		if err != nil {
+			return Record{}, err
+		}
+		number, err := binary.ReadUvarint(r.br)
+		if err != nil {
+			return Record{}, unexpectedEOF(err)
+		}
+		path, err := binary.ReadUvarint(r.br)
+		if err != nil {
+			return Record{}, unexpectedEOF(err)
+		}
+		flags, err := r.br.ReadByte()
+		if err != nil {
+			return Record{}, unexpectedEOF(err)
+		}
+		r.elapsed += time.Duration(delta)
+		if flags&sessionFlag != 0 {
+			var id SessionID
+			_, err := io.ReadFull(r.br, id[:])
+			if err != nil {
+				return Record{}, unexpectedEOF(err)
+			}
+			r.sessions[number] = id
+			continue
+		}
+		size, err := binary.ReadUvarint(r.br)
+		if err != nil {
+			return Record{}, unexpectedEOF(err)
+		}
+		session, ok := r.sessions[number]
+		if number != 0 && !ok {
+			return Record{}, fmt.Errorf("record of unknown session %d", number)
+		}
+		return Record{
+			Time:      r.elapsed,
+			Session:   session,
+			Path:      int(path),
+			Direction: Direction(flags & 1),
+			Layer:     Layer(flags >> 1 & 1),
+			Size:      int(size),
+		}, nil
+	}
+}
+
+// unexpectedEOF turns io.EOF in the middle of a record into
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WrapConn returns conn wrapped so that, if r.TCP is set, every read and
+// write on it is recorded as a TCP-layer record for path of session. If the
+// session is not known yet, it may be zero, and set later with SetSession.
+// Otherwise it returns conn unchanged.
+func (r *Recorder) WrapConn(session SessionID, path int, conn net.Conn) net.Conn {
+	if r == nil || !r.TCP {
+		return conn
+	}
+	c := &tracedConn{Conn: conn, recorder: r, path: path, readDir: 1 - r.sendDirection(), writeDir: r.sendDirection()}
+	c.session.Store(&session)
+	return c
+}
+
+// SetSession sets the session of the records of conn, if it was returned by
+// WrapConn.
+func SetSession(conn net.Conn, session SessionID) {
+	if c, ok := conn.(*tracedConn); ok {
+		c.session.Store(&session)
+	}
+}
+
+type tracedConn struct {
+	net.Conn
+	recorder          *Recorder
+	session           atomic.Pointer[SessionID]
+	path              int
+	readDir, writeDir Direction
+}
+
+func (c *tracedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.recorder.Record(*c.session.Load(), c.path, c.readDir, TCP, n)
+	}
+	return n, err
+}
+
+func (c *tracedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.recorder.Record(*c.session.Load(), c.path, c.writeDir, TCP, n)
+	}
+	return n, err
+}
@@ -0,0 +1,120 @@
+package trace
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := NewRecorder(&buf, Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := SessionID{1, 2, 3, 4, 5, 6, 7, 8}, SessionID{8}
+	r.Sent(a, 0, 100)
+	time.Sleep(2 * time.Millisecond)
+	r.Received(b, 3, 1400)
+	r.Record(SessionID{}, 70000, Upstream, TCP, 1<<20)
+	r.Sent(a, 1, 200)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Vantage() != Server {
+		t.Fatalf("vantage %v, want server", reader.Vantage())
+	}
+	want := []Record{
+		{Session: a, Path: 0, Direction: Downstream, Layer: Frame, Size: 100},
+		{Session: b, Path: 3, Direction: Upstream, Layer: Frame, Size: 1400},
+		{Path: 70000, Direction: Upstream, Layer: TCP, Size: 1 << 20},
+		{Session: a, Path: 1, Direction: Downstream, Layer: Frame, Size: 200},
+	}
+	var last time.Duration
+	for i, w := range want {
+		rec, err := reader.Next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if rec.Time < last {
+			t.Fatalf("record %d goes back in time", i)
+		}
+		last = rec.Time
+		rec.Time = 0
+		if rec != w {
+			t.Fatalf("record %d is %+v, want %+v", i, rec, w)
+		}
+	}
+	if last < 2*time.Millisecond {
+		t.Fatalf("trace lasted %v, want at least 2ms", last)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("after last record got %v, want io.EOF", err)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	r, _ := NewRecorder(&buf, Client)
+	r.Sent(SessionID{1}, 1, 1000)
+	r.Close()
+	reader, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestWrapConn(t *testing.T) {
+	var buf bytes.Buffer
+	r, _ := NewRecorder(&buf, Client)
+	if r.WrapConn(SessionID{}, 0, nil) != nil {
+		t.Fatal("WrapConn wrapped a conn without TCP recording enabled")
+	}
+	r.TCP = true
+	a, b := net.Pipe()
+	defer b.Close()
+	c := r.WrapConn(SessionID{}, 2, a)
+	go func() {
+		io.ReadFull(b, make([]byte, 5))
+		b.Write([]byte("abc"))
+	}()
+	// The session becomes known after the first write.
+	c.Write([]byte("hello"))
+	SetSession(c, SessionID{9})
+	c.Read(make([]byte, 10))
+	r.Close()
+
+	reader, _ := NewReader(&buf)
+	for _, want := range []Record{
+		{Path: 2, Direction: Upstream, Layer: TCP, Size: 5},
+		{Session: SessionID{9}, Path: 2, Direction: Downstream, Layer: TCP, Size: 3},
+	} {
+		rec, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Time = 0
+		if rec != want {
+			t.Fatalf("got %+v, want %+v", rec, want)
+		}
+	}
+}
+
+func TestNilRecorder(t *testing.T) {
+	var r *Recorder
+	r.Sent(SessionID{}, 0, 1)
+	r.Received(SessionID{}, 0, 1)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
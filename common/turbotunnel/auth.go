@@ -0,0 +1,251 @@
+package turbotunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"www.bamsoftware.com/git/turbotunnel-paper.git/example/turbotunnel/turbotunnel"
+)
+
+// Paths prove that they belong to their session with a secret that the
+// client chooses for the session and sends, on the first path to attach, to
+// the server. Every path then begins with a FrameAttach holding a fresh nonce
+// and a MAC of it keyed by the secret, so that knowing a session's ID, which
+// every path sends in the clear, is not enough to attach a path to the
+// session and receive its packets. The server remembers the nonces each
+// session has used, so that a FrameAttach copied from another path is
+// rejected.
+const (
+	// SecretLen is the length of a session secret.
+	SecretLen = 32
+	// attachNonceLen is the length of the nonce in a FrameAttach.
+	attachNonceLen = 16
+	// attachEstablish is the flag of a FrameAttach that carries the
+	// session secret.
+	attachEstablish = 1
+	// attachTimeout bounds how long the server waits for the FrameAttach
+	// of a path, and for the secret of its session to be established by
+	// another path if it does not carry it.
+	attachTimeout = 10 * time.Second
+	// authIdleTimeout is how long the server remembers the secret and
+	// nonces of a session after its last path closes.
+	authIdleTimeout = 10 * time.Minute
+)
+
+// ErrAttach is returned for a path whose FrameAttach does not prove that it
+// belongs to its session, or repeats an earlier one.
+var ErrAttach = errors.New("path failed to authenticate")
+
+// NewSessionSecret returns a random session secret.
+func NewSessionSecret() []byte {
+	secret := make([]byte, SecretLen)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// WriteAttach writes a FrameAttach control frame proving that a path belongs
+// to the session sessionID, whose secret is secret. If establish is true,
+// the frame carries the secret itself, for the server to learn it. The body
+// is
+//
+//	flags (1 byte) | nonce (16 bytes) | secret (32 bytes, if establishing) | tag (32 bytes)
+//
+// where the tag is an HMAC-SHA256, keyed by the secret, of the session ID and
+// everything before the tag.
+func WriteAttach(w io.Writer, sessionID SessionID, secret []byte, establish bool) error {
+	if len(secret) != SecretLen {
+		panic("bad session secret length")
+	}
+	body := make([]byte, 1+attachNonceLen, 1+attachNonceLen+2*SecretLen)
+	_, err := rand.Read(body[1:])
+	if err != nil {
+		return err
+	}
+	if establish {
+		body[0] = attachEstablish
+		body = append(body, secret...)
+	}
+	body = append(body, attachTag(secret, sessionID[:], body)...)
+	return WriteControl(w, FrameAttach, body)
+}
+
+// attachFrame is a parsed FrameAttach body.
+type attachFrame struct {
+	nonce [attachNonceLen]byte
+	// secret is the session secret, if the frame carries it.
+	secret []byte
+	// signed is the part of the body the tag covers.
+	signed []byte
+	tag    []byte
+}
+
+func parseAttach(body []byte) (attachFrame, error) {
+	var a attachFrame
+	if len(body) < 1+attachNonceLen+sha256.Size {
+		return a, errors.New("malformed attach frame")
+	}
+	n := len(body) - sha256.Size
+	a.signed, a.tag = body[:n], body[n:]
+	copy(a.nonce[:], body[1:])
+	switch {
+	case body[0] == 0 && n == 1+attachNonceLen:
+	case body[0] == attachEstablish && n == 1+attachNonceLen+SecretLen:
+		a.secret = body[1+attachNonceLen : n]
+	default:
+		return a, errors.New("malformed attach frame")
+	}
+	return a, nil
+}
+
+// verify reports whether a was made with secret for the session sessionID.
+func (a attachFrame) verify(sessionID turbotunnel.SessionID, secret []byte) bool {
+	return hmac.Equal(a.tag, attachTag(secret, sessionID[:], a.signed))
+}
+
+func attachTag(secret, sessionID, signed []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("splitpt attach"))
+	h.Write(sessionID)
+	h.Write(signed)
+	return h.Sum(nil)
+}
+
+// authTable is what a ListenerPacketConn knows of the secrets of sessions.
+type authTable struct {
+	lock      sync.Mutex
+	sessions  map[turbotunnel.SessionID]*sessionAuth
+	lastSweep time.Time
+}
+
+type sessionAuth struct {
+	// secret is nil until a path establishes it, when ready is closed.
+	secret []byte
+	ready  chan struct{}
+	// nonces holds the nonces of the session's accepted FrameAttachs.
+	nonces map[[attachNonceLen]byte]struct{}
+	// conns counts the paths that are attached or attaching, and idle is
+	// when the last of them closed.
+	conns int
+	idle  time.Time
+}
+
+// authenticate reads the FrameAttach that begins a path of sessionID from
+// conn and answers it if it proves that the path belongs to the session. On
+// success, release must be called when the path closes.
+func (t *authTable) authenticate(conn net.Conn, sessionID turbotunnel.SessionID) error {
+	deadline := time.Now().Add(attachTimeout)
+	conn.SetReadDeadline(deadline)
+	f, err := ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+	if f.Type != FrameAttach {
+		return fmt.Errorf("%w: no attach frame", ErrAttach)
+	}
+	a, err := parseAttach(f.Body)
+	if err != nil {
+		return err
+	}
+	s := t.acquire(sessionID)
+	ok := false
+	defer func() {
+		if !ok {
+			t.release(sessionID)
+		}
+	}()
+
+	if a.secret != nil {
+		if !a.verify(sessionID, a.secret) {
+			return ErrAttach
+		}
+		t.lock.Lock()
+		if s.secret == nil {
+			s.secret = a.secret
+			close(s.ready)
+		} else if !hmac.Equal(s.secret, a.secret) {
+			t.lock.Unlock()
+			return ErrAttach
+		}
+		t.lock.Unlock()
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-s.ready:
+	case <-timer.C:
+		return fmt.Errorf("%w: session secret not established", ErrAttach)
+	}
+
+	t.lock.Lock()
+	if !a.verify(sessionID, s.secret) {
+		t.lock.Unlock()
+		return ErrAttach
+	}
+	if _, seen := s.nonces[a.nonce]; seen {
+		t.lock.Unlock()
+		return fmt.Errorf("%w: replayed attach frame", ErrAttach)
+	}
+	s.nonces[a.nonce] = struct{}{}
+	t.lock.Unlock()
+
+	conn.SetReadDeadline(time.Time{})
+	err = WriteControl(conn, FrameAttachOK, nil)
+	if err != nil {
+		return err
+	}
+	ok = true
+	return nil
+}
+
+// acquire returns the state of a session, creating it if needed, and counts
+// a path of it. It also forgets the sessions that have been idle for
+// authIdleTimeout.
+func (t *authTable) acquire(sessionID turbotunnel.SessionID) *sessionAuth {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	if t.sessions == nil {
+		t.sessions = make(map[turbotunnel.SessionID]*sessionAuth)
+	}
+	if now.Sub(t.lastSweep) > time.Minute {
+		for id, s := range t.sessions {
+			if s.conns == 0 && now.Sub(s.idle) > authIdleTimeout {
+				delete(t.sessions, id)
+			}
+		}
+		t.lastSweep = now
+	}
+	s := t.sessions[sessionID]
+	if s == nil {
+		s = &sessionAuth{
+			ready:  make(chan struct{}),
+			nonces: make(map[[attachNonceLen]byte]struct{}),
+		}
+		t.sessions[sessionID] = s
+	}
+	s.conns++
+	return s
+}
+
+// release uncounts a path of a session. A session whose secret was never
+// established is forgotten with its last path.
+func (t *authTable) release(sessionID turbotunnel.SessionID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := t.sessions[sessionID]
+	s.conns--
+	s.idle = time.Now()
+	if s.conns == 0 && s.secret == nil {
+		delete(t.sessions, sessionID)
+	}
+}
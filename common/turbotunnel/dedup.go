@@ -0,0 +1,55 @@
+package turbotunnel
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// DedupWindow is how many recent packets a receiver remembers to recognize
+// copies. It should cover the packets that can arrive on the fastest path
+// before the slowest path delivers its copy.
+const DedupWindow = 4096
+
+// DedupFilter detects copies of recently seen packets. Sessions that send
+// every packet on several paths use it to pass on only the first copy to
+// arrive. Packets are identified by a hash of their contents; a KCP
+// retransmission differs from the original in its timestamp, so it is not
+// mistaken for a copy. A DedupFilter is safe for concurrent use.
+type DedupFilter struct {
+	lock sync.Mutex
+	seed maphash.Seed
+	seen map[uint64]struct{}
+	// ring holds the hashes in seen in the order they were added, so that
+	// the oldest can be forgotten.
+	ring []uint64
+	next int
+}
+
+// NewDedupFilter returns a DedupFilter that remembers the last size packets.
+func NewDedupFilter(size int) *DedupFilter {
+	return &DedupFilter{
+		seed: maphash.MakeSeed(),
+		seen: make(map[uint64]struct{}, size),
+		ring: make([]uint64, 0, size),
+	}
+}
+
+// Seen reports whether p is a copy of one of the packets remembered by f, and
+// remembers p if not.
+func (f *DedupFilter) Seen(p []byte) bool {
+	h := maphash.Bytes(f.seed, p)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.seen[h]; ok {
+		return true
+	}
+	if len(f.ring) < cap(f.ring) {
+		f.ring = append(f.ring, h)
+	} else {
+		delete(f.seen, f.ring[f.next])
+		f.ring[f.next] = h
+		f.next = (f.next + 1) % len(f.ring)
+	}
+	f.seen[h] = struct{}{}
+	return false
+}
@@ -2,7 +2,9 @@ package turbotunnel
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
+	"time"
 )
 
 // ReadPacket decapsulates a packet from r. It returns io.EOF if and only if
@@ -35,3 +37,140 @@ func WritePacket(w io.Writer, p []byte) error {
 	_, err = w.Write(p)
 	return err
 }
+
+// Control frames share a connection with encapsulated packets. They are
+// distinguished by a zero length prefix, which no real packet has, followed by
+// a one-byte type and the length-prefixed body:
+//
+//	0x0000 | type (1 byte) | length (2 bytes) | body
+const (
+	// FrameFeedback is sent by the server on each path to report the
+	// total number of packet bytes, including length prefixes, it has
+	// received on that path, and when it received the last of them, in
+	// nanoseconds since the path was opened. The body is two big-endian
+	// uint64s.
+	FrameFeedback = 1
+	// FrameRedundancy is sent by the client on each path, right after the
+	// session ID, when it sends every packet on several paths. The body is
+	// one byte, the number of copies, which the server then also sends of
+	// every packet and removes duplicates from what it receives.
+	FrameRedundancy = 2
+	// FrameProbe is sent by the client to check that a path is alive. The
+	// body is a big-endian uint64 sequence number.
+	FrameProbe = 3
+	// FrameProbeReply is the server's answer to a FrameProbe, sent on the
+	// same path with the same body.
+	FrameProbeReply = 4
+	// FrameAttach is sent by the client on each path, right after the
+	// session ID, to prove that the path belongs to the session. See
+	// WriteAttach for the body.
+	FrameAttach = 5
+	// FrameAttachOK is the server's answer to a FrameAttach it accepts,
+	// sent before anything else on the path. The body is empty.
+	FrameAttachOK = 6
+)
+
+// Frame is either an encapsulated packet or a control frame.
+type Frame struct {
+	// Type is 0 for a packet, or one of the control frame types.
+	Type byte
+	// Body is the packet, or the body of the control frame.
+	Body []byte
+}
+
+// IsControl reports whether f is a control frame.
+func (f Frame) IsControl() bool { return f.Type != 0 }
+
+// ReadFrame reads a packet or a control frame from r. It returns io.EOF if and
+// only if there were zero bytes to be read from r.
+func ReadFrame(r io.Reader) (Frame, error) {
+	p, err := ReadPacket(r)
+	if err != nil || len(p) != 0 {
+		return Frame{Body: p}, err
+	}
+	var typ [1]byte
+	_, err = io.ReadFull(r, typ[:])
+	if err == nil && typ[0] == 0 {
+		err = errors.New("control frame with type 0")
+	}
+	if err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	body, err := ReadPacket(r)
+	if err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	return Frame{Type: typ[0], Body: body}, nil
+}
+
+// WriteControl writes a control frame of the given type into w. It panics if
+// typ is 0 or the body is too long.
+func WriteControl(w io.Writer, typ byte, body []byte) error {
+	if typ == 0 {
+		panic("control frame with type 0")
+	}
+	_, err := w.Write([]byte{0, 0, typ})
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, body)
+}
+
+// WriteFeedback writes a FrameFeedback control frame reporting that received
+// bytes had arrived by elapsed after the path was opened.
+func WriteFeedback(w io.Writer, received uint64, elapsed time.Duration) error {
+	var body [16]byte
+	binary.BigEndian.PutUint64(body[0:8], received)
+	binary.BigEndian.PutUint64(body[8:16], uint64(elapsed))
+	return WriteControl(w, FrameFeedback, body[:])
+}
+
+// ParseFeedback returns the byte count and time in the body of a
+// FrameFeedback frame.
+func ParseFeedback(body []byte) (uint64, time.Duration, error) {
+	if len(body) != 16 {
+		return 0, 0, errors.New("malformed feedback frame")
+	}
+	return binary.BigEndian.Uint64(body[0:8]), time.Duration(binary.BigEndian.Uint64(body[8:16])), nil
+}
+
+// WriteRedundancy writes a FrameRedundancy control frame announcing that the
+// session sends k copies of every packet.
+func WriteRedundancy(w io.Writer, k int) error {
+	if k < 1 || k > 255 {
+		panic("redundancy out of range")
+	}
+	return WriteControl(w, FrameRedundancy, []byte{byte(k)})
+}
+
+// ParseRedundancy returns the number of copies in the body of a
+// FrameRedundancy frame.
+func ParseRedundancy(body []byte) (int, error) {
+	if len(body) != 1 || body[0] == 0 {
+		return 0, errors.New("malformed redundancy frame")
+	}
+	return int(body[0]), nil
+}
+
+// WriteProbe writes a FrameProbe control frame with sequence number seq.
+func WriteProbe(w io.Writer, seq uint64) error {
+	var body [8]byte
+	binary.BigEndian.PutUint64(body[:], seq)
+	return WriteControl(w, FrameProbe, body[:])
+}
+
+// ParseProbe returns the sequence number in the body of a FrameProbe or
+// FrameProbeReply frame.
+func ParseProbe(body []byte) (uint64, error) {
+	if len(body) != 8 {
+		return 0, errors.New("malformed probe frame")
+	}
+	return binary.BigEndian.Uint64(body), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -1,37 +1,133 @@
 package turbotunnel
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"anticensorshiptrafficsplitting/splitpt/common/metrics"
+	"anticensorshiptrafficsplitting/splitpt/common/trace"
+
 	"www.bamsoftware.com/git/turbotunnel-paper.git/example/turbotunnel/turbotunnel"
 )
 
+// feedbackInterval is how often the server reports received bytes on each
+// path that has received packets since the last report.
+const feedbackInterval = 50 * time.Millisecond
+
+// ListenerPacketConn is a net.PacketConn whose packets are carried on the
+// conns accepted from one or more net.Listeners. The conns of a session may
+// be accepted from any of them.
 type ListenerPacketConn struct {
-	ln net.Listener
 	*turbotunnel.QueuePacketConn
+	recorder *trace.Recorder
+	metrics  *metrics.Metrics
+	// limiter, if not nil, applies the rate limits.
+	limiter *limiter
+	// Number of connections accepted so far, used to number paths in
+	// traces.
+	numPaths atomic.Uint32
+
+	lnsLock sync.Mutex
+	lns     []net.Listener
+	closed  bool
+
+	sessionsLock sync.Mutex
+	sessions     map[turbotunnel.SessionID]*serverSession
+
+	auth authTable
 }
 
-func NewListenerPacketConn(ln net.Listener) *ListenerPacketConn {
+// serverSession is what a ListenerPacketConn knows about a session beyond its
+// packet queues: the conns it is carried on, and whether the client sends
+// copies of each packet.
+type serverSession struct {
+	// copies holds, for each of the session's conns, a queue of packet
+	// copies for the conn to send.
+	copies     []chan []byte
+	next       int
+	redundancy int
+	dedup      *DedupFilter
+}
+
+// copyQueueLen is how many packet copies may wait to be sent on each conn.
+const copyQueueLen = 32
+
+// probeQueueLen is how many probes may wait to be answered on each conn.
+// Further probes go unanswered.
+const probeQueueLen = 8
+
+// ListenerOption configures optional behavior of a ListenerPacketConn.
+type ListenerOption func(*ListenerPacketConn)
+
+// WithRecorder makes the ListenerPacketConn record every frame it sends or
+// receives to rec, under the session of the frame's conn. Paths are the conns,
+// numbered in the order they are accepted.
+func WithRecorder(rec *trace.Recorder) ListenerOption {
+	return func(c *ListenerPacketConn) { c.recorder = rec }
+}
+
+// WithRateLimit makes the ListenerPacketConn limit the rate of every session,
+// and of all sessions together, sharing the outgoing rate fairly between
+// sessions.
+func WithRateLimit(limit RateLimit) ListenerOption {
+	return func(c *ListenerPacketConn) {
+		if !limit.IsZero() {
+			c.limiter = newLimiter(limit)
+		}
+	}
+}
+
+// WithMetrics makes the ListenerPacketConn count the bytes that rate limits
+// drop ("throttled_bytes_in") or delay ("throttled_bytes_out"), and the paths
+// that fail to authenticate ("rejected_paths"), in m.
+func WithMetrics(m *metrics.Metrics) ListenerOption {
+	return func(c *ListenerPacketConn) { c.metrics = m }
+}
+
+// NewListenerPacketConn returns a ListenerPacketConn that accepts conns from
+// ln, and from any listener added later with AddListener. Its local address
+// is that of ln.
+func NewListenerPacketConn(ln net.Listener, opts ...ListenerOption) *ListenerPacketConn {
 	c := &ListenerPacketConn{
-		ln,
-		turbotunnel.NewQueuePacketConn(ln.Addr(), 1*time.Minute),
+		QueuePacketConn: turbotunnel.NewQueuePacketConn(ln.Addr(), 1*time.Minute),
+		sessions:        make(map[turbotunnel.SessionID]*serverSession),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	c.AddListener(ln)
+	return c
+}
+
+// AddListener makes c also accept conns from ln, so that clients can split a
+// session over several addresses. c takes ownership of ln and closes it when
+// it is itself closed. If c is already closed, ln is closed and
+// net.ErrClosed is returned.
+func (c *ListenerPacketConn) AddListener(ln net.Listener) error {
+	c.lnsLock.Lock()
+	defer c.lnsLock.Unlock()
+	if c.closed {
+		ln.Close()
+		return net.ErrClosed
+	}
+	c.lns = append(c.lns, ln)
 	go func() {
-		err := c.acceptConnections()
+		err := c.acceptConnections(ln)
 		if err != nil {
 			log.Printf("acceptConnections: %v", err)
 		}
 	}()
-	return c
+	return nil
 }
 
-func (c *ListenerPacketConn) acceptConnections() error {
+func (c *ListenerPacketConn) acceptConnections(ln net.Listener) error {
 	for {
-		conn, err := c.ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			if err, ok := err.(net.Error); ok && err.Temporary() {
 				continue
@@ -49,12 +145,37 @@ func (c *ListenerPacketConn) acceptConnections() error {
 }
 
 func (c *ListenerPacketConn) handleConnection(conn net.Conn) error {
+	pathIndex := int(c.numPaths.Add(1) - 1)
+	conn = c.recorder.WrapConn(trace.SessionID{}, pathIndex, conn)
+
 	// First read the client's session identifier.
 	var sessionID turbotunnel.SessionID
 	_, err := io.ReadFull(conn, sessionID[:])
 	if err != nil {
 		return err
 	}
+	traceSession := trace.SessionID(sessionID)
+	trace.SetSession(conn, traceSession)
+	// Then the FrameAttach proving that the path belongs to the session.
+	err = c.auth.authenticate(conn, sessionID)
+	if err != nil {
+		c.metrics.Add("rejected_paths", 1)
+		return fmt.Errorf("session %v: %w", sessionID, err)
+	}
+	defer c.auth.release(sessionID)
+
+	// received counts the packet bytes read from this path, and
+	// receivedAt is when the last of them arrived, relative to start. The
+	// write loop reports them back to the client in feedback frames, from
+	// which the client estimates the path's delivery rate.
+	start := time.Now()
+	var received atomic.Uint64
+	var receivedAt atomic.Int64
+
+	sess, copies := c.attach(sessionID)
+	defer c.detach(sessionID, copies)
+	// probes holds the bodies of probes to answer.
+	probes := make(chan []byte, probeQueueLen)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -63,26 +184,101 @@ func (c *ListenerPacketConn) handleConnection(conn net.Conn) error {
 		defer wg.Done()
 		defer close(done) // Signal the write loop to finish.
 		for {
-			p, err := turbotunnel.ReadPacket(conn)
+			f, err := ReadFrame(conn)
 			if err != nil {
 				return
 			}
-			c.QueuePacketConn.QueueIncoming(p, sessionID)
+			if f.Type == FrameRedundancy {
+				k, err := ParseRedundancy(f.Body)
+				if err != nil {
+					log.Printf("handleConnection: %v", err)
+					return
+				}
+				c.setRedundancy(sess, k)
+				continue
+			}
+			if f.Type == FrameProbe {
+				select {
+				case probes <- f.Body:
+				default:
+				}
+				continue
+			}
+			if f.IsControl() {
+				continue
+			}
+			receivedAt.Store(int64(time.Since(start)))
+			received.Add(uint64(2 + len(f.Body)))
+			c.recorder.Received(traceSession, pathIndex, 2+len(f.Body))
+			if dedup := c.dedupFilter(sess); dedup != nil && dedup.Seen(f.Body) {
+				continue
+			}
+			if c.limiter != nil && !c.limiter.admit(sessionID, len(f.Body)) {
+				c.metrics.Add("throttled_bytes_in", uint64(len(f.Body)))
+				continue
+			}
+			c.QueuePacketConn.QueueIncoming(f.Body, sessionID)
 		}
 	}()
 	go func() {
 		defer wg.Done()
 		defer conn.Close() // Signal the read loop to finish.
+		ticker := time.NewTicker(feedbackInterval)
+		defer ticker.Stop()
+		var acked uint64
 		for {
+			// Probes are answered ahead of queued packets, so
+			// that the client does not take a busy conn for a
+			// dead one.
+			select {
+			case body := <-probes:
+				err := WriteControl(conn, FrameProbeReply, body)
+				if err != nil {
+					return
+				}
+				continue
+			default:
+			}
 			select {
 			case <-done:
 				return
+			case <-ticker.C:
+				n := received.Load()
+				if n == acked {
+					continue
+				}
+				err := WriteFeedback(conn, n, time.Duration(receivedAt.Load()))
+				if err != nil {
+					return
+				}
+				acked = n
+			case body := <-probes:
+				err := WriteControl(conn, FrameProbeReply, body)
+				if err != nil {
+					return
+				}
+			case p := <-copies:
+				if !c.throttle(sessionID, p, done) {
+					return
+				}
+				err := turbotunnel.WritePacket(conn, p)
+				if err != nil {
+					return
+				}
+				c.recorder.Sent(traceSession, pathIndex, 2+len(p))
 			case p, ok := <-c.QueuePacketConn.OutgoingQueue(sessionID):
 				if ok {
+					// Queue the copies first, so that they do not
+					// wait for this conn if it is stalled.
+					c.sendCopies(sess, copies, p)
+					if !c.throttle(sessionID, p, done) {
+						return
+					}
 					err := turbotunnel.WritePacket(conn, p)
 					if err != nil {
 						return
 					}
+					c.recorder.Sent(traceSession, pathIndex, 2+len(p))
 				}
 			}
 		}
@@ -92,8 +288,109 @@ func (c *ListenerPacketConn) handleConnection(conn net.Conn) error {
 	return nil
 }
 
+// attach records a new conn carrying sessionID and returns the session and
+// the conn's queue of packet copies.
+func (c *ListenerPacketConn) attach(sessionID turbotunnel.SessionID) (*serverSession, chan []byte) {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	sess := c.sessions[sessionID]
+	if sess == nil {
+		sess = &serverSession{}
+		c.sessions[sessionID] = sess
+	}
+	copies := make(chan []byte, copyQueueLen)
+	sess.copies = append(sess.copies, copies)
+	return sess, copies
+}
+
+// detach forgets a conn that attach returned copies for, and the session once
+// it has no conns left.
+func (c *ListenerPacketConn) detach(sessionID turbotunnel.SessionID, copies chan []byte) {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	sess := c.sessions[sessionID]
+	for i, ch := range sess.copies {
+		if ch == copies {
+			sess.copies = append(sess.copies[:i], sess.copies[i+1:]...)
+			break
+		}
+	}
+	if len(sess.copies) == 0 {
+		delete(c.sessions, sessionID)
+		if c.limiter != nil {
+			c.limiter.forget(sessionID)
+		}
+	}
+}
+
+// throttle waits until the rate limits allow p to be sent on a conn of
+// sessionID. It returns false if done is closed first.
+func (c *ListenerPacketConn) throttle(sessionID turbotunnel.SessionID, p []byte, done <-chan struct{}) bool {
+	if c.limiter == nil {
+		return true
+	}
+	waited, ok := c.limiter.waitSend(sessionID, len(p), done)
+	if waited {
+		c.metrics.Add("throttled_bytes_out", uint64(len(p)))
+	}
+	return ok
+}
+
+func (c *ListenerPacketConn) setRedundancy(sess *serverSession, k int) {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	sess.redundancy = k
+	if k > 1 && sess.dedup == nil {
+		sess.dedup = NewDedupFilter(DedupWindow)
+	}
+}
+
+func (c *ListenerPacketConn) dedupFilter(sess *serverSession) *DedupFilter {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	return sess.dedup
+}
+
+// sendCopies queues p, which is about to be sent on the conn whose copy queue
+// is own, on as many other conns of the session as the client asked for, taking
+// the conns in turn. Copies are dropped if a conn's queue is full.
+func (c *ListenerPacketConn) sendCopies(sess *serverSession, own chan []byte, p []byte) {
+	c.sessionsLock.Lock()
+	var targets []chan []byte
+	for i := 0; i < len(sess.copies) && len(targets) < sess.redundancy-1; i++ {
+		ch := sess.copies[(sess.next+i)%len(sess.copies)]
+		if ch != own {
+			targets = append(targets, ch)
+		}
+	}
+	if len(sess.copies) > 0 {
+		sess.next = (sess.next + 1) % len(sess.copies)
+	}
+	c.sessionsLock.Unlock()
+	for _, ch := range targets {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// Close closes c and all of its listeners.
 func (c *ListenerPacketConn) Close() error {
-	err := c.ln.Close()
+	c.lnsLock.Lock()
+	wasClosed := c.closed
+	c.closed = true
+	var err error
+	for _, ln := range c.lns {
+		if err2 := ln.Close(); err == nil {
+			err = err2
+		}
+	}
+	c.lns = nil
+	c.lnsLock.Unlock()
+	if c.limiter != nil && !wasClosed {
+		c.limiter.close()
+	}
 	err2 := c.QueuePacketConn.Close()
 	if err == nil {
 		err = err2
@@ -0,0 +1,318 @@
+package turbotunnel
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"www.bamsoftware.com/git/turbotunnel-paper.git/example/turbotunnel/turbotunnel"
+)
+
+// drrQuantum is how many bytes each waiting session may send per round of the
+// deficit round robin that shares the outgoing rate between sessions.
+const drrQuantum = 1500
+
+// RateLimit configures the rate limits of a ListenerPacketConn, in bytes per
+// second, each of which applies separately to packets coming from clients and
+// packets going to them. A zero rate is unlimited; a zero burst is a
+// second's worth of the rate.
+//
+// Incoming packets beyond a limit are dropped, and the client's KCP
+// retransmits them more slowly. Outgoing packets wait their turn, and when
+// sessions compete for the global rate, each gets an equal share.
+type RateLimit struct {
+	// SessionRate and SessionBurst limit each session.
+	SessionRate  int
+	SessionBurst int
+	// GlobalRate and GlobalBurst limit all sessions together.
+	GlobalRate  int
+	GlobalBurst int
+}
+
+// IsZero reports whether l limits nothing.
+func (l RateLimit) IsZero() bool {
+	return l.SessionRate <= 0 && l.GlobalRate <= 0
+}
+
+// tokenBucket is a token bucket of bytes. A nil *tokenBucket is unlimited.
+// Its methods are not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full token bucket, or nil if rate is not positive.
+func newTokenBucket(rate, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// wait returns how long until n bytes may be taken from b. A packet larger
+// than the burst may be taken once the bucket is full, leaving it in debt.
+func (b *tokenBucket) wait(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	need := math.Min(float64(n), b.burst)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration(math.Ceil((need - b.tokens) / b.rate * float64(time.Second)))
+}
+
+// take takes n bytes from b.
+func (b *tokenBucket) take(n int) {
+	if b != nil {
+		b.tokens -= float64(n)
+	}
+}
+
+// limiter applies a RateLimit. Outgoing packets are scheduled by deficit round
+// robin between the sessions that have packets waiting.
+type limiter struct {
+	limit RateLimit
+
+	lock      sync.Mutex
+	globalIn  *tokenBucket
+	globalOut *tokenBucket
+	sessions  map[turbotunnel.SessionID]*limitedSession
+	// active holds the sessions with packets waiting, in round robin
+	// order. next is the index of the session whose turn it is, and
+	// resume is whether its turn was cut short for lack of global
+	// tokens, so that it has already been given its quantum.
+	active []*limitedSession
+	next   int
+	resume bool
+	wake   chan struct{}
+	closed chan struct{}
+}
+
+type limitedSession struct {
+	in, out *tokenBucket
+	deficit int
+	// active is whether the session is in limiter.active.
+	active bool
+	// queue holds the sizes of the session's waiting packets, and the
+	// channels to close when each may be sent.
+	queue []sendRequest
+}
+
+type sendRequest struct {
+	n       int
+	granted chan struct{}
+}
+
+func newLimiter(limit RateLimit) *limiter {
+	now := time.Now()
+	l := &limiter{
+		limit:     limit,
+		globalIn:  newTokenBucket(limit.GlobalRate, limit.GlobalBurst, now),
+		globalOut: newTokenBucket(limit.GlobalRate, limit.GlobalBurst, now),
+		sessions:  make(map[turbotunnel.SessionID]*limitedSession),
+		wake:      make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+	go l.schedule()
+	return l
+}
+
+func (l *limiter) close() {
+	close(l.closed)
+}
+
+// session returns the state of a session, creating it if needed. l.lock must
+// be held.
+func (l *limiter) session(id turbotunnel.SessionID) *limitedSession {
+	s := l.sessions[id]
+	if s == nil {
+		now := time.Now()
+		s = &limitedSession{
+			in:  newTokenBucket(l.limit.SessionRate, l.limit.SessionBurst, now),
+			out: newTokenBucket(l.limit.SessionRate, l.limit.SessionBurst, now),
+		}
+		l.sessions[id] = s
+	}
+	return s
+}
+
+// forget forgets a session that has no conns left.
+func (l *limiter) forget(id turbotunnel.SessionID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s := l.sessions[id]
+	delete(l.sessions, id)
+	for i, other := range l.active {
+		if other == s {
+			l.active = append(l.active[:i], l.active[i+1:]...)
+			l.resume = false
+			break
+		}
+	}
+}
+
+// admit reports whether an incoming packet of n bytes of a session is within
+// the limits, taking its bytes if so.
+func (l *limiter) admit(id turbotunnel.SessionID, n int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s := l.session(id)
+	now := time.Now()
+	if s.in.wait(n, now) > 0 || l.globalIn.wait(n, now) > 0 {
+		return false
+	}
+	s.in.take(n)
+	l.globalIn.take(n)
+	return true
+}
+
+// waitSend waits until an outgoing packet of n bytes of a session may be
+// sent. It returns whether the packet had to wait, or false early if done is
+// closed.
+func (l *limiter) waitSend(id turbotunnel.SessionID, n int, done <-chan struct{}) (waited, ok bool) {
+	l.lock.Lock()
+	s := l.session(id)
+	now := time.Now()
+	// Send at once if nothing is waiting and the limits allow it.
+	if len(l.active) == 0 && s.out.wait(n, now) == 0 && l.globalOut.wait(n, now) == 0 {
+		s.out.take(n)
+		l.globalOut.take(n)
+		l.lock.Unlock()
+		return false, true
+	}
+	req := sendRequest{n: n, granted: make(chan struct{})}
+	if !s.active {
+		s.active = true
+		l.active = append(l.active, s)
+	}
+	s.queue = append(s.queue, req)
+	l.lock.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-req.granted:
+		return true, true
+	case <-done:
+	case <-l.closed:
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, other := range s.queue {
+		if other.granted == req.granted {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	return true, false
+}
+
+// schedule grants the waiting packets of the active sessions in deficit round
+// robin order, as the limits allow, until the limiter is closed.
+func (l *limiter) schedule() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		sleep := l.round()
+		if sleep > 0 {
+			timer.Reset(sleep)
+		}
+		select {
+		case <-l.closed:
+			return
+		case <-l.wake:
+		case <-timer.C:
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+// round grants waiting packets in deficit round robin order until every active
+// session has either sent all its packets or must wait for tokens. It returns
+// how long until the first of them may send, or 0 if none are waiting.
+func (l *limiter) round() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for len(l.active) > 0 {
+		now := time.Now()
+		var sleep time.Duration
+		// progress is whether another pass may grant more: a packet
+		// was granted, or a session needs more turns for its next one.
+		progress := false
+		for visits := len(l.active); visits > 0 && len(l.active) > 0; visits-- {
+			if l.next >= len(l.active) {
+				l.next = 0
+			}
+			s := l.active[l.next]
+			if !l.resume {
+				s.deficit += drrQuantum
+			}
+			l.resume = false
+			for len(s.queue) > 0 && s.deficit >= s.queue[0].n {
+				req := s.queue[0]
+				if d := s.out.wait(req.n, now); d > 0 {
+					sleep = minWait(sleep, d)
+					break
+				}
+				if d := l.globalOut.wait(req.n, now); d > 0 {
+					// Every session must wait; carry on with
+					// this one's turn when there are tokens.
+					l.resume = true
+					return minWait(sleep, d)
+				}
+				s.out.take(req.n)
+				l.globalOut.take(req.n)
+				close(req.granted)
+				s.queue = s.queue[1:]
+				s.deficit -= req.n
+				progress = true
+			}
+			if len(s.queue) == 0 {
+				s.deficit = 0
+				s.active = false
+				l.active = append(l.active[:l.next], l.active[l.next+1:]...)
+				continue
+			}
+			if s.deficit < s.queue[0].n {
+				progress = true
+			}
+			// A session waiting for tokens does not bank turns.
+			s.deficit = min(s.deficit, drrQuantum+s.queue[0].n)
+			l.next++
+		}
+		if !progress {
+			return sleep
+		}
+	}
+	return 0
+}
+
+// minWait returns the shorter of two waits, where 0 means no wait yet.
+func minWait(a, b time.Duration) time.Duration {
+	if a == 0 || b < a {
+		return b
+	}
+	return a
+}
@@ -98,14 +98,17 @@ func (c *RedialPacketConn) dialAndExchange() error {
 		defer close(done) // Signal the write loop to finish.
 		br := bufio.NewReader(conn)
 		for {
-			p, err := ReadPacket(br)
+			f, err := ReadFrame(br)
 			if err != nil {
 				return
 			}
+			if f.IsControl() {
+				continue
+			}
 			select {
 			case <-c.closed:
 				return
-			case c.recvQueue <- p:
+			case c.recvQueue <- f.Body:
 			}
 		}
 	}()
@@ -0,0 +1,365 @@
+package turbotunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt/common/metrics"
+
+	"www.bamsoftware.com/git/turbotunnel-paper.git/example/turbotunnel/turbotunnel"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	packets := [][]byte{{}, []byte("a"), bytes.Repeat([]byte("x"), 65535)}
+	for _, p := range packets {
+		err := WritePacket(&buf, p)
+		if err != nil {
+			t.Fatalf("WritePacket: %v", err)
+		}
+	}
+	for _, want := range packets {
+		got, err := ReadPacket(&buf)
+		if err != nil {
+			t.Fatalf("ReadPacket: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got packet of length %d, want %d", len(got), len(want))
+		}
+	}
+	_, err := ReadPacket(&buf)
+	if err != io.EOF {
+		t.Fatalf("ReadPacket at end returned %v, want io.EOF", err)
+	}
+}
+
+func TestReadPacketTruncated(t *testing.T) {
+	_, err := ReadPacket(bytes.NewReader([]byte{0x00, 0x05, 'a', 'b'}))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestWritePacketTooLong(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("WritePacket did not panic on an oversized packet")
+		}
+	}()
+	WritePacket(io.Discard, make([]byte, 65536))
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	WritePacket(&buf, []byte("packet"))
+	WriteFeedback(&buf, 1234, 5*time.Second)
+	WritePacket(&buf, []byte("another"))
+
+	f, err := ReadFrame(&buf)
+	if err != nil || f.IsControl() || string(f.Body) != "packet" {
+		t.Fatalf("got %+v, %v, want packet", f, err)
+	}
+	f, err = ReadFrame(&buf)
+	if err != nil || f.Type != FrameFeedback {
+		t.Fatalf("got %+v, %v, want feedback frame", f, err)
+	}
+	n, elapsed, err := ParseFeedback(f.Body)
+	if err != nil || n != 1234 || elapsed != 5*time.Second {
+		t.Fatalf("ParseFeedback got %d, %v, %v, want 1234, 5s", n, elapsed, err)
+	}
+	f, err = ReadFrame(&buf)
+	if err != nil || f.IsControl() || string(f.Body) != "another" {
+		t.Fatalf("got %+v, %v, want packet", f, err)
+	}
+	_, err = ReadFrame(&buf)
+	if err != io.EOF {
+		t.Fatalf("ReadFrame at end returned %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	for _, b := range [][]byte{{0x00, 0x00}, {0x00, 0x00, FrameFeedback, 0x00, 0x10, 1}} {
+		_, err := ReadFrame(bytes.NewReader(b))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("%x: got %v, want io.ErrUnexpectedEOF", b, err)
+		}
+	}
+}
+
+func TestQueuePacketConn(t *testing.T) {
+	c := NewQueuePacketConn(stringAddr{"test", "local"}, 0)
+	defer c.Close()
+	addr := NewSessionID()
+
+	c.QueueIncoming([]byte("incoming"), addr)
+	buf := make([]byte, 100)
+	n, from, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "incoming" || from != addr {
+		t.Fatalf("ReadFrom returned %q from %v", buf[:n], from)
+	}
+
+	_, err = c.WriteTo([]byte("outgoing"), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-c.OutgoingQueue(addr):
+		if string(p) != "outgoing" {
+			t.Fatalf("OutgoingQueue returned %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nothing in OutgoingQueue")
+	}
+
+	c.Close()
+	_, _, err = c.ReadFrom(buf)
+	if err == nil {
+		t.Fatal("ReadFrom after Close succeeded")
+	}
+}
+
+func TestRemoteMapExpiry(t *testing.T) {
+	var inner remoteMapInner
+	inner.byAddr = make(map[string]int)
+	now := time.Now()
+	a, b := NewSessionID(), NewSessionID()
+	qa := inner.Lookup(a, now).SendQueue
+	inner.Lookup(b, now.Add(time.Minute))
+	if inner.Lookup(a, now).SendQueue != qa {
+		t.Fatal("Lookup created a second queue for the same address")
+	}
+
+	inner.removeExpired(now.Add(90*time.Second), time.Minute)
+	if inner.Len() != 1 {
+		t.Fatalf("%d records after expiry, want 1", inner.Len())
+	}
+	if _, ok := <-qa; ok {
+		t.Fatal("expired send queue was not closed")
+	}
+	if _, ok := inner.byAddr[b.String()]; !ok {
+		t.Fatal("unexpired record was removed")
+	}
+}
+
+func TestSessionIDAddr(t *testing.T) {
+	id := NewSessionID()
+	var addr net.Addr = id
+	if addr.Network() != "session" || len(addr.String()) != 2*len(id) {
+		t.Fatalf("unexpected address %s/%s", addr.Network(), addr.String())
+	}
+}
+
+func TestDedupFilter(t *testing.T) {
+	f := NewDedupFilter(2)
+	if f.Seen([]byte("a")) || f.Seen([]byte("b")) {
+		t.Fatal("first packets reported as copies")
+	}
+	if !f.Seen([]byte("a")) {
+		t.Fatal("copy not detected")
+	}
+	// "c" pushes out "a", the oldest.
+	if f.Seen([]byte("c")) {
+		t.Fatal("new packet reported as a copy")
+	}
+	if f.Seen([]byte("a")) {
+		t.Fatal("packet remembered beyond the window")
+	}
+}
+
+func TestListenerPacketConnClose(t *testing.T) {
+	ln1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewListenerPacketConn(ln1)
+	if err := c.AddListener(ln2); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	// Every listener is closed with c, and one added afterwards at once.
+	for _, ln := range []net.Listener{ln1, ln2} {
+		if _, err := ln.Accept(); err == nil {
+			t.Errorf("%v still accepting", ln.Addr())
+		}
+	}
+	ln3, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddListener(ln3); err != net.ErrClosed {
+		t.Errorf("AddListener after Close returned %v", err)
+	}
+	if _, err := ln3.Accept(); err == nil {
+		t.Error("listener added after Close still accepting")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(1000, 500, now)
+	if d := b.wait(500, now); d != 0 {
+		t.Fatalf("full bucket waits %v", d)
+	}
+	b.take(500)
+	if d := b.wait(100, now); d != 100*time.Millisecond {
+		t.Fatalf("empty bucket waits %v for 100 bytes", d)
+	}
+	// A packet larger than the burst goes once the bucket is full.
+	if d := b.wait(2000, now.Add(500*time.Millisecond)); d != 0 {
+		t.Fatalf("full bucket waits %v for a large packet", d)
+	}
+	if (*tokenBucket)(nil).wait(1<<30, now) != 0 {
+		t.Fatal("unlimited bucket waits")
+	}
+}
+
+func TestLimiterFairness(t *testing.T) {
+	const rate = 1500 * 200
+	l := newLimiter(RateLimit{GlobalRate: rate, GlobalBurst: 1500})
+	defer l.close()
+	done := make(chan struct{})
+	var sent [2]atomic.Int64
+	var wg sync.WaitGroup
+	// Session 0 sends on four conns at once, session 1 on one; each
+	// should still get half of the rate.
+	for i, conns := range []int{4, 1} {
+		var id turbotunnel.SessionID
+		id[0] = byte(i)
+		for j := 0; j < conns; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for {
+					if _, ok := l.waitSend(id, 1500, done); !ok {
+						return
+					}
+					sent[i].Add(1500)
+				}
+			}(i)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	a, b := sent[0].Load(), sent[1].Load()
+	if total := a + b; total > rate {
+		t.Errorf("sent %d bytes in half a second at %d bytes/s", total, rate)
+	}
+	if a > 2*b || b > 2*a {
+		t.Errorf("unfair shares: %d and %d bytes", a, b)
+	}
+}
+
+func TestLimiterAdmit(t *testing.T) {
+	l := newLimiter(RateLimit{SessionRate: 10000, SessionBurst: 3000})
+	defer l.close()
+	var id, other turbotunnel.SessionID
+	other[0] = 1
+	admitted := 0
+	for i := 0; i < 10; i++ {
+		if l.admit(id, 1000) {
+			admitted++
+		}
+	}
+	if admitted != 3 {
+		t.Errorf("admitted %d packets of the burst, want 3", admitted)
+	}
+	if !l.admit(other, 1000) {
+		t.Error("other session was limited")
+	}
+}
+
+// dialPath opens a path to addr, writes begin on it, and returns the path if
+// the server accepts it.
+func dialPath(addr net.Addr, begin []byte) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(begin)
+	if err == nil {
+		var f Frame
+		f, err = ReadFrame(conn)
+		if err == nil && f.Type != FrameAttachOK {
+			err = errors.New("path not accepted")
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, nil
+}
+
+// beginPath returns the session ID and FrameAttach that begin a path.
+func beginPath(id SessionID, secret []byte, establish bool) []byte {
+	var buf bytes.Buffer
+	buf.Write(id[:])
+	WriteAttach(&buf, id, secret, establish)
+	return buf.Bytes()
+}
+
+func TestAttach(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := metrics.New()
+	c := NewListenerPacketConn(ln, WithMetrics(m))
+	defer c.Close()
+	id := NewSessionID()
+	secret := NewSessionSecret()
+
+	establish := beginPath(id, secret, true)
+	conn, err := dialPath(ln.Addr(), establish)
+	if err != nil {
+		t.Fatalf("establishing path: %v", err)
+	}
+	defer conn.Close()
+	second := beginPath(id, secret, false)
+	conn, err = dialPath(ln.Addr(), second)
+	if err != nil {
+		t.Fatalf("second path: %v", err)
+	}
+	defer conn.Close()
+
+	// Knowing the session ID, or having seen another path begin, is not
+	// enough to attach a path.
+	other := NewSessionSecret()
+	var bare bytes.Buffer
+	bare.Write(id[:])
+	WritePacket(&bare, []byte("packet"))
+	for name, begin := range map[string][]byte{
+		"no attach frame":    bare.Bytes(),
+		"wrong secret":       beginPath(id, other, false),
+		"replacing secret":   beginPath(id, other, true),
+		"replayed attach":    second,
+		"replayed establish": establish,
+	} {
+		if conn, err := dialPath(ln.Addr(), begin); err == nil {
+			conn.Close()
+			t.Errorf("%s: path accepted", name)
+		}
+	}
+	if n := m.Get("rejected_paths"); n != 5 {
+		t.Errorf("counted %d rejected paths, want 5", n)
+	}
+	if _, err := dialPath(ln.Addr(), beginPath(id, secret, false)); err != nil {
+		t.Errorf("third path: %v", err)
+	}
+}
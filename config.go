@@ -0,0 +1,299 @@
+package splitpt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt/common/bridgeline"
+	"anticensorshiptrafficsplitting/splitpt/common/netem"
+	"anticensorshiptrafficsplitting/splitpt/common/split"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config is the client configuration, normally read from a TOML file with
+// LoadConfig. TOML keys are snake_case, such as active_paths, except those
+// of the original settings, splittingalg, lyrebirdpath and the connections'
+// transport, args, cert and bridge, which are the field names in lower case.
+type Config struct {
+	SplittingAlg string
+	// Redundancy is how many paths carry each packet when SplittingAlg is
+	// "redundant". It defaults to 2 and is limited to the number of
+	// connections.
+	Redundancy int `toml:"redundancy"`
+	// FlowletGap is the idle gap, such as "200ms", after which the
+	// "flowlet" algorithm moves to another path. It defaults to
+	// split.DefaultFlowletGap.
+	FlowletGap time.Duration `toml:"flowlet_gap"`
+	// SizeThreshold is the packet size, in bytes, below which the
+	// "size-class" algorithm sends packets on the paths whose Class is
+	// "latency". It defaults to split.DefaultSizeThreshold.
+	SizeThreshold int `toml:"size_threshold"`
+	// ActivePaths is how many of the connections carry a session at once.
+	// The rest are a pool of bridges standing by to replace paths that
+	// fail. Zero means all of them.
+	ActivePaths int `toml:"active_paths"`
+	// RotateEvery, if set, is how often, such as "1h", each session moves
+	// a path to a bridge of the pool that it is not using.
+	RotateEvery time.Duration `toml:"rotate_every"`
+	// AttachWait, if set, is how long, such as "10s", the other paths of
+	// a new session wait for the server to confirm the session secret
+	// sent on the first path before they send it too. It defaults to a
+	// multiple of the first path's delay measured in earlier sessions,
+	// or split.DefaultAttachWait.
+	AttachWait time.Duration `toml:"attach_wait"`
+	// Health configures the probes that detect paths a censor has
+	// black-holed.
+	Health       HealthCheck `toml:"health"`
+	LyrebirdPath string
+	Connections  map[string][]Connection
+	// BridgeLine, if set, is a splitpt bridge line, such as a server
+	// writes to its BridgeLineFile, with or without the leading
+	// "Bridge". Its paths are added to the connections, carried by
+	// lyrebird, its algorithm is used if SplittingAlg is not set, and
+	// its tuning preset becomes ServerTuning.
+	BridgeLine string `toml:"bridge_line"`
+	// Tuning configures KCP and smux. If its Preset is not set, it is
+	// ServerTuning.
+	Tuning Tuning `toml:"tuning"`
+	// ServerTuning, if set, is the tuning preset of the server, which
+	// Tuning must be compatible with. A BridgeLine sets it if it names
+	// one.
+	ServerTuning string `toml:"server_tuning"`
+}
+
+// HealthCheck configures path health checking, which is enabled unless
+// Disable is set. In TOML, it is the [health] table:
+//
+//	[health]
+//	interval = "1s"
+//	timeout = "5s"
+//	quarantine_after = 3
+//	quarantine_for = "30s"
+//	reinstate_after = 2
+type HealthCheck struct {
+	Disable bool `toml:"disable"`
+	split.HealthConfig
+}
+
+// defaultRedundancy is the Redundancy of a config that does not set it.
+const defaultRedundancy = 2
+
+// Connection describes one path of a split session: the PT that carries it and
+// the bridge it connects to.
+type Connection struct {
+	Transport string
+	// Method is the transport method to ask the child PT for, "obfs4"
+	// if empty.
+	Method string `toml:"method"`
+	Args   []string
+	Cert   string
+	Bridge string
+	// Class is "latency" for a path that should carry small packets, or
+	// "bulk" for one that should carry large packets, when the splitting
+	// algorithm is "size-class". Paths without a class carry both.
+	Class string `toml:"class"`
+	// Netem, if present, impairs this path with emulated latency, loss and
+	// so on. It is a debugging aid for comparing splitting algorithms and
+	// should not be used in production.
+	Netem *netem.Profile `toml:"netem"`
+
+	// id tells apart the connections of a Client's pool, several of which
+	// may go to the same bridge.
+	id int
+}
+
+// LoadConfig reads and validates a client TOML config file. The file may leave
+// out the connections if the client's paths come from the bridge lines tor
+// gives it instead; see ForBridge.
+func LoadConfig(tomlFilename string) (*Config, error) {
+	log.Printf("Decoding TOML")
+	var config Config
+	_, err := toml.DecodeFile(tomlFilename, &config)
+	if err != nil {
+		log.Printf("Error decoding TOML config")
+		return nil, err
+	}
+
+	err = config.useBridgeLine()
+	if err != nil {
+		return nil, err
+	}
+	// Check a copy, so that the tuning is left unresolved for the preset
+	// of a bridge given later.
+	checked := config
+	if len(config.Connections["connections"]) == 0 {
+		err = checked.validateSettings()
+	} else {
+		err = checked.validate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%v connections found", len(config.Connections["connections"]))
+	for _, conn := range config.Connections["connections"] {
+		log.Printf("Connection: %s %s", conn.Transport, conn.Bridge)
+	}
+	return &config, nil
+}
+
+// useBridgeLine adds the paths of the config's BridgeLine to its connections,
+// and clears it.
+func (config *Config) useBridgeLine() error {
+	if config.BridgeLine == "" {
+		return nil
+	}
+	b, err := bridgeline.Parse(config.BridgeLine)
+	if err != nil {
+		return fmt.Errorf("Invalid bridge_line in TOML: %w", err)
+	}
+	conns := append([]Connection(nil), config.Connections["connections"]...)
+	config.setConnections(append(conns, bridgeConnections(b)...))
+	config.useBridge(b)
+	config.BridgeLine = ""
+	return nil
+}
+
+// ForBridge returns a copy of config whose connections are the paths of b,
+// carried by lyrebird, for the bridge line whose arguments tor passes with a
+// SOCKS connection. As with BridgeLine, the bridge's algorithm is used if
+// SplittingAlg is not set, and its tuning preset becomes ServerTuning.
+func (config Config) ForBridge(b *bridgeline.Bridge) Config {
+	config.setConnections(bridgeConnections(b))
+	config.useBridge(b)
+	return config
+}
+
+// bridgeConnections returns a lyrebird connection for each path of b.
+func bridgeConnections(b *bridgeline.Bridge) []Connection {
+	var conns []Connection
+	for _, p := range b.Paths {
+		conns = append(conns, Connection{
+			Transport: "lyrebird",
+			Method:    p.Method,
+			Args:      p.Args,
+			Bridge:    p.Addr,
+		})
+	}
+	return conns
+}
+
+// setConnections makes conns the config's connections.
+func (config *Config) setConnections(conns []Connection) {
+	// The map may be shared with a copy of the config.
+	connections := map[string][]Connection{"connections": conns}
+	for k, v := range config.Connections {
+		if k != "connections" {
+			connections[k] = v
+		}
+	}
+	config.Connections = connections
+}
+
+// useBridge takes the algorithm and tuning preset the bridge b suggests.
+func (config *Config) useBridge(b *bridgeline.Bridge) {
+	if config.SplittingAlg == "" {
+		config.SplittingAlg = b.Alg
+	}
+	if b.Tuning != "" {
+		config.ServerTuning = b.Tuning
+	}
+}
+
+// pathClass parses the Class of a Connection.
+func pathClass(class string) (split.PathClass, error) {
+	switch class {
+	case "":
+		return split.ClassAny, nil
+	case "latency":
+		return split.ClassLatency, nil
+	case "bulk":
+		return split.ClassBulk, nil
+	}
+	return 0, fmt.Errorf("Invalid path class %q in TOML", class)
+}
+
+// validate checks the parts of the config that every client needs.
+func (config *Config) validate() error {
+	if len(config.Connections["connections"]) == 0 {
+		return errors.New("Error processing TOML: No connections specified")
+	}
+	return config.validateSettings()
+}
+
+// validateSettings is validate for a config that may not have connections
+// yet.
+func (config *Config) validateSettings() error {
+	for _, conn := range config.Connections["connections"] {
+		if err := config.validateConnection(conn); err != nil {
+			return err
+		}
+	}
+
+	switch config.SplittingAlg {
+	case "round-robin":
+	case "random":
+	case "adaptive-bandwidth":
+	case "per-stream":
+	case "redundant":
+	case "flowlet":
+	case "size-class":
+	default:
+		return errors.New("Invalid splitting algorithm in TOML")
+	}
+	if config.Redundancy < 0 || config.Redundancy > 255 {
+		return errors.New("Invalid redundancy in TOML")
+	}
+	if config.FlowletGap < 0 {
+		return errors.New("Invalid flowlet gap in TOML")
+	}
+	if config.SizeThreshold < 0 {
+		return errors.New("Invalid size threshold in TOML")
+	}
+	if config.ActivePaths < 0 {
+		return errors.New("Invalid active_paths in TOML")
+	}
+	if config.RotateEvery < 0 {
+		return errors.New("Invalid rotate_every in TOML")
+	}
+	if config.AttachWait < 0 {
+		return errors.New("Invalid attach_wait in TOML")
+	}
+	health := config.Health
+	if health.Interval < 0 || health.Timeout < 0 || health.QuarantineAfter < 0 ||
+		health.QuarantineFor < 0 || health.ReinstateAfter < 0 {
+		return errors.New("Invalid health check settings in TOML")
+	}
+	if config.Tuning.Preset == "" {
+		config.Tuning.Preset = config.ServerTuning
+	}
+	tuning, err := config.Tuning.resolve()
+	if err != nil {
+		return fmt.Errorf("Invalid tuning in TOML: %w", err)
+	}
+	if config.ServerTuning != "" {
+		err := tuning.CompatibleWith(Tuning{Preset: config.ServerTuning})
+		if err != nil {
+			return fmt.Errorf("Tuning in TOML does not suit the server's %q tuning: %w", config.ServerTuning, err)
+		}
+	}
+	config.Tuning = tuning
+	return nil
+}
+
+// validateConnection checks one connection of the config.
+func (config *Config) validateConnection(conn Connection) error {
+	if conn.Transport == "lyrebird" && config.LyrebirdPath == "" {
+		return errors.New("Error processing TOML: No path to lyrebird binary specified")
+	}
+	if _, err := pathClass(conn.Class); err != nil {
+		return err
+	}
+	if strings.ContainsAny(conn.Method, " ,=\n\x00") {
+		return fmt.Errorf("Invalid method %q in TOML", conn.Method)
+	}
+	return nil
+}
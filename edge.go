@@ -0,0 +1,160 @@
+package splitpt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt/common/link"
+)
+
+// edgeDialTimeout bounds how long an edge waits for a forwarded path to be
+// opened to the central node.
+const edgeDialTimeout = 30 * time.Second
+
+// EdgeConfig configures an Edge.
+type EdgeConfig struct {
+	// Central is the address of the central node's link listener.
+	Central string
+	// Key is the pre-shared key of the links between the nodes.
+	Key []byte
+	// Logger receives the edge's log messages. If nil, the standard
+	// logger is used.
+	Logger *log.Logger
+}
+
+// Edge is an edge node of a distributed splitpt server. Instead of
+// reassembling the paths that clients open to it, it forwards each one over a
+// link to the central node, which reassembles them together with the paths
+// that reach other edges. See package link.
+type Edge struct {
+	dialer *link.Dialer
+	logger *log.Logger
+
+	lock      sync.Mutex
+	lns       []net.Listener
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// ListenEdge starts an edge node on ln. The Edge takes ownership of ln and
+// closes it when it is itself closed.
+func ListenEdge(ln net.Listener, config EdgeConfig) (*Edge, error) {
+	if config.Central == "" {
+		return nil, errors.New("edge needs the address of the central node")
+	}
+	if len(config.Key) < link.MinKeyLen {
+		return nil, errors.New("edge needs a link key")
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	e := &Edge{
+		dialer: &link.Dialer{Addr: config.Central, Key: config.Key},
+		logger: logger,
+		closed: make(chan struct{}),
+	}
+	err := e.AddListener(ln)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// AddListener makes e also forward the paths it accepts from ln. The Edge
+// takes ownership of ln.
+func (e *Edge) AddListener(ln net.Listener) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	select {
+	case <-e.closed:
+		ln.Close()
+		return errListenerClosed
+	default:
+	}
+	e.lns = append(e.lns, ln)
+	go e.acceptLoop(ln)
+	return nil
+}
+
+// Addr returns the address of the net.Listener given to ListenEdge.
+func (e *Edge) Addr() net.Addr {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.lns[0].Addr()
+}
+
+// Close stops accepting paths and closes the link to the central node, and
+// with it every forwarded path.
+func (e *Edge) Close() error {
+	err := errListenerClosed
+	e.closeOnce.Do(func() {
+		e.lock.Lock()
+		close(e.closed)
+		err = nil
+		for _, ln := range e.lns {
+			if err2 := ln.Close(); err == nil {
+				err = err2
+			}
+		}
+		e.lock.Unlock()
+		if err2 := e.dialer.Close(); err == nil {
+			err = err2
+		}
+	})
+	return err
+}
+
+func (e *Edge) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			select {
+			case <-e.closed:
+			default:
+				e.logger.Printf("accept error: %s", err.Error())
+			}
+			return
+		}
+		go func() {
+			err := e.forward(conn)
+			if err != nil {
+				e.logger.Printf("Error forwarding path from %v: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// forward copies a path to and from the central node until either end closes
+// it.
+func (e *Edge) forward(conn net.Conn) error {
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), edgeDialTimeout)
+	defer cancel()
+	central, err := e.dialer.DialPath(ctx)
+	if err != nil {
+		return err
+	}
+	defer central.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(central, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, central)
+		done <- struct{}{}
+	}()
+	// Either end closing ends the path; the deferred closes stop the
+	// other copy.
+	<-done
+	return nil
+}
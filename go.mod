@@ -4,11 +4,16 @@ go 1.21.0
 
 toolchain go1.21.5
 
-require gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib v1.5.0
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/txthinking/socks5 v0.0.0-20230325130024-4230056ae301
+	github.com/xtaci/kcp-go/v5 v5.6.8
+	github.com/xtaci/smux v1.5.24
+	gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib v1.5.0
+)
 
 require (
 	cloud.google.com/go v0.26.0 // indirect
-	github.com/BurntSushi/toml v1.4.0 // indirect
 	github.com/census-instrumentation/opencensus-proto v0.2.1 // indirect
 	github.com/client9/misspell v0.3.4 // indirect
 	github.com/cncf/udpa/go v0.0.0-20191209042840-269d4d468f6f // indirect
@@ -44,10 +49,7 @@ require (
 	github.com/templexxx/xorsimd v0.4.2 // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
 	github.com/txthinking/runnergroup v0.0.0-20210608031112-152c7c4432bf // indirect
-	github.com/txthinking/socks5 v0.0.0-20230325130024-4230056ae301 // indirect
-	github.com/xtaci/kcp-go/v5 v5.6.8 // indirect
 	github.com/xtaci/lossyconn v0.0.0-20190602105132-8df528c0c9ae // indirect
-	github.com/xtaci/smux v1.5.24 // indirect
 	github.com/yuin/goldmark v1.4.13 // indirect
 	golang.org/x/crypto v0.17.0 // indirect
 	golang.org/x/exp v0.0.0-20190121172915-509febef88a4 // indirect
@@ -0,0 +1,74 @@
+package splitpt
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+
+	"anticensorshiptrafficsplitting/splitpt/common/ptproto"
+
+	"github.com/txthinking/socks5"
+)
+
+// lyrebirdConnect launches a lyrebird client process as described by child
+// and returns a SOCKS5 client for its method, and the process. If the process
+// cannot provide the method, or does not offer it within ptStartupTimeout, it
+// is killed and lyrebirdConnect returns an error, one of the ptproto error
+// types if the process reported it. Otherwise the process is killed when ctx
+// is done, if the caller has not killed it before.
+func lyrebirdConnect(ctx context.Context, logger *log.Logger, child childPT, args []string) (*socks5.Client, *ptProcess, error) {
+	logger.Printf("Conecting to Lyrebird")
+	startup := ptproto.ClientStartup{Method: child.method}
+	var method *ptproto.Method
+	logger.Printf("Waiting for method %s", child.method)
+	p, err := child.launch(ctx, logger, []string{
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=0",
+		"TOR_PT_CLIENT_TRANSPORTS=" + child.method,
+	}, func(text string) (bool, error) {
+		m, err := startup.Line(text)
+		if m != nil && m.Protocol != "socks5" {
+			return false, &ptproto.MethodError{Method: child.method, Message: "unsupported proxy protocol " + m.Protocol}
+		}
+		method = m
+		return m != nil, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.Printf("SOCKS5 addr: %s", method.Addr)
+
+	logger.Printf("Getting Lyrebird SOCKS client")
+	client, err := socks5.NewClient(method.Addr, encodeArgs(args), "\x00", 0, 0)
+	if err != nil {
+		logger.Printf("Error connecting to pt")
+		p.kill()
+		return nil, nil, err
+	}
+
+	return client, p, nil
+}
+
+// childConn is a conn through a child PT launched for it alone. Closing it
+// kills the process, so that replacing paths does not leave processes behind.
+type childConn struct {
+	net.Conn
+	p *ptProcess
+}
+
+func (c *childConn) Close() error {
+	err := c.Conn.Close()
+	c.p.kill()
+	return err
+}
+
+// encodeArgs encodes args as the SOCKS username of a connection through a
+// child PT, escaping semicolons and backslashes as pt-spec.txt says.
+func encodeArgs(args []string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `;`, `\;`)
+	var escaped []string
+	for _, arg := range args {
+		escaped = append(escaped, escape.Replace(arg))
+	}
+	return strings.Join(escaped, ";")
+}
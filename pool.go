@@ -0,0 +1,266 @@
+package splitpt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	split "anticensorshiptrafficsplitting/splitpt/common/split"
+)
+
+// The connections of a Config are a pool of bridges, of which ActivePaths
+// carry each session. When a path fails, the bridge is remembered as bad for a
+// while and the path is replaced with one to another bridge of the pool. The
+// client also tops up the shared session when it has lost paths and, if
+// RotateEvery is set, periodically moves one of its paths to another bridge.
+
+// badBridgeTimeout is how long a bridge whose path failed is avoided.
+const badBridgeTimeout = 6 * time.Hour
+
+// maintainInterval is how often the client tops up sessions that have fewer
+// paths than they should.
+const maintainInterval = 10 * time.Second
+
+// markBad records that the path to bridge failed.
+func (c *Client) markBad(bridge string) {
+	now := time.Now()
+	c.updateState(bridge, func(r *bridgeRecord) {
+		r.Failures++
+		r.LastFailure = now
+		r.BadUntil = now.Add(badBridgeTimeout)
+	})
+}
+
+// activePaths returns how many paths each session should have. It is called
+// with c.lock held.
+func (c *Client) activePaths() int {
+	n := len(c.config.Connections["connections"])
+	if c.config.ActivePaths > 0 && c.config.ActivePaths < n {
+		n = c.config.ActivePaths
+	}
+	return n
+}
+
+// candidates returns the connections of the pool that inUse does not report,
+// in the order to try them: those to good bridges in pool order, then those to
+// bad bridges, those that failed longest ago first. If good is set, bad
+// bridges are left out.
+func (c *Client) candidates(pool []Connection, inUse func(conn Connection) bool, good bool) []Connection {
+	now := time.Now()
+	var result, bad []Connection
+	badUntil := make(map[string]time.Time)
+	for _, conn := range pool {
+		if inUse != nil && inUse(conn) {
+			continue
+		}
+		if until := c.state.get(conn.Bridge).BadUntil; now.Before(until) {
+			bad = append(bad, conn)
+			badUntil[conn.Bridge] = until
+			continue
+		}
+		result = append(result, conn)
+	}
+	if good {
+		return result
+	}
+	sort.SliceStable(bad, func(i, j int) bool {
+		return badUntil[bad[i].Bridge].Before(badUntil[bad[j].Bridge])
+	})
+	return append(result, bad...)
+}
+
+// pool returns the connections of the pool.
+func (c *Client) pool() []Connection {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.config.Connections["connections"]
+}
+
+// dialFirst dials the first of conns that can be dialed, as the path of sess
+// with the given index, marking the bridges that cannot be dialed as bad. Each
+// connection is claimed for the path with the given limit before it is
+// dialed, and those that cannot be claimed are skipped. If none can be dialed,
+// the path is forgotten.
+func (c *Client) dialFirst(ctx context.Context, sess *session, index int, conns []Connection, limit int) (Connection, net.Conn, error) {
+	err := errors.New("no bridges to dial")
+	for _, conn := range conns {
+		err = sess.claim(index, conn, limit)
+		if err == errSessionFull {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		var ptconn net.Conn
+		ptconn, err = c.dialConnection(ctx, sess, index, conn)
+		if err == nil {
+			c.updateState(conn.Bridge, func(r *bridgeRecord) { r.Dials++ })
+			c.pathStatus(index, conn.Bridge, "CONNECT", "Success")
+			return conn, ptconn, nil
+		}
+		c.pathStatus(index, conn.Bridge, "CONNECT", "Failed", "ERRMSG", err.Error())
+		if ctx.Err() != nil {
+			// Out of time, which says nothing about the bridge.
+			break
+		}
+		c.warn("Error dialing %s: %s", conn.Bridge, err.Error())
+		c.markBad(conn.Bridge)
+	}
+	sess.forgetPath(index)
+	return Connection{}, nil, err
+}
+
+// replace dials a replacement for the path with the given index of sess,
+// which failed or was removed. It tries the connections of the pool that sess
+// is not using, those to good bridges first, and the path's own connection
+// last. It is the redial function of every session.
+func (c *Client) replace(sess *session, index int) (net.Conn, error) {
+	from, failed := sess.connectionOf(index)
+	if failed {
+		// The path failed, rather than being removed.
+		c.pathStatus(index, from.Bridge, "CONNECT", "Failed", "ERRMSG", "path failed")
+		c.markBad(from.Bridge)
+	}
+	pool := c.pool()
+	conns := c.candidates(pool, sess.uses, false)
+	for _, conn := range pool {
+		if failed && conn.id == from.id {
+			conns = append(conns, conn)
+		}
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, replaceTimeout)
+	defer cancel()
+	conn, ptconn, err := c.dialFirst(ctx, sess, index, conns, 0)
+	if err != nil {
+		c.warn("Error replacing path %d to %s: %s", index, from.Bridge, err.Error())
+		return nil, err
+	}
+	c.notice("Replaced path %d to %s with %s", index, from.Bridge, conn.Bridge)
+	return ptconn, nil
+}
+
+// addPath dials a new path for sess to the first of conns that can be dialed
+// and adds it to the session, unless the session already has limit paths, when
+// it returns errSessionFull.
+func (c *Client) addPath(ctx context.Context, sess *session, conns []Connection, limit int) error {
+	c.lock.Lock()
+	index := c.nextPath
+	c.nextPath++
+	c.lock.Unlock()
+	conn, ptconn, err := c.dialFirst(ctx, sess, index, conns, limit)
+	if err != nil {
+		return err
+	}
+	// The path is already recorded, for it to start from the last
+	// measurements of its bridge.
+	if sc, ok := sess.pconn.(*split.SizeClassPacketConn); ok {
+		// Already checked by validateConnection.
+		class, _ := pathClass(conn.Class)
+		err = sc.AddPathClass(index, ptconn, class)
+	} else {
+		err = sess.pconn.AddPath(index, ptconn)
+	}
+	if err != nil {
+		sess.forgetPath(index)
+		return err
+	}
+	c.notice("Added path %d to %s", index, conn.Bridge)
+	return nil
+}
+
+// maintain tops up the shared session whenever it has fewer paths than it
+// should, rotates one of its paths each RotateEvery, and saves the
+// rates measured on every path, until the client is closed.
+func (c *Client) maintain() {
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+	stats := time.NewTicker(statsInterval)
+	defer stats.Stop()
+	var rotate <-chan time.Time
+	if c.config.RotateEvery > 0 {
+		t := time.NewTicker(c.config.RotateEvery)
+		defer t.Stop()
+		rotate = t.C
+	}
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.refill()
+		case <-c.refillNow:
+			c.refill()
+		case <-rotate:
+			c.rotate()
+		case <-stats.C:
+			c.lock.Lock()
+			sessions := c.sessions()
+			c.lock.Unlock()
+			c.recordStats(sessions)
+		}
+	}
+}
+
+// kickRefill makes maintain top up the shared session now.
+func (c *Client) kickRefill() {
+	select {
+	case c.refillNow <- struct{}{}:
+	default:
+	}
+}
+
+// refill adds paths to the shared session until it has as many as it should,
+// or no more bridges of the pool can be dialed.
+func (c *Client) refill() {
+	c.lock.Lock()
+	sess, n := c.sess, c.activePaths()
+	c.lock.Unlock()
+	if sess == nil || sess.smux.IsClosed() {
+		return
+	}
+	// Paths being redialed count, as do those being added by AddPath.
+	for sess.pathCount() < n {
+		ctx, cancel := context.WithTimeout(c.ctx, replaceTimeout)
+		err := c.addPath(ctx, sess, c.candidates(c.pool(), sess.uses, false), n)
+		cancel()
+		if err == errSessionFull {
+			return
+		}
+		if err != nil {
+			c.warn("Error topping up session: %s", err.Error())
+			return
+		}
+	}
+}
+
+// rotate moves the oldest path of the shared session to a good bridge of the
+// pool that the session is not using, if there is one. The new path is added
+// before the old one is removed, so that the session never has fewer paths.
+// Per-stream sessions have a single path each, and are left alone.
+func (c *Client) rotate() {
+	c.lock.Lock()
+	sess, n := c.sess, c.activePaths()
+	c.lock.Unlock()
+	if sess == nil || sess.smux.IsClosed() {
+		return
+	}
+	oldest, ok := sess.oldestPath()
+	if !ok {
+		return
+	}
+	conns := c.candidates(c.pool(), sess.uses, true)
+	if len(conns) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, replaceTimeout)
+	err := c.addPath(ctx, sess, conns, n+1)
+	cancel()
+	if err != nil {
+		c.logger.Printf("Error rotating path %d: %s", oldest, err.Error())
+		return
+	}
+	c.notice("Rotating out path %d", oldest)
+	sess.removePath(oldest)
+}
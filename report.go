@@ -0,0 +1,102 @@
+package splitpt
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt/common/ptproto"
+)
+
+// Reporter receives messages for tor's log and PT status updates: the
+// Client's own, about what each of its paths is doing, and those of its child
+// PTs, passed on. The client binary hands them to tor over the managed proxy
+// protocol, so that tor's log and controllers show them.
+type Reporter interface {
+	// Log reports a message with a severity of "error", "warning",
+	// "notice", "info" or "debug", or of something else that stands for
+	// "notice".
+	Log(severity, message string)
+	// Status reports the status of transport as alternating keys and
+	// values, such as "ADDRESS", bridge, "CONNECT", "Success".
+	Status(transport string, kv ...string)
+}
+
+// WithReporter makes the Client report its paths' progress, and pass on the
+// log and status messages of its child PTs, to r.
+func WithReporter(r Reporter) Option {
+	return func(c *Client) { c.reporter = r }
+}
+
+// statusTransport is the transport the Client's own status updates are
+// about.
+const statusTransport = "splitpt"
+
+type nopReporter struct{}
+
+func (nopReporter) Log(severity, message string)          {}
+func (nopReporter) Status(transport string, kv ...string) {}
+
+// notice logs a message, and reports it for tor's log.
+func (c *Client) notice(format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	c.logger.Print(message)
+	c.reporter.Log("notice", message)
+}
+
+// warn logs a message, and reports it for tor's log as a warning.
+func (c *Client) warn(format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	c.logger.Print(message)
+	c.reporter.Log("warning", message)
+}
+
+// pathStatus reports the status of the path with the given index to bridge.
+func (c *Client) pathStatus(index int, bridge string, kv ...string) {
+	kv = append([]string{"ADDRESS", bridge, "PATH", strconv.Itoa(index)}, kv...)
+	c.reporter.Status(statusTransport, kv...)
+}
+
+// pathRTT reports the round-trip time and delivery rate last measured on the
+// path with the given index to bridge.
+func (c *Client) pathRTT(index int, bridge string, rtt time.Duration, rate float64) {
+	c.pathStatus(index, bridge,
+		"RTT", strconv.FormatInt(rtt.Milliseconds(), 10),
+		"RATE", strconv.FormatInt(int64(rate), 10))
+}
+
+// relayPT passes on a LOG or STATUS line from the child PT launched for
+// conn.
+func (c *Client) relayPT(conn Connection, line ptproto.Line) {
+	relayLine(c.reporter, conn.Transport, conn.Bridge, line)
+}
+
+// relayLine passes on to r a LOG or STATUS line from a child PT of the given
+// transport, whose log messages are prefixed with the transport and name.
+func relayLine(r Reporter, transport, name string, line ptproto.Line) {
+	switch line.Keyword {
+	case "LOG":
+		severity, _ := line.Get("SEVERITY")
+		message, _ := line.Get("MESSAGE")
+		r.Log(severity, fmt.Sprintf("%s %s: %s", transport, name, message))
+	case "STATUS":
+		if t, ok := line.Get("TRANSPORT"); ok {
+			transport = t
+		}
+		var kv []string
+		all := line.KeyValues()
+		for i := 0; i+1 < len(all); i += 2 {
+			if all[i] != "TRANSPORT" {
+				kv = append(kv, all[i], all[i+1])
+			}
+		}
+		r.Status(transport, kv...)
+	}
+}
+
+// relayStderr passes on a line a child PT launched for conn wrote to its
+// standard error, where PTs only write when something is badly wrong.
+func (c *Client) relayStderr(conn Connection, text string) {
+	c.logger.Printf("%s %s: %s", conn.Transport, conn.Bridge, text)
+	c.reporter.Log("warning", fmt.Sprintf("%s %s: %s", conn.Transport, conn.Bridge, text))
+}
@@ -0,0 +1,181 @@
+package splitpt
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"anticensorshiptrafficsplitting/splitpt/common/metrics"
+	"anticensorshiptrafficsplitting/splitpt/common/trace"
+	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+var errListenerClosed = errors.New("listener is closed")
+
+// ServerConfig configures a Listener.
+type ServerConfig struct {
+	// Logger receives the listener's log messages. If nil, the standard
+	// logger is used.
+	Logger *log.Logger
+	// Recorder, if not nil, records a trace of every path's frames.
+	Recorder *trace.Recorder
+	// RateLimit limits the rate of each session and of all of them
+	// together. The zero RateLimit limits nothing.
+	RateLimit tt.RateLimit
+	// Metrics, if not nil, counts the bytes the rate limits throttle and the
+	// paths that fail to authenticate.
+	Metrics *metrics.Metrics
+	// Tuning configures KCP and smux. Clients should use a compatible
+	// tuning; see Tuning.CompatibleWith.
+	Tuning Tuning
+}
+
+// Listener is a net.Listener for splitpt streams. It reassembles the paths
+// that clients open to the underlying net.Listeners into KCP/smux sessions and
+// returns each stream of each session from Accept. The paths of a session may
+// arrive on any of the net.Listeners.
+type Listener struct {
+	ln     net.Listener
+	pconn  *tt.ListenerPacketConn
+	kcpln  *kcp.Listener
+	logger *log.Logger
+	tuning Tuning
+
+	queue     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Listen starts a splitpt server on ln. The Listener takes ownership of ln and
+// closes it when it is itself closed.
+func Listen(ln net.Listener, config ServerConfig) (*Listener, error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	tuning, err := config.Tuning.resolve()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	// TurboTunnel
+	pconn := tt.NewListenerPacketConn(ln,
+		tt.WithRecorder(config.Recorder),
+		tt.WithRateLimit(config.RateLimit),
+		tt.WithMetrics(config.Metrics))
+	kcpln, err := kcp.ServeConn(nil, 0, 0, pconn)
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+	l := &Listener{
+		ln:     ln,
+		pconn:  pconn,
+		kcpln:  kcpln,
+		logger: logger,
+		tuning: tuning,
+		queue:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	go func() {
+		err := l.acceptLoop()
+		if err != nil {
+			l.logger.Printf("accept error: %s", err.Error())
+		}
+	}()
+	return l, nil
+}
+
+// Accept returns the next stream opened by any client.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, errListenerClosed
+	case conn := <-l.queue:
+		return conn, nil
+	}
+}
+
+// Addr returns the address of the net.Listener given to Listen.
+func (l *Listener) Addr() net.Addr { return l.ln.Addr() }
+
+// AddListener makes l also accept paths from ln, sharing its sessions, so that
+// clients can split a session over several ports or addresses of the server.
+// The Listener takes ownership of ln.
+func (l *Listener) AddListener(ln net.Listener) error {
+	return l.pconn.AddListener(ln)
+}
+
+// Close stops accepting paths and streams and closes every session.
+func (l *Listener) Close() error {
+	err := errListenerClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.kcpln.Close()
+		err2 := l.pconn.Close()
+		if err == nil {
+			err = err2
+		}
+	})
+	return err
+}
+
+func (l *Listener) acceptLoop() error {
+	defer l.kcpln.Close()
+	for {
+		conn, err := l.kcpln.AcceptKCP()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			select {
+			case <-l.closed:
+				return nil
+			default:
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			err := l.acceptStreams(conn)
+			if err != nil {
+				l.logger.Printf("Error: %s", err)
+			}
+		}()
+	}
+}
+
+func (l *Listener) acceptStreams(conn *kcp.UDPSession) error {
+	l.tuning.configureKCP(conn)
+	sess, err := smux.Server(conn, l.tuning.smuxConfig())
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			select {
+			case <-l.closed:
+				return nil
+			default:
+			}
+			return err
+		}
+
+		select {
+		case l.queue <- stream:
+		case <-l.closed:
+			stream.Close()
+			return nil
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -15,9 +19,12 @@ import (
 
 	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
 
-	"github.com/xtaci/kcp-go/v5"
-	"github.com/xtaci/smux"
-
+	"anticensorshiptrafficsplitting/splitpt"
+	"anticensorshiptrafficsplitting/splitpt/common/link"
+	"anticensorshiptrafficsplitting/splitpt/common/metrics"
+	"anticensorshiptrafficsplitting/splitpt/common/ptproto"
+	"anticensorshiptrafficsplitting/splitpt/common/target"
+	"anticensorshiptrafficsplitting/splitpt/common/trace"
 	tt "anticensorshiptrafficsplitting/splitpt/common/turbotunnel"
 )
 
@@ -27,7 +34,17 @@ const (
 	TYPE = "tcp"
 )
 
-func proxy(local *net.TCPConn, stream *smux.Stream) {
+// How long an exit waits for a connection to a requested target.
+const exitDialTimeout = 30 * time.Second
+
+// metricsInterval is how often the server logs its metrics.
+const metricsInterval = 1 * time.Hour
+
+// streamHandler is called for every smux stream a client opens. It owns the
+// stream and is responsible for closing it.
+type streamHandler func(stream net.Conn) error
+
+func proxy(local *net.TCPConn, stream net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -52,74 +69,157 @@ func proxy(local *net.TCPConn, stream *smux.Stream) {
 
 }
 
-func handler(stream *smux.Stream, ptInfo pt.ServerInfo) error {
-	defer stream.Close()
-	or, err := pt.DialOr(&ptInfo, stream.RemoteAddr().String(), "splitpt")
-	if err != nil {
-		return err
+// orHandler returns a streamHandler that forwards each stream to tor's ORPort.
+func orHandler(ptInfo pt.ServerInfo) streamHandler {
+	return func(stream net.Conn) error {
+		defer stream.Close()
+		or, err := pt.DialOr(&ptInfo, stream.RemoteAddr().String(), "splitpt")
+		if err != nil {
+			return err
+		}
+		defer or.Close()
+		proxy(or, stream)
+
+		return nil
 	}
-	defer or.Close()
-	proxy(or, stream)
+}
 
-	return nil
+// exitHandler returns a streamHandler that reads the target address requested
+// at the start of each stream, dials it with dialer, and reports the result
+// back to the client before proxying. Targets that dialer refuses are answered
+// with target.ReplyNotAllowed.
+func exitHandler(dialer *target.Dialer) streamHandler {
+	return func(stream net.Conn) error {
+		defer stream.Close()
+		addr, err := target.ReadRequest(stream)
+		if err != nil {
+			return err
+		}
+		conn, err := dialer.Dial(addr)
+		if err != nil {
+			target.WriteReply(stream, target.ReplyCode(err))
+			return err
+		}
+		defer conn.Close()
+		err = target.WriteReply(stream, target.ReplySucceeded)
+		if err != nil {
+			return err
+		}
+		proxy(conn.(*net.TCPConn), stream)
+
+		return nil
+	}
 }
 
-func acceptLoop(kcpln *kcp.Listener, ptInfo pt.ServerInfo) error {
-	defer kcpln.Close()
-	for {
-		conn, err := kcpln.AcceptKCP()
+// serve runs a splitpt server on lns, passing each incoming stream to handler.
+// The paths of a session may arrive on any of lns.
+func serve(lns []net.Listener, handler streamHandler, config splitpt.ServerConfig) error {
+	sln, err := splitpt.Listen(lns[0], config)
+	if err != nil {
+		closeAll(lns)
+		return err
+	}
+	for _, ln := range lns[1:] {
+		err := sln.AddListener(ln)
 		if err != nil {
-			if e, ok := err.(net.Error); ok && e.Temporary() {
-				continue
-			}
-			log.Printf("accept error: %s", err.Error())
+			sln.Close()
 			return err
 		}
-		go func() {
-			defer conn.Close()
-			err := acceptStreams(conn, ptInfo)
+	}
+	go acceptLoop(sln, handler)
+	return nil
+}
+
+// listenAll listens on each of addrs, which may hold several
+// comma-separated addresses each.
+func listenAll(addrs []string) ([]net.Listener, error) {
+	var lns []net.Listener
+	for _, addr := range addrs {
+		for _, addr := range strings.Split(addr, ",") {
+			ln, err := net.Listen("tcp", addr)
 			if err != nil {
-				log.Printf("Error: %s", err)
+				closeAll(lns)
+				return nil, err
 			}
-		}()
+			lns = append(lns, ln)
+		}
 	}
-	return nil
+	return lns, nil
 }
 
-func acceptStreams(conn *kcp.UDPSession, ptInfo pt.ServerInfo) error {
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 2
-	smuxConfig.KeepAliveTimeout = 1 * time.Minute
-	sess, err := smux.Server(conn, smuxConfig)
-	if err != nil {
-		return err
+func closeAll(lns []net.Listener) {
+	for _, ln := range lns {
+		ln.Close()
 	}
-	defer sess.Close()
+}
 
+func acceptLoop(ln *splitpt.Listener, handler streamHandler) error {
+	defer ln.Close()
 	for {
-		stream, err := sess.AcceptStream()
+		stream, err := ln.Accept()
 		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				continue
-			}
+			log.Printf("accept error: %s", err.Error())
 			return err
 		}
-
 		go func() {
-			defer stream.Close()
-			err := handler(stream, ptInfo)
+			err := handler(stream)
 			if err != nil {
 				log.Printf("Error: %s", err)
 			}
 		}()
 	}
-	return nil
+}
 
+// startBackends launches the backing PT servers of config, which forward the
+// paths they accept to the splitpt listener at orAddr.
+func startBackends(config splitpt.BackendConfig, orAddr net.Addr) (*splitpt.Backends, error) {
+	if config.StateDir != "" {
+		err := os.MkdirAll(config.StateDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	backends, err := splitpt.StartBackends(config, orAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Backends started; bridge line in %s:\n%s",
+		filepath.Join(config.StateDir, splitpt.BridgeLineFile), backends.BridgeLine())
+	return backends, nil
+}
+
+// options holds the command-line flags that run needs.
+type options struct {
+	listenAddr       string
+	traceFilename    string
+	traceTCP         bool
+	backendsFilename string
+	stateDir         string
+	linkAddr         string
+	edgeAddr         string
+	linkKeyFilename  string
+	sessionRate      int
+	globalRate       int
+	tuning           string
+	exitAllow        string
 }
 
 func main() {
+	var opts options
 	// Setup logging
 	logFileName := flag.String("log", "", "log file to write to")
+	flag.StringVar(&opts.listenAddr, "listen", "", "run as a standalone exit on these comma-separated addresses instead of as a Tor PT")
+	flag.StringVar(&opts.traceFilename, "trace", "", "record a packet trace of every path to this file")
+	flag.BoolVar(&opts.traceTCP, "trace-tcp", false, "also record TCP reads and writes in the packet trace")
+	flag.StringVar(&opts.backendsFilename, "backends", "", "launch the backing PT servers described in this toml file")
+	flag.StringVar(&opts.stateDir, "state", "", "keep state in this directory instead of TOR_PT_STATE_LOCATION")
+	flag.StringVar(&opts.linkAddr, "link-listen", "", "also reassemble the paths that edge nodes forward to this address")
+	flag.StringVar(&opts.edgeAddr, "edge", "", "run as an edge node, forwarding paths to the central node at this address (needs -listen)")
+	flag.StringVar(&opts.linkKeyFilename, "link-key", "", "file holding the base64 key of the links between edge and central nodes")
+	flag.IntVar(&opts.sessionRate, "session-rate", 0, "limit each session to this many bytes per second in each direction")
+	flag.IntVar(&opts.globalRate, "global-rate", 0, "limit all sessions together to this many bytes per second in each direction, shared fairly")
+	flag.StringVar(&opts.tuning, "tuning", "", "tune KCP and smux with this preset: default, low-latency, bulk or lossy")
+	flag.StringVar(&opts.exitAllow, "exit-allow", "", "let the standalone exit connect to these comma-separated CIDR prefixes, although they are loopback, private or link-local")
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.LUTC)
@@ -135,11 +235,150 @@ func main() {
 
 	log.Printf("Starting")
 
-	ptInfo, err := pt.ServerSetup(nil)
+	err := run(opts)
 	if err != nil {
-		log.Printf("Error setting up server: %s", err)
+		log.Printf("Error: %s", err)
 		os.Exit(1)
 	}
+}
+
+// run runs the server until it receives SIGTERM or SIGINT. Errors are
+// returned rather than fatal so that the deferred closes run, flushing the
+// trace and stopping the backends.
+func run(opts options) error {
+	var config splitpt.ServerConfig
+	if opts.traceFilename != "" {
+		recorder, err := trace.Create(opts.traceFilename, trace.Server)
+		if err != nil {
+			return fmt.Errorf("can't create trace: %w", err)
+		}
+		recorder.TCP = opts.traceTCP
+		defer recorder.Close()
+		config.Recorder = recorder
+	}
+	config.RateLimit = tt.RateLimit{SessionRate: opts.sessionRate, GlobalRate: opts.globalRate}
+	config.Tuning = splitpt.Tuning{Preset: opts.tuning}
+	m := metrics.New()
+	config.Metrics = m
+	metricsCtx, stopMetrics := context.WithCancel(context.Background())
+	defer stopMetrics()
+	go m.LogEvery(metricsCtx, log.Default(), metricsInterval)
+
+	var backendConfig *splitpt.BackendConfig
+	if opts.backendsFilename != "" {
+		var err error
+		backendConfig, err = splitpt.LoadBackendConfig(opts.backendsFilename)
+		if err != nil {
+			return fmt.Errorf("backends config: %w", err)
+		}
+		backendConfig.Logger = log.Default()
+		backendConfig.Tuning = opts.tuning
+	}
+
+	var linkKey []byte
+	if opts.linkAddr != "" || opts.edgeAddr != "" {
+		if opts.linkKeyFilename == "" {
+			return errors.New("-link-listen and -edge need -link-key")
+		}
+		var err error
+		linkKey, err = link.LoadKey(opts.linkKeyFilename)
+		if err != nil {
+			return err
+		}
+	}
+	// linkln, if not nil, accepts the paths that edge nodes forward.
+	var linkln net.Listener
+	if opts.linkAddr != "" {
+		ln, err := net.Listen("tcp", opts.linkAddr)
+		if err != nil {
+			return err
+		}
+		linkln = link.Listen(ln, linkKey, log.Default())
+		log.Printf("Accepting links from edge nodes on %v", ln.Addr())
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+
+	if opts.edgeAddr != "" {
+		if opts.listenAddr == "" {
+			return errors.New("-edge needs -listen")
+		}
+		lns, err := listenAll([]string{opts.listenAddr})
+		if err != nil {
+			return err
+		}
+		edge, err := splitpt.ListenEdge(lns[0], splitpt.EdgeConfig{Central: opts.edgeAddr, Key: linkKey})
+		if err != nil {
+			closeAll(lns)
+			return err
+		}
+		defer edge.Close()
+		for _, ln := range lns[1:] {
+			edge.AddListener(ln)
+		}
+		for _, ln := range lns {
+			log.Printf("Edge listening on %v, forwarding to %s", ln.Addr(), opts.edgeAddr)
+		}
+		if backendConfig != nil {
+			backendConfig.StateDir = opts.stateDir
+			backends, err := startBackends(*backendConfig, lns[0].Addr())
+			if err != nil {
+				return err
+			}
+			defer backends.Close()
+		}
+		<-sigChan
+		return nil
+	}
+
+	if opts.listenAddr != "" {
+		allow, err := target.ParsePrefixes(opts.exitAllow)
+		if err != nil {
+			return fmt.Errorf("-exit-allow: %w", err)
+		}
+		lns, err := listenAll([]string{opts.listenAddr})
+		if err != nil {
+			return err
+		}
+		if linkln != nil {
+			lns = append(lns, linkln)
+		}
+		dialer := &target.Dialer{Timeout: exitDialTimeout, Allow: allow}
+		err = serve(lns, exitHandler(dialer), config)
+		if err != nil {
+			return err
+		}
+		for _, ln := range lns {
+			log.Printf("Exit listening on %v", ln.Addr())
+		}
+		if backendConfig != nil {
+			backendConfig.StateDir = opts.stateDir
+			backends, err := startBackends(*backendConfig, lns[0].Addr())
+			if err != nil {
+				return err
+			}
+			defer backends.Close()
+		}
+		<-sigChan
+		return nil
+	}
+
+	ptInfo, err := pt.ServerSetup(nil)
+	if err != nil {
+		return fmt.Errorf("setting up server: %w", err)
+	}
+
+	if backendConfig != nil {
+		backendConfig.StateDir = opts.stateDir
+		if opts.stateDir == "" {
+			backendConfig.StateDir, err = pt.MakeStateDir()
+			if err != nil {
+				return fmt.Errorf("making state directory: %w", err)
+			}
+		}
+		backendConfig.Reporter = &ptproto.Writer{W: pt.Stdout}
+	}
 
 	for _, bindaddr := range ptInfo.Bindaddrs {
 		switch bindaddr.MethodName {
@@ -147,18 +386,44 @@ func main() {
 			ln, err := net.ListenTCP("tcp", bindaddr.Addr)
 			if err != nil {
 				log.Printf("Error: %s", err.Error())
+				pt.SmethodError(bindaddr.MethodName, err.Error())
 				break
 			}
 
-			// TurboTunnel
-			pconn := tt.NewListenerPacketConn(ln)
-			kcpln, err := kcp.ServeConn(nil, 0, 0, pconn)
+			// Further addresses, given with the listen= transport
+			// option, share the sessions of the bindaddr.
+			extra, err := listenAll(bindaddr.Options["listen"])
 			if err != nil {
+				ln.Close()
 				log.Printf("Error: %s", err.Error())
+				pt.SmethodError(bindaddr.MethodName, err.Error())
 				break
 			}
+			if linkln != nil {
+				// Forwarded paths join the first listener's sessions.
+				extra = append(extra, linkln)
+				linkln = nil
+			}
+			err = serve(append([]net.Listener{ln}, extra...), orHandler(ptInfo), config)
+			if err != nil {
+				log.Printf("Error: %s", err.Error())
+				pt.SmethodError(bindaddr.MethodName, err.Error())
+				break
+			}
+
+			if backendConfig != nil {
+				backends, err := startBackends(*backendConfig, ln.Addr())
+				if err != nil {
+					log.Printf("Error: %s", err.Error())
+					pt.SmethodError(bindaddr.MethodName, err.Error())
+					break
+				}
+				defer backends.Close()
+				pt.Log(pt.LogSeverityNotice, "splitpt bridge line: "+backends.BridgeLine())
+				// The backends forward to the first listener only.
+				backendConfig = nil
+			}
 
-			go acceptLoop(kcpln, ptInfo)
 			pt.Smethod(bindaddr.MethodName, ln.Addr())
 
 		default:
@@ -168,8 +433,6 @@ func main() {
 	}
 	pt.SmethodsDone()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM)
-
 	<-sigChan
+	return nil
 }
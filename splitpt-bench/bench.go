@@ -0,0 +1,377 @@
+// splitpt-bench compares splitting algorithms by running a client and server
+// in-process over emulated or loopback paths.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"anticensorshiptrafficsplitting/splitpt/common/harness"
+	"anticensorshiptrafficsplitting/splitpt/common/netem"
+)
+
+// Result is what one benchmark run reports. It is also the JSON output
+// format.
+type Result struct {
+	Algorithm string `json:"algorithm"`
+	Workload  string `json:"workload"`
+	Paths     int    `json:"paths"`
+
+	Bytes          int64   `json:"bytes"`
+	Seconds        float64 `json:"seconds"`
+	ThroughputMbps float64 `json:"throughput_mbps"`
+
+	Requests     int     `json:"requests,omitempty"`
+	LatencyP50Ms float64 `json:"latency_p50_ms,omitempty"`
+	LatencyP90Ms float64 `json:"latency_p90_ms,omitempty"`
+	LatencyP99Ms float64 `json:"latency_p99_ms,omitempty"`
+
+	// PathShare is the fraction of all path bytes, in both directions,
+	// carried by each path.
+	PathShare []float64 `json:"path_share"`
+
+	CPUSeconds float64 `json:"cpu_seconds"`
+	Allocs     uint64  `json:"allocs"`
+	AllocBytes uint64  `json:"alloc_bytes"`
+}
+
+type options struct {
+	algs     []string
+	paths    int
+	loopback bool
+	profiles []netem.Profile
+
+	workloads []string
+	size      int64
+	streams   int
+	requests  int
+	reqSize   int64
+	respSize  int64
+	timeout   time.Duration
+}
+
+// parseList splits a comma-separated flag value, expanding a single value to
+// n copies.
+func parseList(s string, n int) ([]string, error) {
+	if s == "" {
+		return make([]string, n), nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) == 1 {
+		for len(parts) < n {
+			parts = append(parts, parts[0])
+		}
+	}
+	if len(parts) != n {
+		return nil, fmt.Errorf("%q has %d values for %d paths", s, len(parts), n)
+	}
+	return parts, nil
+}
+
+// parseProfiles builds a netem profile for each path from per-path flag
+// values.
+func parseProfiles(n int, latency, jitter, bandwidth, loss string) ([]netem.Profile, error) {
+	latencies, err := parseList(latency, n)
+	if err != nil {
+		return nil, err
+	}
+	jitters, err := parseList(jitter, n)
+	if err != nil {
+		return nil, err
+	}
+	bandwidths, err := parseList(bandwidth, n)
+	if err != nil {
+		return nil, err
+	}
+	losses, err := parseList(loss, n)
+	if err != nil {
+		return nil, err
+	}
+	profiles := make([]netem.Profile, n)
+	impaired := false
+	for i := range profiles {
+		p := &profiles[i]
+		if latencies[i] != "" {
+			if p.Latency, err = time.ParseDuration(latencies[i]); err != nil {
+				return nil, err
+			}
+		}
+		if jitters[i] != "" {
+			if p.Jitter, err = time.ParseDuration(jitters[i]); err != nil {
+				return nil, err
+			}
+		}
+		if bandwidths[i] != "" {
+			if p.Bandwidth, err = strconv.Atoi(bandwidths[i]); err != nil {
+				return nil, err
+			}
+		}
+		if losses[i] != "" {
+			if p.Loss, err = strconv.ParseFloat(losses[i], 64); err != nil {
+				return nil, err
+			}
+		}
+		impaired = impaired || !p.IsZero()
+	}
+	if !impaired {
+		return nil, nil
+	}
+	return profiles, nil
+}
+
+func percentile(sorted []time.Duration, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(q * float64(len(sorted)-1))
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// run benchmarks one workload with one algorithm.
+func run(opts *options, alg, workload string) (*Result, error) {
+	counters := make([]*pathCounter, opts.paths)
+	for i := range counters {
+		counters[i] = &pathCounter{}
+	}
+	h, err := harness.Start(harness.Config{
+		SplittingAlg: alg,
+		Paths:        opts.paths,
+		Loopback:     opts.loopback,
+		Netem:        opts.profiles,
+		WrapPath: func(i int, conn net.Conn) net.Conn {
+			return &countingConn{Conn: conn, counter: counters[i]}
+		},
+		Handler: serveBench,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+	// Establish the session before measuring anything.
+	warmup, err := h.Client.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = exchange(warmup, 1, 1)
+	warmup.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range counters {
+		c.sent.Store(0)
+		c.received.Store(0)
+	}
+
+	result := &Result{Algorithm: alg, Workload: workload, Paths: opts.paths}
+	var latencies []time.Duration
+	var latenciesLock sync.Mutex
+
+	// Each stream runs do, which returns the payload bytes it moved.
+	var do func(conn net.Conn) (int64, error)
+	switch workload {
+	case "download":
+		do = func(conn net.Conn) (int64, error) {
+			return opts.size, exchange(conn, 0, uint64(opts.size))
+		}
+	case "upload":
+		do = func(conn net.Conn) (int64, error) {
+			return opts.size, exchange(conn, uint64(opts.size), 1)
+		}
+	case "reqresp":
+		do = func(conn net.Conn) (int64, error) {
+			var total int64
+			for i := 0; i < opts.requests; i++ {
+				start := time.Now()
+				err := exchange(conn, uint64(opts.reqSize), uint64(opts.respSize))
+				if err != nil {
+					return total, err
+				}
+				latenciesLock.Lock()
+				latencies = append(latencies, time.Since(start))
+				latenciesLock.Unlock()
+				total += opts.reqSize + opts.respSize
+			}
+			return total, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown workload %q", workload)
+	}
+
+	runtime.GC()
+	var memBefore, memAfter runtime.MemStats
+	runtime.ReadMemStats(&memBefore)
+	cpuBefore := cpuTime()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, opts.streams)
+	var total int64
+	var totalLock sync.Mutex
+	for i := 0; i < opts.streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := h.Client.DialContext(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetDeadline(deadline)
+			}
+			n, err := do(conn)
+			totalLock.Lock()
+			total += n
+			totalLock.Unlock()
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	elapsed := time.Since(start)
+	cpu := cpuTime() - cpuBefore
+	runtime.ReadMemStats(&memAfter)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	result.Bytes = total
+	result.Seconds = elapsed.Seconds()
+	result.ThroughputMbps = float64(total) * 8 / elapsed.Seconds() / 1e6
+	result.CPUSeconds = cpu.Seconds()
+	result.Allocs = memAfter.Mallocs - memBefore.Mallocs
+	result.AllocBytes = memAfter.TotalAlloc - memBefore.TotalAlloc
+
+	var pathTotal int64
+	for _, c := range counters {
+		pathTotal += c.sent.Load() + c.received.Load()
+	}
+	for _, c := range counters {
+		share := 0.0
+		if pathTotal > 0 {
+			share = float64(c.sent.Load()+c.received.Load()) / float64(pathTotal)
+		}
+		result.PathShare = append(result.PathShare, share)
+	}
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		result.Requests = len(latencies)
+		result.LatencyP50Ms = percentile(latencies, 0.50)
+		result.LatencyP90Ms = percentile(latencies, 0.90)
+		result.LatencyP99Ms = percentile(latencies, 0.99)
+	}
+	return result, nil
+}
+
+func printText(w io.Writer, results []*Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALGORITHM\tWORKLOAD\tMBIT/S\tP50 MS\tP90 MS\tP99 MS\tPATH SHARE\tCPU S\tALLOCS\tALLOC MB")
+	for _, r := range results {
+		var shares []string
+		for _, s := range r.PathShare {
+			shares = append(shares, fmt.Sprintf("%.0f%%", 100*s))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.2f\t%.1f\t%.1f\t%.1f\t%s\t%.2f\t%d\t%.1f\n",
+			r.Algorithm, r.Workload, r.ThroughputMbps,
+			r.LatencyP50Ms, r.LatencyP90Ms, r.LatencyP99Ms,
+			strings.Join(shares, "/"), r.CPUSeconds, r.Allocs, float64(r.AllocBytes)/1e6)
+	}
+	tw.Flush()
+}
+
+func main() {
+	algs := flag.String("algs", "round-robin,random,adaptive-bandwidth,per-stream,redundant,flowlet,size-class", "comma-separated splitting algorithms to compare")
+	paths := flag.Int("paths", 3, "number of paths")
+	loopback := flag.Bool("loopback", false, "use loopback TCP paths instead of in-memory pipes")
+	latency := flag.String("latency", "", "one-way latency, one value for all paths or a comma-separated value per path")
+	jitter := flag.String("jitter", "", "latency jitter, one value or one per path")
+	bandwidth := flag.String("bandwidth", "", "bandwidth cap in bytes per second, one value or one per path")
+	loss := flag.String("loss", "", "loss probability, one value or one per path")
+	workloads := flag.String("workloads", "download,upload,reqresp", "comma-separated workloads: download, upload, reqresp")
+	size := flag.Int64("size", 4*1024*1024, "bytes per stream for download and upload")
+	streams := flag.Int("streams", 1, "concurrent streams")
+	requests := flag.Int("requests", 100, "requests per stream for reqresp")
+	reqSize := flag.Int64("reqsize", 512, "request size for reqresp")
+	respSize := flag.Int64("respsize", 4096, "response size for reqresp")
+	timeout := flag.Duration("timeout", 5*time.Minute, "maximum time for each run")
+	jsonOutput := flag.Bool("json", false, "print results as JSON")
+	logFilename := flag.String("log", "", "name of log file for client and server messages")
+	flag.Parse()
+
+	log.SetFlags(log.LstdFlags | log.LUTC)
+	log.SetOutput(io.Discard)
+	if *logFilename != "" {
+		logFile, err := os.OpenFile(*logFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+
+	if *paths <= 0 || *streams <= 0 {
+		fmt.Fprintln(os.Stderr, errors.New("-paths and -streams must be positive"))
+		os.Exit(2)
+	}
+	profiles, err := parseProfiles(*paths, *latency, *jitter, *bandwidth, *loss)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	opts := &options{
+		algs:      strings.Split(*algs, ","),
+		paths:     *paths,
+		loopback:  *loopback,
+		profiles:  profiles,
+		workloads: strings.Split(*workloads, ","),
+		size:      *size,
+		streams:   *streams,
+		requests:  *requests,
+		reqSize:   *reqSize,
+		respSize:  *respSize,
+		timeout:   *timeout,
+	}
+
+	var results []*Result
+	for _, alg := range opts.algs {
+		for _, workload := range opts.workloads {
+			log.Printf("running %s with %s", workload, alg)
+			result, err := run(opts, alg, workload)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s with %s: %v\n", workload, alg, err)
+				os.Exit(1)
+			}
+			results = append(results, result)
+		}
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	} else {
+		printText(os.Stdout, results)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// cpuTime is not implemented on this platform and always returns 0.
+func cpuTime() time.Duration { return 0 }
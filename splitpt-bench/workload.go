@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// The benchmark protocol is a sequence of requests on a stream. Each request
+// is a header of two big-endian uint64s, n and m, followed by n bytes from the
+// client. The server discards the n bytes and answers with m bytes. Bulk
+// downloads, bulk uploads and request/response exchanges are all built from
+// this.
+const headerLen = 16
+
+func writeHeader(w io.Writer, n, m uint64) error {
+	var hdr [headerLen]byte
+	binary.BigEndian.PutUint64(hdr[0:8], n)
+	binary.BigEndian.PutUint64(hdr[8:16], m)
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+// serveBench is the server's stream handler.
+func serveBench(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	var hdr [headerLen]byte
+	for {
+		_, err := io.ReadFull(br, hdr[:])
+		if err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint64(hdr[0:8])
+		m := binary.BigEndian.Uint64(hdr[8:16])
+		_, err = io.CopyN(io.Discard, br, int64(n))
+		if err != nil {
+			return
+		}
+		_, err = io.CopyN(conn, zeroReader{}, int64(m))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// exchange sends one request of n bytes and reads the m-byte response.
+func exchange(conn net.Conn, n, m uint64) error {
+	errCh := make(chan error, 1)
+	go func() {
+		err := writeHeader(conn, n, m)
+		if err == nil {
+			_, err = io.CopyN(conn, zeroReader{}, int64(n))
+		}
+		errCh <- err
+	}()
+	_, err := io.CopyN(io.Discard, conn, int64(m))
+	if err2 := <-errCh; err == nil {
+		err = err2
+	}
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// countingConn counts the bytes that pass through a path in each direction.
+type countingConn struct {
+	net.Conn
+	counter *pathCounter
+}
+
+type pathCounter struct {
+	sent, received atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.counter.received.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.counter.sent.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,174 @@
+// splitpt-trace converts splitpt packet traces to the formats used by
+// website-fingerprinting classifiers.
+//
+// The csv format has one line per record, for all sessions and paths. The
+// cell format has one file per path of each session, with lines of
+// "time<TAB>direction" where direction is 1 for client-to-server and -1 for
+// server-to-client; each record becomes ceil(size/cell-size) such lines, or a
+// single line of the signed size if -cell-size is 0. Records whose session is
+// not known, such as the first TCP reads on a server's conn, have the session
+// 0000000000000000.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"anticensorshiptrafficsplitting/splitpt/common/trace"
+)
+
+func readTrace(filename string, layer trace.Layer) ([]trace.Record, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := trace.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var records []trace.Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		if rec.Layer == layer {
+			records = append(records, rec)
+		}
+	}
+}
+
+func writeCSV(w io.Writer, records []trace.Record) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "time,session,path,direction,layer,size")
+	for _, rec := range records {
+		fmt.Fprintf(bw, "%.6f,%s,%d,%s,%s,%d\n", rec.Time.Seconds(), rec.Session, rec.Path, rec.Direction, rec.Layer, rec.Size)
+	}
+	return bw.Flush()
+}
+
+func writeCells(w io.Writer, records []trace.Record, cellSize int) error {
+	bw := bufio.NewWriter(w)
+	for _, rec := range records {
+		sign := 1
+		if rec.Direction == trace.Downstream {
+			sign = -1
+		}
+		if cellSize <= 0 {
+			fmt.Fprintf(bw, "%.6f\t%d\n", rec.Time.Seconds(), sign*rec.Size)
+			continue
+		}
+		for n := 0; n < rec.Size; n += cellSize {
+			fmt.Fprintf(bw, "%.6f\t%d\n", rec.Time.Seconds(), sign)
+		}
+	}
+	return bw.Flush()
+}
+
+// pathKey identifies a path across the sessions of a trace.
+type pathKey struct {
+	session trace.SessionID
+	path    int
+}
+
+func run(filename, format, output string, layer trace.Layer, session string, path, cellSize int) error {
+	records, err := readTrace(filename, layer)
+	if err != nil {
+		return err
+	}
+	if session != "" || path >= 0 {
+		var filtered []trace.Record
+		for _, rec := range records {
+			if (session == "" || rec.Session.String() == session) && (path < 0 || rec.Path == path) {
+				filtered = append(filtered, rec)
+			}
+		}
+		records = filtered
+	}
+
+	switch format {
+	case "csv":
+		if output == "" {
+			return writeCSV(os.Stdout, records)
+		}
+		f, err := os.Create(output + ".csv")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return writeCSV(f, records)
+	case "cell":
+		byPath := make(map[pathKey][]trace.Record)
+		for _, rec := range records {
+			key := pathKey{rec.Session, rec.Path}
+			byPath[key] = append(byPath[key], rec)
+		}
+		if output == "" {
+			if len(byPath) > 1 {
+				return errors.New("the cell format needs -o, or -session and -path to select a single path")
+			}
+			return writeCells(os.Stdout, records, cellSize)
+		}
+		var keys []pathKey
+		for key := range byPath {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].session != keys[j].session {
+				return keys[i].session.String() < keys[j].session.String()
+			}
+			return keys[i].path < keys[j].path
+		})
+		for _, key := range keys {
+			f, err := os.Create(fmt.Sprintf("%s.%s.path%d.cell", output, key.session, key.path))
+			if err != nil {
+				return err
+			}
+			err = writeCells(f, byPath[key], cellSize)
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func main() {
+	format := flag.String("format", "csv", "output format: csv or cell")
+	output := flag.String("o", "", "output file prefix; cell output gets one file per path of each session")
+	tcp := flag.Bool("tcp", false, "convert TCP-layer records instead of frame records")
+	session := flag.String("session", "", "only convert records for this session, given in hex")
+	path := flag.Int("path", -1, "only convert records for this path")
+	cellSize := flag.Int("cell-size", 512, "bytes per cell in cell output, or 0 for one signed size per record")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] TRACEFILE\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	layer := trace.Frame
+	if *tcp {
+		layer = trace.TCP
+	}
+	err := run(flag.Arg(0), *format, *output, layer, *session, *path, *cellSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
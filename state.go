@@ -0,0 +1,198 @@
+package splitpt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	split "anticensorshiptrafficsplitting/splitpt/common/split"
+)
+
+// The client keeps what it learns about bridges in a JSON file in its state
+// directory, normally the one tor gives PTs in TOR_PT_STATE_LOCATION, so that
+// it survives restarts. Child PTs get a subdirectory of the state directory
+// each, named after the transport.
+
+// stateFileName is the name of the client's state file in the state
+// directory.
+const stateFileName = "splitpt-state.json"
+
+// stateVersion is the version of the state file's format. A file of a later
+// version is left alone.
+const stateVersion = 1
+
+// statsInterval is how often the client saves and reports the rates it has
+// measured.
+const statsInterval = 1 * time.Minute
+
+// bridgeRecord is what the client remembers about a bridge.
+type bridgeRecord struct {
+	// Dials counts the successful dials of the bridge, and Failures the
+	// paths to it that could not be dialed or failed.
+	Dials       int       `json:"dials"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	// BadUntil is when the bridge stops being avoided after a failure.
+	BadUntil time.Time `json:"bad_until"`
+	// Rate and MinDelay are the last measurements of a path to the
+	// bridge, from which new paths to it start their estimates.
+	Rate     float64       `json:"rate,omitempty"`
+	MinDelay time.Duration `json:"min_delay,omitempty"`
+}
+
+// stateData is the content of the state file.
+type stateData struct {
+	Version int                      `json:"version"`
+	Bridges map[string]*bridgeRecord `json:"bridges"`
+}
+
+// clientState is the client's persistent state. If it has a file, every
+// change is saved to it.
+type clientState struct {
+	lock sync.Mutex
+	file string
+	data stateData
+}
+
+// loadState reads the client's state from dir. If dir is empty, nothing is
+// remembered across restarts. If the state file cannot be read, the client
+// starts afresh, and if it is of an unknown version, it is also left as it is.
+func loadState(dir string) (*clientState, error) {
+	s := &clientState{data: stateData{
+		Version: stateVersion,
+		Bridges: make(map[string]*bridgeRecord),
+	}}
+	if dir == "" {
+		return s, nil
+	}
+	s.file = filepath.Join(dir, stateFileName)
+	data, err := os.ReadFile(s.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	var loaded stateData
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return s, err
+	}
+	if loaded.Version != stateVersion {
+		file := s.file
+		s.file = ""
+		return s, fmt.Errorf("%s has unknown version %d", file, loaded.Version)
+	}
+	if loaded.Bridges != nil {
+		s.data.Bridges = loaded.Bridges
+	}
+	return s, nil
+}
+
+// get returns what is remembered about bridge.
+func (s *clientState) get(bridge string) bridgeRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r, ok := s.data.Bridges[bridge]; ok {
+		return *r
+	}
+	return bridgeRecord{}
+}
+
+// update calls f with the record of bridge, creating it if need be, and saves
+// the state.
+func (s *clientState) update(bridge string, f func(r *bridgeRecord)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.data.Bridges[bridge]
+	if !ok {
+		r = &bridgeRecord{}
+		s.data.Bridges[bridge] = r
+	}
+	f(r)
+	return s.save()
+}
+
+// save writes the state to s.file, replacing it atomically. It is called with
+// s.lock held.
+func (s *clientState) save() error {
+	if s.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.data, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// updateState calls f with the record of bridge, logging any error saving the
+// state.
+func (c *Client) updateState(bridge string, f func(r *bridgeRecord)) {
+	err := c.state.update(bridge, f)
+	if err != nil {
+		c.logger.Printf("Error saving state: %s", err.Error())
+	}
+}
+
+// ptStateDir returns the state directory of the child PT for transport,
+// creating it if need be. Without a state directory of its own, the client
+// uses a temporary one, removed by Close.
+func (c *Client) ptStateDir(transport string) (string, error) {
+	c.tempOnce.Do(func() {
+		if c.stateDir == "" {
+			c.tempDir, c.tempErr = os.MkdirTemp("", "splitpt-state-")
+		}
+	})
+	dir := c.stateDir
+	if dir == "" {
+		if c.tempErr != nil {
+			return "", c.tempErr
+		}
+		dir = c.tempDir
+	}
+	dir = filepath.Join(dir, transport)
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// recordStats remembers the rates measured on every path of sessions, for
+// later paths to the same bridges, and reports them.
+func (c *Client) recordStats(sessions []*session) {
+	for _, sess := range sessions {
+		if sess == nil || sess.pconn == nil {
+			continue
+		}
+		for _, s := range sess.pconn.PathStats() {
+			bridge := sess.bridgeOf(s.Index)
+			if bridge == "" || s.Rate == 0 {
+				continue
+			}
+			c.pathRTT(s.Index, bridge, s.MinDelay, s.Rate)
+			c.updateState(bridge, func(r *bridgeRecord) {
+				r.Rate, r.MinDelay = s.Rate, s.MinDelay
+			})
+		}
+	}
+}
+
+// priorStats returns the function from which the paths of sess start their
+// estimates: the last measurements of their bridges, if there are any.
+func (c *Client) priorStats(sess *session) func(index int) (split.PathStats, bool) {
+	return func(index int) (split.PathStats, bool) {
+		bridge := sess.bridgeOf(index)
+		if bridge == "" {
+			return split.PathStats{}, false
+		}
+		r := c.state.get(bridge)
+		return split.PathStats{Index: index, Rate: r.Rate, MinDelay: r.MinDelay}, r.Rate > 0
+	}
+}
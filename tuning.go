@@ -0,0 +1,231 @@
+package splitpt
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// Tuning configures the KCP and smux layers of a session. Fields left zero, or
+// nil, take their values from the preset. In the client's TOML, it is the
+// [tuning] table:
+//
+//	[tuning]
+//	preset = "lossy"
+//	mtu = 1200
+//
+// The client and server of a session need not be tuned alike, but some
+// tunings do not work together; see CompatibleWith.
+type Tuning struct {
+	// Preset is "default", "low-latency", "bulk" or "lossy". Empty means
+	// "default".
+	Preset string
+	// NoDelay, Interval, Resend and NoCongestion are the parameters of
+	// KCP's nodelay mode: whether it retransmits sooner, how often it
+	// flushes, after how many skipping ACKs it retransmits a packet (0
+	// for never), and whether it does without congestion control.
+	NoDelay      *bool         `toml:"nodelay"`
+	Interval     time.Duration `toml:"interval"`
+	Resend       *int          `toml:"resend"`
+	NoCongestion *bool         `toml:"nc"`
+	// SendWindow and RecvWindow are KCP's window sizes, in packets.
+	SendWindow int `toml:"send_window"`
+	RecvWindow int `toml:"recv_window"`
+	// MTU is the size of the largest KCP packet, in bytes.
+	MTU int `toml:"mtu"`
+	// MaxReceiveBuffer and MaxStreamBuffer are how many bytes smux
+	// buffers for the whole session and for each stream.
+	MaxReceiveBuffer int `toml:"max_receive_buffer"`
+	MaxStreamBuffer  int `toml:"max_stream_buffer"`
+	// KeepAliveInterval is how often smux sends keepalives, and
+	// KeepAliveTimeout how long it waits for anything from the other end
+	// before it closes the session.
+	KeepAliveInterval time.Duration `toml:"keepalive_interval"`
+	KeepAliveTimeout  time.Duration `toml:"keepalive_timeout"`
+}
+
+// maxMTU is the largest MTU that KCP reads whole.
+const maxMTU = 1500
+
+// minMTU is the smallest MTU allowed, leaving room for data after KCP's
+// 24-byte header.
+const minMTU = 576
+
+// tuningPresets holds the named presets, each of which sets every field.
+var tuningPresets = map[string]Tuning{
+	// KCP's own defaults, with the smux buffers the client has always
+	// used.
+	"default": {
+		NoDelay: newBool(false), Interval: 100 * time.Millisecond, Resend: newInt(0), NoCongestion: newBool(false),
+		SendWindow: 32, RecvWindow: 32, MTU: 1400,
+		MaxReceiveBuffer: 4 * 1024 * 1024, MaxStreamBuffer: 1024 * 1024,
+		KeepAliveInterval: 10 * time.Second, KeepAliveTimeout: 1 * time.Minute,
+	},
+	// Quick retransmission and small buffers, for interactive streams.
+	"low-latency": {
+		NoDelay: newBool(true), Interval: 10 * time.Millisecond, Resend: newInt(2), NoCongestion: newBool(true),
+		SendWindow: 128, RecvWindow: 128, MTU: 1400,
+		MaxReceiveBuffer: 1024 * 1024, MaxStreamBuffer: 256 * 1024,
+		KeepAliveInterval: 10 * time.Second, KeepAliveTimeout: 1 * time.Minute,
+	},
+	// Large windows and buffers for throughput, keeping congestion
+	// control.
+	"bulk": {
+		NoDelay: newBool(false), Interval: 40 * time.Millisecond, Resend: newInt(2), NoCongestion: newBool(false),
+		SendWindow: 1024, RecvWindow: 1024, MTU: 1400,
+		MaxReceiveBuffer: 16 * 1024 * 1024, MaxStreamBuffer: 4 * 1024 * 1024,
+		KeepAliveInterval: 10 * time.Second, KeepAliveTimeout: 1 * time.Minute,
+	},
+	// Quick retransmission without congestion control, which would take
+	// loss for congestion, smaller packets, and a keepalive timeout that
+	// outlasts short outages.
+	"lossy": {
+		NoDelay: newBool(true), Interval: 20 * time.Millisecond, Resend: newInt(2), NoCongestion: newBool(true),
+		SendWindow: 512, RecvWindow: 512, MTU: 1200,
+		MaxReceiveBuffer: 8 * 1024 * 1024, MaxStreamBuffer: 2 * 1024 * 1024,
+		KeepAliveInterval: 10 * time.Second, KeepAliveTimeout: 3 * time.Minute,
+	},
+}
+
+func newBool(b bool) *bool { return &b }
+func newInt(n int) *int    { return &n }
+
+// resolve returns t with the fields it leaves unset taken from its preset,
+// and checks the result.
+func (t Tuning) resolve() (Tuning, error) {
+	if t.Preset == "" {
+		t.Preset = "default"
+	}
+	preset, ok := tuningPresets[t.Preset]
+	if !ok {
+		return t, fmt.Errorf("unknown tuning preset %q", t.Preset)
+	}
+	if t.NoDelay == nil {
+		t.NoDelay = preset.NoDelay
+	}
+	if t.Interval == 0 {
+		t.Interval = preset.Interval
+	}
+	if t.Resend == nil {
+		t.Resend = preset.Resend
+	}
+	if t.NoCongestion == nil {
+		t.NoCongestion = preset.NoCongestion
+	}
+	if t.SendWindow == 0 {
+		t.SendWindow = preset.SendWindow
+	}
+	if t.RecvWindow == 0 {
+		t.RecvWindow = preset.RecvWindow
+	}
+	if t.MTU == 0 {
+		t.MTU = preset.MTU
+	}
+	if t.MaxReceiveBuffer == 0 {
+		t.MaxReceiveBuffer = preset.MaxReceiveBuffer
+	}
+	if t.MaxStreamBuffer == 0 {
+		t.MaxStreamBuffer = preset.MaxStreamBuffer
+	}
+	if t.KeepAliveInterval == 0 {
+		t.KeepAliveInterval = preset.KeepAliveInterval
+	}
+	if t.KeepAliveTimeout == 0 {
+		t.KeepAliveTimeout = preset.KeepAliveTimeout
+	}
+
+	if t.Interval < 10*time.Millisecond || t.Interval > 5*time.Second {
+		return t, errors.New("tuning interval must be between 10ms and 5s")
+	}
+	if *t.Resend < 0 {
+		return t, errors.New("tuning resend must not be negative")
+	}
+	if t.SendWindow < 0 || t.RecvWindow < 0 {
+		return t, errors.New("tuning windows must not be negative")
+	}
+	if t.MTU < minMTU || t.MTU > maxMTU {
+		return t, fmt.Errorf("tuning mtu must be between %d and %d", minMTU, maxMTU)
+	}
+	err := smux.VerifyConfig(t.smuxConfig())
+	if err != nil {
+		return t, fmt.Errorf("bad smux tuning: %w", err)
+	}
+	// Each end of a session may be tuned alike.
+	err = t.compatibleWith(t)
+	if err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// CompatibleWith returns an error if sessions between an end tuned with t and
+// an end tuned with peer would not work well: if either end's keepalives are
+// too far apart for the other to wait for them, or if either end may
+// retransmit packets before the other, which acknowledges packets only once
+// per interval, has had time to.
+func (t Tuning) CompatibleWith(peer Tuning) error {
+	t, err := t.resolve()
+	if err != nil {
+		return err
+	}
+	peer, err = peer.resolve()
+	if err != nil {
+		return fmt.Errorf("peer: %w", err)
+	}
+	err = t.compatibleWith(peer)
+	if err != nil {
+		return err
+	}
+	return peer.compatibleWith(t)
+}
+
+// compatibleWith checks one direction of CompatibleWith, for resolved
+// tunings: that an end tuned with t waits long enough for the keepalives and
+// acknowledgments of an end tuned with peer.
+func (t Tuning) compatibleWith(peer Tuning) error {
+	if peer.KeepAliveInterval >= t.KeepAliveTimeout {
+		return fmt.Errorf("keepalive interval %v is not shorter than keepalive timeout %v",
+			peer.KeepAliveInterval, t.KeepAliveTimeout)
+	}
+	if peer.Interval > t.minRTO() {
+		return fmt.Errorf("interval %v is longer than the other end's minimum retransmission timeout %v",
+			peer.Interval, t.minRTO())
+	}
+	return nil
+}
+
+// minRTO is KCP's shortest retransmission timeout for t.
+func (t Tuning) minRTO() time.Duration {
+	if *t.NoDelay {
+		return 30 * time.Millisecond
+	}
+	return 100 * time.Millisecond
+}
+
+// configureKCP applies a resolved Tuning to conn.
+func (t Tuning) configureKCP(conn *kcp.UDPSession) {
+	conn.SetNoDelay(boolInt(*t.NoDelay), int(t.Interval/time.Millisecond), *t.Resend, boolInt(*t.NoCongestion))
+	conn.SetWindowSize(t.SendWindow, t.RecvWindow)
+	conn.SetMtu(t.MTU)
+}
+
+// smuxConfig returns the smux configuration of a resolved Tuning.
+func (t Tuning) smuxConfig() *smux.Config {
+	config := smux.DefaultConfig()
+	config.Version = 2
+	config.KeepAliveInterval = t.KeepAliveInterval
+	config.KeepAliveTimeout = t.KeepAliveTimeout
+	config.MaxReceiveBuffer = t.MaxReceiveBuffer
+	config.MaxStreamBuffer = t.MaxStreamBuffer
+	return config
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}